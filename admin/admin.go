@@ -0,0 +1,220 @@
+// Package admin serves a JSON API to inspect and manage the sessions, tunneled connections and
+// peers of a remotedialer server.
+//
+//	GET    /sessions                             sessions of clients and peers
+//	DELETE /sessions/{sessionKey}                disconnect a session
+//	GET    /sessions/{sessionKey}/connections    tunneled connections of a session
+//	DELETE /sessions/{sessionKey}/connections/{id}
+//	GET    /peers                                peers and the client keys they route to
+//	POST   /peers                                add a peer, {"id": ..., "url": ..., "token": ...}
+//	DELETE /peers/{id}
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rancher/remotedialer"
+	"github.com/sirupsen/logrus"
+)
+
+// Connection is a tunneled connection with its age.
+type Connection struct {
+	remotedialer.ConnectionInfo
+	Age time.Duration `json:"age"`
+}
+
+// Handler serves the admin API. Every request must be allowed by Authorizer, the client key it
+// returns naming the operator in the logs of actions.
+type Handler struct {
+	Server     *remotedialer.Server
+	Authorizer remotedialer.Authorizer
+	// Prefix is the path the API is served under, such as "/admin".
+	Prefix string
+
+	initOnce sync.Once
+	router   *mux.Router
+}
+
+type userCtx struct{}
+
+func withUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userCtx{}, user)
+}
+
+func user(ctx context.Context) string {
+	user, _ := ctx.Value(userCtx{}).(string)
+	return user
+}
+
+// New returns a Handler for server serving the API under prefix.
+func New(server *remotedialer.Server, auth remotedialer.Authorizer, prefix string) *Handler {
+	return &Handler{
+		Server:     server,
+		Authorizer: auth,
+		Prefix:     prefix,
+	}
+}
+
+func (h *Handler) init() {
+	router := mux.NewRouter()
+	r := router.PathPrefix(strings.TrimSuffix(h.Prefix, "/")).Subrouter()
+	r.HandleFunc("/sessions", h.listSessions).Methods(http.MethodGet)
+	r.HandleFunc("/sessions/{sessionKey}", h.closeSession).Methods(http.MethodDelete)
+	r.HandleFunc("/sessions/{sessionKey}/connections", h.listConnections).Methods(http.MethodGet)
+	r.HandleFunc("/sessions/{sessionKey}/connections/{id}", h.closeConnection).Methods(http.MethodDelete)
+	r.HandleFunc("/peers", h.listPeers).Methods(http.MethodGet)
+	r.HandleFunc("/peers", h.addPeer).Methods(http.MethodPost)
+	r.HandleFunc("/peers/{id}", h.removePeer).Methods(http.MethodDelete)
+	h.router = router
+}
+
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h.initOnce.Do(h.init)
+
+	if h.Authorizer == nil {
+		writeError(rw, http.StatusForbidden, errors.New("no authorizer configured"))
+		return
+	}
+
+	name, authed, err := h.Authorizer(req)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+	if !authed {
+		writeError(rw, http.StatusUnauthorized, errors.New("failed authentication"))
+		return
+	}
+
+	h.router.ServeHTTP(rw, req.WithContext(withUser(req.Context(), name)))
+}
+
+func (h *Handler) listSessions(rw http.ResponseWriter, req *http.Request) {
+	sessions := h.Server.Sessions()
+	if sessions == nil {
+		sessions = []remotedialer.SessionInfo{}
+	}
+	writeJSON(rw, http.StatusOK, sessions)
+}
+
+func (h *Handler) closeSession(rw http.ResponseWriter, req *http.Request) {
+	sessionKey, ok := intVar(rw, req, "sessionKey")
+	if !ok {
+		return
+	}
+	if !h.Server.CloseSession(sessionKey) {
+		writeError(rw, http.StatusNotFound, errors.New("session not found"))
+		return
+	}
+	logrus.Infof("Admin %s closed session %d", user(req.Context()), sessionKey)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) listConnections(rw http.ResponseWriter, req *http.Request) {
+	sessionKey, ok := intVar(rw, req, "sessionKey")
+	if !ok {
+		return
+	}
+	conns, ok := h.Server.SessionConnections(sessionKey)
+	if !ok {
+		writeError(rw, http.StatusNotFound, errors.New("session not found"))
+		return
+	}
+
+	now := time.Now()
+	result := make([]Connection, 0, len(conns))
+	for _, conn := range conns {
+		result = append(result, Connection{
+			ConnectionInfo: conn,
+			Age:            now.Sub(conn.Created),
+		})
+	}
+	writeJSON(rw, http.StatusOK, result)
+}
+
+func (h *Handler) closeConnection(rw http.ResponseWriter, req *http.Request) {
+	sessionKey, ok := intVar(rw, req, "sessionKey")
+	if !ok {
+		return
+	}
+	id, ok := intVar(rw, req, "id")
+	if !ok {
+		return
+	}
+	if !h.Server.CloseConnection(sessionKey, id) {
+		writeError(rw, http.StatusNotFound, errors.New("connection not found"))
+		return
+	}
+	logrus.Infof("Admin %s closed connection %d of session %d", user(req.Context()), id, sessionKey)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) listPeers(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, http.StatusOK, h.Server.Peers())
+}
+
+func (h *Handler) addPeer(rw http.ResponseWriter, req *http.Request) {
+	if h.Server.PeerID == "" {
+		writeError(rw, http.StatusConflict, errors.New("peering is not enabled, the server has no peer ID"))
+		return
+	}
+
+	var peer remotedialer.PeerInfo
+	if err := json.NewDecoder(req.Body).Decode(&peer); err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+	if peer.ID == "" || peer.URL == "" || peer.Token == "" {
+		writeError(rw, http.StatusBadRequest, errors.New("id, url and token are required"))
+		return
+	}
+
+	h.Server.AddPeer(peer.URL, peer.ID, peer.Token)
+	logrus.Infof("Admin %s added peer %s, %s", user(req.Context()), peer.ID, peer.URL)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) removePeer(rw http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	found := false
+	for _, p := range h.Server.Peers() {
+		if p.ID == id && p.URL != "" {
+			found = true
+		}
+	}
+	if !found {
+		writeError(rw, http.StatusNotFound, errors.New("peer not found"))
+		return
+	}
+
+	h.Server.RemovePeer(id)
+	logrus.Infof("Admin %s removed peer %s", user(req.Context()), id)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func intVar(rw http.ResponseWriter, req *http.Request, name string) (int64, bool) {
+	value, err := strconv.ParseInt(mux.Vars(req)[name], 10, 64)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, errors.New("invalid "+name))
+		return 0, false
+	}
+	return value, true
+}
+
+func writeJSON(rw http.ResponseWriter, code int, obj interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(obj)
+}
+
+func writeError(rw http.ResponseWriter, code int, err error) {
+	writeJSON(rw, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,165 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/remotedialer"
+	"github.com/rancher/remotedialer/remotedialertest"
+)
+
+// operator authorizes requests with the bearer token "secret" as the operator "alice".
+func operator(req *http.Request) (string, bool, error) {
+	return "alice", req.Header.Get("Authorization") == "Bearer secret", nil
+}
+
+// do serves a request to h with the operator token, decoding a JSON response into result.
+func do(t *testing.T, h http.Handler, method, path string, body io.Reader, result interface{}) int {
+	req := httptest.NewRequest(method, path, body)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if result != nil && rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAuthorization(t *testing.T) {
+	server := remotedialer.New(nil, remotedialer.DefaultErrorWriter)
+	tests := []struct {
+		auth remotedialer.Authorizer
+		code int
+	}{
+		{nil, http.StatusForbidden},
+		{func(*http.Request) (string, bool, error) { return "", false, nil }, http.StatusUnauthorized},
+		{func(*http.Request) (string, bool, error) { return "", false, errors.New("invalid token") }, http.StatusBadRequest},
+		{func(*http.Request) (string, bool, error) { return "alice", true, nil }, http.StatusOK},
+	}
+	for i, test := range tests {
+		rec := httptest.NewRecorder()
+		New(server, test.auth, "/admin").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/sessions", nil))
+		if rec.Code != test.code {
+			t.Errorf("%d: expected %d, got %d", i, test.code, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	New(server, operator, "/admin").ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/admin/sessions/1", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected %d for an action without credentials, got %d", http.StatusUnauthorized, rec.Code)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	harness := remotedialertest.New()
+	defer harness.Close()
+	client, err := harness.Connect("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Handle("tcp", "echo:7", remotedialertest.Echo)
+	h := New(harness.Server, operator, "/admin")
+
+	var sessions []remotedialer.SessionInfo
+	if code := do(t, h, http.MethodGet, "/admin/sessions", nil, &sessions); code != http.StatusOK {
+		t.Fatalf("listing sessions failed with %d", code)
+	}
+	if len(sessions) != 1 || sessions[0].ClientKey != "foo" || sessions[0].Peer {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+	prefix := "/admin/sessions/" + strconv.FormatInt(sessions[0].SessionKey, 10)
+
+	conn, err := harness.Server.Dial("foo", 5*time.Second, "tcp", "echo:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	var conns []Connection
+	if code := do(t, h, http.MethodGet, prefix+"/connections", nil, &conns); code != http.StatusOK {
+		t.Fatalf("listing connections failed with %d", code)
+	}
+	if len(conns) != 1 || conns[0].Address != "echo:7" || conns[0].Transmitted != 5 || conns[0].Age <= 0 {
+		t.Fatalf("unexpected connections %+v", conns)
+	}
+
+	// Kicking a connection
+	connection := prefix + "/connections/" + strconv.FormatInt(conns[0].ID, 10)
+	if code := do(t, h, http.MethodDelete, connection, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("closing the connection failed with %d", code)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection still open")
+	}
+	if code := do(t, h, http.MethodDelete, connection, nil, nil); code != http.StatusNotFound {
+		t.Fatalf("expected %d for a closed connection, got %d", http.StatusNotFound, code)
+	}
+	if code := do(t, h, http.MethodDelete, prefix+"/connections/x", nil, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected %d for an invalid connection ID, got %d", http.StatusBadRequest, code)
+	}
+
+	// Kicking the session
+	if code := do(t, h, http.MethodDelete, prefix, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("closing the session failed with %d", code)
+	}
+	if harness.Server.HasSession("foo") {
+		t.Fatal("session still connected")
+	}
+	if code := do(t, h, http.MethodDelete, prefix, nil, nil); code != http.StatusNotFound {
+		t.Fatalf("expected %d for a closed session, got %d", http.StatusNotFound, code)
+	}
+	if code := do(t, h, http.MethodGet, prefix+"/connections", nil, nil); code != http.StatusNotFound {
+		t.Fatalf("expected %d for the connections of a closed session, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestPeers(t *testing.T) {
+	server := remotedialer.New(nil, remotedialer.DefaultErrorWriter)
+	h := New(server, operator, "/admin")
+
+	peer := `{"id": "b", "url": "ws://127.0.0.1:1/connect", "token": "b-token"}`
+	if code := do(t, h, http.MethodPost, "/admin/peers", strings.NewReader(peer), nil); code != http.StatusConflict {
+		t.Fatalf("expected %d without a peer ID, got %d", http.StatusConflict, code)
+	}
+
+	server.PeerID = "a"
+	server.PeerToken = "a-token"
+	for _, body := range []string{"{", `{"id": "b", "url": "ws://127.0.0.1:1/connect"}`} {
+		if code := do(t, h, http.MethodPost, "/admin/peers", strings.NewReader(body), nil); code != http.StatusBadRequest {
+			t.Fatalf("%s: expected %d, got %d", body, http.StatusBadRequest, code)
+		}
+	}
+	if code := do(t, h, http.MethodPost, "/admin/peers", strings.NewReader(peer), nil); code != http.StatusNoContent {
+		t.Fatalf("adding the peer failed with %d", code)
+	}
+
+	var peers []remotedialer.PeerStatus
+	if code := do(t, h, http.MethodGet, "/admin/peers", nil, &peers); code != http.StatusOK {
+		t.Fatalf("listing peers failed with %d", code)
+	}
+	if len(peers) != 1 || peers[0].ID != "b" || peers[0].URL != "ws://127.0.0.1:1/connect" {
+		t.Fatalf("unexpected peers %+v", peers)
+	}
+
+	if code := do(t, h, http.MethodDelete, "/admin/peers/b", nil, nil); code != http.StatusNoContent {
+		t.Fatalf("removing the peer failed with %d", code)
+	}
+	if code := do(t, h, http.MethodDelete, "/admin/peers/b", nil, nil); code != http.StatusNotFound {
+		t.Fatalf("expected %d for a removed peer, got %d", http.StatusNotFound, code)
+	}
+}
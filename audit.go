@@ -0,0 +1,109 @@
+package remotedialer
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Types of AuditEvent.
+const (
+	// AuditConnect is a tunneled connection being dialed.
+	AuditConnect = "connect"
+	// AuditDenied is a connection refused by the ConnectAuthorizer or the limits of the
+	// session, or a websocket refused by the Authorizer.
+	AuditDenied = "denied"
+	// AuditClose is a tunneled connection closing.
+	AuditClose = "close"
+)
+
+// AuditEvent records who reached what through the tunnel.
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// ClientKey is the client dialing the connection, empty on the client itself.
+	ClientKey string `json:"clientKey,omitempty"`
+	// Peer is the peer the connection is relayed to or from.
+	Peer       string `json:"peer,omitempty"`
+	SessionKey int64  `json:"sessionKey,omitempty"`
+	ConnID     int64  `json:"connID,omitempty"`
+	Network    string `json:"network,omitempty"`
+	Address    string `json:"address,omitempty"`
+	// Caller identifies who asked for the connection, see DialOptions, or the remote address
+	// of a refused websocket.
+	Caller string `json:"caller,omitempty"`
+	// Transmitted, Received and Duration are set when the connection closes.
+	Transmitted int64         `json:"transmitted,omitempty"`
+	Received    int64         `json:"received,omitempty"`
+	Duration    time.Duration `json:"duration,omitempty"`
+	// Reason is why the connection was refused or closed.
+	Reason string `json:"reason,omitempty"`
+}
+
+// AuditSink receives the audit events of a Server or client session. Audit is called on the
+// path of the connection, so it should not block.
+type AuditSink interface {
+	Audit(event AuditEvent)
+}
+
+func (s *Session) auditEvent(eventType string, connID int64, network, address, caller string, reason error) AuditEvent {
+	event := AuditEvent{
+		Time:       time.Now(),
+		Type:       eventType,
+		SessionKey: s.sessionKey,
+		ConnID:     connID,
+		Network:    network,
+		Address:    address,
+		Caller:     caller,
+	}
+	if !s.client {
+		event.ClientKey = s.clientKey
+	}
+	if clientKey, proto, _, err := parseForwardedNetwork(network); err == nil {
+		event.ClientKey = clientKey
+		event.Network = proto
+		event.Peer = s.remotePeerID
+	}
+	if reason != nil {
+		event.Reason = reason.Error()
+	}
+	return event
+}
+
+// auditDenied records a connection refused before it was created.
+func (s *Session) auditDenied(connID int64, network, address, caller string, reason error) {
+	if s.onDenied != nil {
+		s.onDenied(network, address, reason)
+	}
+	if s.auditSink != nil {
+		s.auditSink.Audit(s.auditEvent(AuditDenied, connID, network, address, caller, reason))
+	}
+}
+
+func (c *connection) audit(eventType string, reason error) {
+	s := c.session
+	if s.auditSink == nil {
+		return
+	}
+
+	event := s.auditEvent(eventType, c.connID, c.addr.proto, c.addr.address, c.caller, reason)
+	if eventType == AuditClose {
+		event.Transmitted = atomic.LoadInt64(&c.transmitted)
+		event.Received = atomic.LoadInt64(&c.received)
+		event.Duration = time.Since(c.created)
+	}
+	s.auditSink.Audit(event)
+}
+
+// auditRefused records a websocket refused by the Authorizer.
+func (s *Server) auditRefused(req *http.Request, clientKey string, reason error) {
+	if s.Audit != nil {
+		s.Audit.Audit(AuditEvent{
+			Time:      time.Now(),
+			Type:      AuditDenied,
+			ClientKey: clientKey,
+			Caller:    req.RemoteAddr,
+			Reason:    reason.Error(),
+		})
+	}
+}
@@ -0,0 +1,244 @@
+// Package audit provides remotedialer.AuditSink implementations writing JSON lines to a file
+// or to the local syslog socket. File and Syslog write on the caller's goroutine, a Log buffers
+// the events for them.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rancher/remotedialer"
+	"github.com/sirupsen/logrus"
+)
+
+// File writes events to a file as JSON lines.
+type File struct {
+	sync.Mutex
+
+	path string
+	file *os.File
+}
+
+// NewFile appends events to the file path, creating it if needed.
+func NewFile(path string) (*File, error) {
+	f := &File{path: path}
+	if err := f.Reopen(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reopen reopens the file, such as after it was rotated.
+func (f *File) Reopen() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = file
+	return nil
+}
+
+func (f *File) Audit(event remotedialer.AuditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	f.Lock()
+	defer f.Unlock()
+
+	if _, err := f.file.Write(line); err != nil {
+		logrus.Errorf("Failed to write audit event to %s: %v", f.path, err)
+	}
+}
+
+func (f *File) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.file.Close()
+}
+
+// DefaultSyslogSocket is the syslog socket of most Linux systems.
+const DefaultSyslogSocket = "/dev/log"
+
+// severity and facility of the syslog messages, info and authpriv.
+const syslogPriority = 6 | 10<<3
+
+// Syslog sends events as JSON to the syslog daemon listening on a local unix socket.
+type Syslog struct {
+	sync.Mutex
+
+	address string
+	tag     string
+	conn    net.Conn
+}
+
+// NewSyslog connects to the syslog socket address, DefaultSyslogSocket if empty, tagging the
+// messages with tag.
+func NewSyslog(address, tag string) (*Syslog, error) {
+	if address == "" {
+		address = DefaultSyslogSocket
+	}
+	s := &Syslog{
+		address: address,
+		tag:     tag,
+	}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Syslog) connect() error {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	var err error
+	for _, network := range []string{"unixgram", "unix"} {
+		if s.conn, err = net.Dial(network, s.address); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *Syslog) Audit(event remotedialer.AuditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	// The local daemon adds the hostname, the timestamp is in the format of RFC 3164
+	msg := fmt.Sprintf("<%d>%s %s[%d]: %s\n", syslogPriority, time.Now().Format(time.Stamp), s.tag, os.Getpid(), line)
+	if s.conn != nil {
+		if _, err = s.conn.Write([]byte(msg)); err == nil {
+			return
+		}
+	}
+
+	// The daemon may have restarted
+	if err = s.connect(); err == nil {
+		_, err = s.conn.Write([]byte(msg))
+	}
+	if err != nil {
+		logrus.Errorf("Failed to send audit event to syslog %s: %v", s.address, err)
+	}
+}
+
+func (s *Syslog) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// Config enables the sinks of a Log.
+type Config struct {
+	// File appends events to this file as JSON lines if set.
+	File string `yaml:"file" json:"file"`
+	// Syslog sends events to this local syslog socket, such as /dev/log, if set.
+	Syslog string `yaml:"syslog" json:"syslog"`
+	// DropOnFull drops events while the sinks fall behind instead of holding up the
+	// connections, see Buffered.
+	DropOnFull bool `yaml:"dropOnFull" json:"dropOnFull"`
+}
+
+// Log sends events to the sinks enabled by a Config from a Buffered.
+type Log struct {
+	file     *File
+	syslog   *Syslog
+	buffered *Buffered
+}
+
+// New returns a Log for config, tagging syslog messages with tag, or nil if no sink is
+// enabled.
+func New(config Config, tag string) (*Log, error) {
+	if config.File == "" && config.Syslog == "" {
+		return nil, nil
+	}
+
+	l := &Log{}
+	var err error
+	if config.File != "" {
+		if l.file, err = NewFile(config.File); err != nil {
+			return nil, err
+		}
+	}
+	if config.Syslog != "" {
+		if l.syslog, err = NewSyslog(config.Syslog, tag); err != nil {
+			if l.file != nil {
+				l.file.Close()
+			}
+			return nil, err
+		}
+	}
+	l.buffered = NewBuffered(sinks{file: l.file, syslog: l.syslog}, DefaultBufferSize)
+	l.buffered.DropOnFull = config.DropOnFull
+	return l, nil
+}
+
+func (l *Log) Audit(event remotedialer.AuditEvent) {
+	l.buffered.Audit(event)
+}
+
+// Dropped returns how many events were dropped because the sinks fell behind, always 0 unless
+// DropOnFull is set.
+func (l *Log) Dropped() int64 {
+	return l.buffered.Dropped()
+}
+
+// Reopen reopens the file, such as after it was rotated.
+func (l *Log) Reopen() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Reopen()
+}
+
+// Close writes the buffered events and closes the sinks.
+func (l *Log) Close() error {
+	l.buffered.Close()
+	if l.file != nil {
+		l.file.Close()
+	}
+	if l.syslog != nil {
+		l.syslog.Close()
+	}
+	return nil
+}
+
+// sinks writes events to the sinks of a Log.
+type sinks struct {
+	file   *File
+	syslog *Syslog
+}
+
+func (s sinks) Audit(event remotedialer.AuditEvent) {
+	if s.file != nil {
+		s.file.Audit(event)
+	}
+	if s.syslog != nil {
+		s.syslog.Audit(event)
+	}
+}
@@ -0,0 +1,249 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher/remotedialer"
+)
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// readEvents reads the JSON lines of the file path.
+func readEvents(t *testing.T, path string) []remotedialer.AuditEvent {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var events []remotedialer.AuditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event remotedialer.AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestFile(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "audit.log")
+
+	f, err := NewFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Audit(remotedialer.AuditEvent{Type: remotedialer.AuditConnect, ClientKey: "foo", ConnID: 1, Address: "db:5432"})
+	f.Audit(remotedialer.AuditEvent{Type: remotedialer.AuditClose, ClientKey: "foo", ConnID: 1, Transmitted: 5})
+
+	events := readEvents(t, path)
+	if len(events) != 2 || events[0].Type != remotedialer.AuditConnect || events[0].Address != "db:5432" ||
+		events[1].Type != remotedialer.AuditClose || events[1].Transmitted != 5 {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	if info, err := os.Stat(path); err != nil || (runtime.GOOS != "windows" && info.Mode().Perm() != 0600) {
+		t.Fatalf("unexpected file %v, %v", info, err)
+	}
+
+	// Rotation
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	f.Audit(remotedialer.AuditEvent{Type: remotedialer.AuditDenied, ClientKey: "bar"})
+	if events := readEvents(t, path); len(events) != 1 || events[0].ClientKey != "bar" {
+		t.Fatalf("unexpected events after reopening %+v", events)
+	}
+	if events := readEvents(t, path+".1"); len(events) != 2 {
+		t.Fatalf("rotated file changed: %+v", events)
+	}
+}
+
+// listenSyslog listens on a unixgram socket in dir, returning its address and the messages
+// received.
+func listenSyslog(t *testing.T, dir string) (string, net.PacketConn, <-chan string) {
+	address := filepath.Join(dir, "log")
+	conn, err := net.ListenPacket("unixgram", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string, 16)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			messages <- string(buf[:n])
+		}
+	}()
+	return address, conn, messages
+}
+
+func receive(t *testing.T, messages <-chan string) string {
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no syslog message")
+		return ""
+	}
+}
+
+func TestSyslog(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix datagram sockets")
+	}
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	address, daemon, messages := listenSyslog(t, dir)
+
+	s, err := NewSyslog(address, "remotedialer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Audit(remotedialer.AuditEvent{Type: remotedialer.AuditConnect, ClientKey: "foo", Address: "db:5432"})
+
+	msg := receive(t, messages)
+	if !strings.HasPrefix(msg, "<86>") || !strings.Contains(msg, " remotedialer-test[") {
+		t.Fatalf("unexpected message %q", msg)
+	}
+	var event remotedialer.AuditEvent
+	if err := json.Unmarshal([]byte(msg[strings.Index(msg, "]: ")+3:]), &event); err != nil || event.ClientKey != "foo" || event.Address != "db:5432" {
+		t.Fatalf("unexpected event in %q: %v", msg, err)
+	}
+
+	// The daemon restarting
+	daemon.Close()
+	os.Remove(address)
+	address, daemon, messages = listenSyslog(t, dir)
+	defer daemon.Close()
+	s.Audit(remotedialer.AuditEvent{Type: remotedialer.AuditClose, ClientKey: "foo"})
+	if msg := receive(t, messages); !strings.Contains(msg, `"type":"close"`) {
+		t.Fatalf("unexpected message %q", msg)
+	}
+
+	if _, err := NewSyslog(filepath.Join(dir, "missing"), "remotedialer-test"); err == nil {
+		t.Fatal("connected to a missing socket")
+	}
+}
+
+// gatedSink counts the events passed once its gate is open.
+type gatedSink struct {
+	sync.Mutex
+	gate   chan struct{}
+	events int
+}
+
+func (g *gatedSink) Audit(remotedialer.AuditEvent) {
+	<-g.gate
+	g.Lock()
+	defer g.Unlock()
+	g.events++
+}
+
+func (g *gatedSink) count() int {
+	g.Lock()
+	defer g.Unlock()
+	return g.events
+}
+
+func TestBufferedBlocksWhenFull(t *testing.T) {
+	sink := &gatedSink{gate: make(chan struct{})}
+	b := NewBuffered(sink, 2)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			b.Audit(remotedialer.AuditEvent{})
+		}
+	}()
+	select {
+	case <-done:
+		t.Fatal("Audit did not wait for the sink")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(sink.gate)
+	<-done
+	b.Close()
+	if sink.count() != 10 || b.Dropped() != 0 {
+		t.Fatalf("passed %d events, dropped %d", sink.count(), b.Dropped())
+	}
+
+	// Events after Close are ignored
+	b.Audit(remotedialer.AuditEvent{})
+	if sink.count() != 10 {
+		t.Fatal("event passed after Close")
+	}
+}
+
+func TestBufferedDropOnFull(t *testing.T) {
+	sink := &gatedSink{gate: make(chan struct{})}
+	b := NewBuffered(sink, 2)
+	b.DropOnFull = true
+
+	for i := 0; i < 10; i++ {
+		b.Audit(remotedialer.AuditEvent{})
+	}
+	close(sink.gate)
+	b.Close()
+
+	// One event may have been taken by the sink before the buffer filled up
+	if passed := sink.count(); passed < 2 || passed > 3 || int64(passed)+b.Dropped() != 10 {
+		t.Fatalf("passed %d events, dropped %d", passed, b.Dropped())
+	}
+}
+
+func TestLog(t *testing.T) {
+	if l, err := New(Config{}, "remotedialer-test"); l != nil || err != nil {
+		t.Fatalf("expected no Log without sinks, got %v, %v", l, err)
+	}
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "audit.log")
+	if _, err := New(Config{File: path, Syslog: filepath.Join(dir, "missing")}, "remotedialer-test"); err == nil {
+		t.Fatal("created a Log with a missing syslog socket")
+	}
+
+	l, err := New(Config{File: path}, "remotedialer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		l.Audit(remotedialer.AuditEvent{Type: remotedialer.AuditConnect, ConnID: int64(i + 1)})
+	}
+	// Close writes the buffered events
+	l.Close()
+	events := readEvents(t, path)
+	if len(events) != 100 || events[99].ConnID != 100 || l.Dropped() != 0 {
+		t.Fatalf("wrote %d events, dropped %d", len(events), l.Dropped())
+	}
+}
@@ -0,0 +1,88 @@
+package audit
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/rancher/remotedialer"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultBufferSize is how many events a Log holds while its sinks are busy.
+const DefaultBufferSize = 4096
+
+// Buffered passes events to a sink from its own goroutine, so that Audit only blocks the
+// connections while the buffer is full.
+type Buffered struct {
+	// DropOnFull drops events while the buffer is full instead of waiting for the sink. Drops
+	// are counted by Dropped and logged once the sink catches up.
+	DropOnFull bool
+
+	sink    remotedialer.AuditSink
+	events  chan remotedialer.AuditEvent
+	done    chan struct{}
+	dropped int64
+
+	lock   sync.RWMutex
+	closed bool
+}
+
+// NewBuffered buffers up to size events for sink.
+func NewBuffered(sink remotedialer.AuditSink, size int) *Buffered {
+	b := &Buffered{
+		sink:   sink,
+		events: make(chan remotedialer.AuditEvent, size),
+		done:   make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *Buffered) run() {
+	defer close(b.done)
+
+	var reported int64
+	for event := range b.events {
+		b.sink.Audit(event)
+		if dropped := atomic.LoadInt64(&b.dropped); dropped != reported {
+			logrus.Warnf("Dropped %d audit events while the buffer was full", dropped-reported)
+			reported = dropped
+		}
+	}
+}
+
+func (b *Buffered) Audit(event remotedialer.AuditEvent) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if b.closed {
+		return
+	}
+	if !b.DropOnFull {
+		b.events <- event
+		return
+	}
+	select {
+	case b.events <- event:
+	default:
+		atomic.AddInt64(&b.dropped, 1)
+	}
+}
+
+// Dropped returns how many events were dropped because the buffer was full.
+func (b *Buffered) Dropped() int64 {
+	return atomic.LoadInt64(&b.dropped)
+}
+
+// Close stops accepting events, returning once the buffered ones are passed to the sink.
+func (b *Buffered) Close() error {
+	b.lock.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.events)
+	}
+	b.lock.Unlock()
+
+	<-b.done
+	return nil
+}
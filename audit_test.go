@@ -0,0 +1,164 @@
+package remotedialer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type auditRecorder struct {
+	sync.Mutex
+	events []AuditEvent
+}
+
+func (r *auditRecorder) Audit(event AuditEvent) {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, event)
+}
+
+// find returns the first event of eventType for address.
+func (r *auditRecorder) find(eventType, address string) (AuditEvent, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, event := range r.events {
+		if event.Type == eventType && event.Address == address {
+			return event, true
+		}
+	}
+	return AuditEvent{}, false
+}
+
+// wait waits for the first event of eventType for address.
+func (r *auditRecorder) wait(t *testing.T, eventType, address string) AuditEvent {
+	var event AuditEvent
+	if !waitFor(func() bool {
+		var ok bool
+		event, ok = r.find(eventType, address)
+		return ok
+	}) {
+		t.Fatalf("no %s event for %s", eventType, address)
+	}
+	return event
+}
+
+func TestAuditConnectAndClose(t *testing.T) {
+	echo, closeEcho := listenEcho(t)
+	defer closeEcho()
+	server, url, closeServer := newTestServer()
+	defer closeServer()
+	serverAudit := &auditRecorder{}
+	server.Audit = serverAudit
+
+	clientAudit := &auditRecorder{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connectClient(ctx, url, "foo", ClientOptions{Audit: clientAudit})
+	if !waitFor(func() bool { return server.HasSession("foo") }) {
+		t.Fatal("client did not connect")
+	}
+	session := clientSessions(server, "foo")[0]
+
+	conn, err := server.DialWithOptions("foo", 5*time.Second, "tcp", echo, DialOptions{Caller: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("hello"))
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	connect := serverAudit.wait(t, AuditConnect, echo)
+	if connect.ClientKey != "foo" || connect.SessionKey != session.sessionKey || connect.ConnID == 0 ||
+		connect.Network != "tcp" || connect.Caller != "alice" {
+		t.Fatalf("unexpected connect event %+v", connect)
+	}
+	closed := serverAudit.wait(t, AuditClose, echo)
+	if closed.ConnID != connect.ConnID || closed.Transmitted != 5 || closed.Received != 5 || closed.Duration <= 0 {
+		t.Fatalf("unexpected close event %+v", closed)
+	}
+
+	// The client records the same connection without its own client key
+	connect = clientAudit.wait(t, AuditConnect, echo)
+	if connect.ClientKey != "" || connect.ConnID != closed.ConnID || connect.Network != "tcp" {
+		t.Fatalf("unexpected client connect event %+v", connect)
+	}
+	closed = clientAudit.wait(t, AuditClose, echo)
+	if closed.Transmitted != 5 || closed.Received != 5 {
+		t.Fatalf("unexpected client close event %+v", closed)
+	}
+}
+
+func TestAuditDenied(t *testing.T) {
+	echo, closeEcho := listenEcho(t)
+	defer closeEcho()
+	server, url, closeServer := newTestServer()
+	defer closeServer()
+	serverAudit := &auditRecorder{}
+	server.Audit = serverAudit
+	server.Limits = Limits{MaxConnectionsPerSession: 1}
+
+	clientAudit := &auditRecorder{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connectClient(ctx, url, "foo", ClientOptions{
+		Auth:  func(proto, address string) bool { return address == echo },
+		Audit: clientAudit,
+	})
+	if !waitFor(func() bool { return server.HasSession("foo") }) {
+		t.Fatal("client did not connect")
+	}
+
+	// Refused by the limits of the session
+	conn, err := server.Dial("foo", 5*time.Second, "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.DialWithOptions("foo", 5*time.Second, "tcp", "127.0.0.1:2", DialOptions{Caller: "alice"}); err != ErrTooManyConnections {
+		t.Fatalf("expected %v, got %v", ErrTooManyConnections, err)
+	}
+	denied := serverAudit.wait(t, AuditDenied, "127.0.0.1:2")
+	if denied.ClientKey != "foo" || denied.Caller != "alice" || denied.Reason != ErrTooManyConnections.Error() {
+		t.Fatalf("unexpected denied event %+v", denied)
+	}
+	conn.Close()
+	serverAudit.wait(t, AuditClose, echo)
+
+	// Refused by the client's ConnectAuthorizer
+	conn, err = server.Dial("foo", 5*time.Second, "tcp", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	denied = clientAudit.wait(t, AuditDenied, "127.0.0.1:1")
+	if denied.Reason != ErrConnectNotAllowed.Error() {
+		t.Fatalf("unexpected denied event %+v", denied)
+	}
+}
+
+func TestAuditRefusedWebsocket(t *testing.T) {
+	server := New(func(req *http.Request) (string, bool, error) {
+		return "foo", false, nil
+	}, DefaultErrorWriter)
+	recorder := &auditRecorder{}
+	server.Audit = recorder
+	hs := httptest.NewServer(server)
+	defer hs.Close()
+
+	if _, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(hs.URL, "http"), nil); err == nil {
+		t.Fatal("websocket accepted")
+	}
+	denied := recorder.wait(t, AuditDenied, "")
+	if denied.ClientKey != "foo" || denied.Caller == "" || denied.Reason == "" {
+		t.Fatalf("unexpected denied event %+v", denied)
+	}
+}
@@ -3,29 +3,129 @@ package remotedialer
 import (
 	"context"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
 type ConnectAuthorizer func(proto, address string) bool
 
+const maxRedirects = 3
+
+// ClientOptions configures a connection made by ClientConnectWithOptions.
+type ClientOptions struct {
+	Headers   http.Header
+	Dialer    *websocket.Dialer
+	Auth      ConnectAuthorizer
+	OnConnect func(context.Context) error
+	// TokenSource, if set, is called before every connection attempt and the token is sent
+	// as an "Authorization: Bearer" header.
+	TokenSource TokenSource
+	// Resume, if set, lets tunneled connections survive a reconnect within the server's
+	// grace period.
+	Resume *ClientResume
+	// Stripes is the number of websockets to spread the session's connections over, up to the
+	// server's MaxStripes.
+	Stripes int
+	// Compression configures compression of the session, see CompressionConfig.
+	Compression CompressionConfig
+	// Priority, if set, schedules the data sent on connections dialed for the server.
+	Priority PriorityFunc
+	// Limits protects the client from the server, see Limits. MaxSessionsPerKey is unused.
+	Limits Limits
+	// InstanceID identifies this agent to the server's DuplicatePolicy. It should stay the same
+	// across reconnects and differ between agents using the same client key.
+	InstanceID string
+	// ServeOptions configures the pings of the session.
+	ServeOptions ServeOptions
+	// OnSession, if set, is called with the session once connected, such as to report its
+	// connections.
+	OnSession func(*Session)
+	// Audit, if set, records the connections dialed for the server, see AuditSink.
+	Audit AuditSink
+	// Dial, if set, dials the connections requested by the server instead of net.Dial.
+	Dial Dialer
+	// OnDenied, if set, is called with the connections refused by Auth or Limits, reason
+	// being ErrConnectNotAllowed or the limit reached.
+	OnDenied func(network, address string, reason error)
+}
+
 func ClientConnect(ctx context.Context, wsURL string, headers http.Header, dialer *websocket.Dialer, auth ConnectAuthorizer, onConnect func(context.Context) error) {
-	if err := connectToProxy(ctx, wsURL, headers, auth, dialer, onConnect); err != nil {
+	ClientConnectWithOptions(ctx, wsURL, ClientOptions{
+		Headers:   headers,
+		Dialer:    dialer,
+		Auth:      auth,
+		OnConnect: onConnect,
+	})
+}
+
+// ClientConnectWithOptions is ClientConnect with additional settings. Like ClientConnect it
+// returns when the connection ends and should be called in a loop to reconnect.
+func ClientConnectWithOptions(ctx context.Context, wsURL string, opts ClientOptions) {
+	if err := connectToProxy(ctx, wsURL, opts); err != nil {
 		logrus.WithError(err).Error("Remotedialer proxy error")
 		time.Sleep(time.Duration(5) * time.Second)
 	}
 }
 
-func connectToProxy(rootCtx context.Context, proxyURL string, headers http.Header, auth ConnectAuthorizer, dialer *websocket.Dialer, onConnect func(context.Context) error) error {
+// ConnectToProxyWithOptions connects to the server and serves the session until it ends,
+// returning nil if ctx is done or the server closed it cleanly. Unlike ClientConnect it doesn't
+// wait after an error, leaving the retry policy to the caller.
+func ConnectToProxyWithOptions(ctx context.Context, wsURL string, opts ClientOptions) error {
+	return connectToProxy(ctx, wsURL, opts)
+}
+
+func connectToProxy(rootCtx context.Context, proxyURL string, opts ClientOptions) error {
 	logrus.WithField("url", proxyURL).Info("Connecting to proxy")
 
+	dialer := opts.Dialer
 	if dialer == nil {
 		dialer = &websocket.Dialer{Proxy:http.ProxyFromEnvironment,HandshakeTimeout:HandshakeTimeOut}
 	}
-	ws, resp, err := dialer.Dial(proxyURL, headers)
+	if opts.Compression.WebsocketDeflate && !dialer.EnableCompression {
+		withCompression := *dialer
+		withCompression.EnableCompression = true
+		dialer = &withCompression
+	}
+
+	headers := opts.Headers
+	if opts.TokenSource != nil {
+		token, err := opts.TokenSource(rootCtx)
+		if err != nil {
+			return errors.Wrap(err, "failed to get token")
+		}
+		headers = cloneHeader(headers)
+		headers.Set("Authorization", "Bearer "+token)
+	}
+
+	if opts.Resume != nil {
+		headers = cloneHeader(headers)
+		headers.Set(ResumeToken, opts.Resume.headerToken())
+	}
+
+	if opts.Stripes > 1 {
+		headers = cloneHeader(headers)
+		headers.Set(Stripes, strconv.Itoa(opts.Stripes))
+	}
+
+	if opts.Compression.Deflate {
+		headers = cloneHeader(headers)
+		headers.Set(Compression, deflateEncoding)
+	}
+
+	if opts.InstanceID != "" {
+		headers = cloneHeader(headers)
+		headers.Set(InstanceID, opts.InstanceID)
+	}
+
+	ws, resp, err := dialFollowingRedirects(dialer, proxyURL, headers)
 	if err != nil {
 		if resp == nil {
 			logrus.WithError(err).Errorf("Failed to connect to proxy. Empty dialer response")
@@ -46,22 +146,52 @@ func connectToProxy(rootCtx context.Context, proxyURL string, headers http.Heade
 	ctx, cancel := context.WithCancel(rootCtx)
 	defer cancel()
 
-	if onConnect != nil {
+	if opts.OnConnect != nil {
 		go func() {
-			if err := onConnect(ctx); err != nil {
+			if err := opts.OnConnect(ctx); err != nil {
 				result <- err
 			}
 		}()
 	}
 
-	session := NewClientSession(auth, ws)
-	defer session.Close()
+	configure := func(session *Session) {
+		session.priority = opts.Priority
+		session.auditSink = opts.Audit
+		session.dialer = opts.Dial
+		session.onDenied = opts.OnDenied
+		session.setLimits(opts.Limits)
+		if resp.Header.Get(Compression) == deflateEncoding {
+			session.compression = opts.Compression
+			session.deflate = true
+		}
+	}
+
+	var session *Session
+	if opts.Resume != nil {
+		session, err = opts.Resume.sessionFor(opts.Auth, ws, resp, configure)
+		if err != nil {
+			return err
+		}
+		defer opts.Resume.detach(rootCtx)
+	} else {
+		session = NewClientSession(opts.Auth, ws)
+		configure(session)
+		defer session.Close()
+	}
+
+	if opts.OnSession != nil {
+		opts.OnSession(session)
+	}
 
 	go func() {
-		_, err = session.Serve(ctx)
+		_, err := session.ServeWithOptions(ctx, opts.ServeOptions)
 		result <- err
 	}()
 
+	if opts.Stripes > 1 {
+		dialStripes(ctx, session, dialer, proxyURL, headers, resp, opts.ServeOptions)
+	}
+
 	select {
 	case <-ctx.Done():
 		logrus.WithField("url", proxyURL).WithField("err", ctx.Err()).Info("Proxy done")
@@ -70,3 +200,60 @@ func connectToProxy(rootCtx context.Context, proxyURL string, headers http.Heade
 		return err
 	}
 }
+
+// dialFollowingRedirects dials the websocket and follows the redirects a server in
+// ClusterRedirect mode sends to the owner of the client key.
+func dialFollowingRedirects(dialer *websocket.Dialer, wsURL string, headers http.Header) (*websocket.Conn, *http.Response, error) {
+	ws, resp, err := dialer.Dial(wsURL, headers)
+	for i := 0; i < maxRedirects && err != nil && resp != nil; i++ {
+		if resp.StatusCode != http.StatusTemporaryRedirect && resp.StatusCode != http.StatusPermanentRedirect {
+			break
+		}
+
+		base, parseErr := url.Parse(wsURL)
+		if parseErr != nil {
+			break
+		}
+		location, parseErr := base.Parse(resp.Header.Get("Location"))
+		if parseErr != nil {
+			break
+		}
+
+		if location.Scheme != base.Scheme || !sameDomain(location.Hostname(), base.Hostname()) {
+			logrus.WithField("url", location.String()).Warn("Not following redirect out of the domain of the proxy")
+			break
+		}
+
+		wsURL = location.String()
+		logrus.WithField("url", wsURL).Info("Following redirect to proxy")
+		ws, resp, err = dialer.Dial(wsURL, headers)
+	}
+	return ws, resp, err
+}
+
+// sameDomain reports whether host is proxyHost or a sibling of it, such as a.example.com and
+// b.example.com. IP addresses must be equal.
+func sameDomain(host, proxyHost string) bool {
+	if strings.EqualFold(host, proxyHost) {
+		return true
+	}
+	if net.ParseIP(host) != nil || net.ParseIP(proxyHost) != nil {
+		return false
+	}
+	parent := func(h string) string {
+		parts := strings.SplitN(h, ".", 2)
+		if len(parts) != 2 || !strings.Contains(parts[1], ".") {
+			return ""
+		}
+		return strings.ToLower(parts[1])
+	}
+	return parent(host) != "" && parent(host) == parent(proxyHost)
+}
+
+func cloneHeader(headers http.Header) http.Header {
+	result := http.Header{}
+	for k, v := range headers {
+		result[k] = append([]string(nil), v...)
+	}
+	return result
+}
@@ -20,6 +20,7 @@ func clientDial(dialer Dialer, conn *connection, message *message) {
 	} else {
 		netConn, err = dialer(message.proto, message.address)
 	}
+	conn.session.dialDone()
 
 	if err != nil {
 		conn.tunnelClose(err)
@@ -0,0 +1,168 @@
+package remotedialer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// Forwarded is set to its PeerID by a member proxying a websocket request to the owning
+	// server, which then accepts it even if its own view of the membership differs.
+	Forwarded = "X-API-Tunnel-Forwarded"
+	// ForwardedToken authenticates Forwarded with the peer token of the proxying member.
+	ForwardedToken = "X-API-Tunnel-Forwarded-Token"
+)
+
+type ClusterMode int
+
+const (
+	// ClusterRedirect answers websocket requests for keys owned by another member with a
+	// temporary redirect to the owner's URL. ClientConnect follows these redirects.
+	ClusterRedirect ClusterMode = iota
+	// ClusterProxy proxies the websocket to the owner.
+	ClusterProxy
+)
+
+// Cluster assigns each client key to one member using rendezvous hashing, so agents end up on
+// the owning server and other members forward dials to it over their peer session instead of
+// propagating client keys to every peer. Members are the servers' PeerIDs and the URLs agents
+// connect to, and must include this server.
+type Cluster struct {
+	sync.RWMutex
+
+	Mode    ClusterMode
+	members []PeerInfo
+}
+
+func NewCluster(mode ClusterMode, members ...PeerInfo) *Cluster {
+	c := &Cluster{
+		Mode: mode,
+	}
+	c.SetMembers(members)
+	return c
+}
+
+func (c *Cluster) SetMembers(members []PeerInfo) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.members = append([]PeerInfo(nil), members...)
+}
+
+func (c *Cluster) Members() []PeerInfo {
+	c.RLock()
+	defer c.RUnlock()
+
+	return append([]PeerInfo(nil), c.members...)
+}
+
+// Owner returns the member responsible for clientKey.
+func (c *Cluster) Owner(clientKey string) (PeerInfo, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	var (
+		owner     PeerInfo
+		bestScore uint64
+		found     bool
+	)
+	for _, member := range c.members {
+		score := rendezvousScore(member.ID, clientKey)
+		if !found || score > bestScore || (score == bestScore && member.ID < owner.ID) {
+			owner = member
+			bestScore = score
+			found = true
+		}
+	}
+	return owner, found
+}
+
+func rendezvousScore(memberID, clientKey string) uint64 {
+	sum := sha256.Sum256([]byte(memberID + "\x00" + clientKey))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// forwardToOwner redirects or proxies the websocket request to the owner of clientKey and
+// returns true, or returns false if this server should accept it.
+func (s *Server) forwardToOwner(rw http.ResponseWriter, req *http.Request, clientKey string) bool {
+	if s.Cluster == nil {
+		return false
+	}
+	if id := req.Header.Get(Forwarded); id != "" && s.checkPeerToken(id, req.Header.Get(ForwardedToken)) {
+		return false
+	}
+
+	owner, ok := s.Cluster.Owner(clientKey)
+	if !ok || owner.ID == s.PeerID {
+		return false
+	}
+
+	if s.Cluster.Mode == ClusterRedirect {
+		logrus.Infof("Redirecting backend connection request [%s] to %s", clientKey, owner.ID)
+		http.Redirect(rw, req, owner.URL, http.StatusTemporaryRedirect)
+		return true
+	}
+
+	target, err := url.Parse(owner.URL)
+	if err != nil {
+		s.errorWriter(rw, req, 500, err)
+		return true
+	}
+	target.Scheme = strings.Replace(target.Scheme, "ws", "http", 1)
+
+	logrus.Infof("Proxying backend connection request [%s] to %s", clientKey, owner.ID)
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = target.Scheme
+			r.URL.Host = target.Host
+			r.URL.Path = target.Path
+			r.Host = target.Host
+			r.Header.Set(Forwarded, s.PeerID)
+			r.Header.Set(ForwardedToken, s.getPeerToken())
+		},
+		Transport:     s.getPeerTransport(),
+		FlushInterval: -1,
+	}
+	proxy.ServeHTTP(rw, req)
+	return true
+}
+
+// getPeerTransport returns the transport proxying websocket requests to other members.
+func (s *Server) getPeerTransport() *http.Transport {
+	s.peerTransportOnce.Do(func() {
+		s.peerTransport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: s.peerTLSConfig(),
+		}
+	})
+	return s.peerTransport
+}
+
+// clusterDialer returns a dialer that forwards to the owner of clientKey over its peer session.
+func (s *Server) clusterDialer(clientKey string, deadline time.Duration, caller string) (Dialer, bool) {
+	if s.Cluster == nil {
+		return nil, false
+	}
+
+	owner, ok := s.Cluster.Owner(clientKey)
+	if !ok || owner.ID == s.PeerID {
+		return nil, false
+	}
+
+	s.sessions.Lock()
+	defer s.sessions.Unlock()
+
+	sessions := s.sessions.peers[owner.ID]
+	if len(sessions) == 0 {
+		return nil, false
+	}
+	return toDialer(sessions[0], clientKey, 0, deadline, caller), true
+}
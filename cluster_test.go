@@ -0,0 +1,233 @@
+package remotedialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClusterOwner(t *testing.T) {
+	members := []PeerInfo{{ID: "a"}, {ID: "b"}, {ID: "c"}}
+	cluster := NewCluster(ClusterRedirect, members...)
+	reordered := NewCluster(ClusterRedirect, members[2], members[0], members[1])
+	shrunk := NewCluster(ClusterRedirect, members[0], members[1])
+
+	owned := map[string]int{}
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		owner, ok := cluster.Owner(key)
+		if !ok {
+			t.Fatal("no owner")
+		}
+		owned[owner.ID]++
+
+		if other, _ := reordered.Owner(key); other.ID != owner.ID {
+			t.Fatalf("owner of %s depends on the order of members", key)
+		}
+		// Only the keys of a removed member move
+		if other, _ := shrunk.Owner(key); owner.ID != "c" && other.ID != owner.ID {
+			t.Fatalf("%s moved from %s to %s", key, owner.ID, other.ID)
+		}
+	}
+	for _, member := range members {
+		if owned[member.ID] < 50 {
+			t.Fatalf("unbalanced ownership %v", owned)
+		}
+	}
+
+	if _, ok := NewCluster(ClusterRedirect).Owner("foo"); ok {
+		t.Fatal("owner found in an empty cluster")
+	}
+}
+
+// keyOwnedBy returns a client key owned by id.
+func keyOwnedBy(cluster *Cluster, id string) string {
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		if owner, _ := cluster.Owner(key); owner.ID == id {
+			return key
+		}
+	}
+}
+
+func TestClusterForwardedAuthentication(t *testing.T) {
+	server := newPeerTestServer()
+	server.Cluster = NewCluster(ClusterRedirect,
+		PeerInfo{ID: "a", URL: "ws://a.example.com/connect"},
+		PeerInfo{ID: "b", URL: "ws://b.example.com/connect"})
+	server.AddPeer("ws://127.0.0.1:1/connect", "b", "b-token")
+	defer server.RemovePeer("b")
+	key := keyOwnedBy(server.Cluster, "b")
+
+	forward := func(headers map[string]string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/connect", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		if !server.forwardToOwner(rw, req, key) {
+			return nil
+		}
+		return rw
+	}
+
+	if rw := forward(nil); rw == nil || rw.Code != http.StatusTemporaryRedirect ||
+		rw.Header().Get("Location") != "ws://b.example.com/connect" {
+		t.Fatal("request not redirected to the owner")
+	}
+	if rw := forward(map[string]string{Forwarded: "b"}); rw == nil {
+		t.Fatal("forwarded request without a token accepted")
+	}
+	if rw := forward(map[string]string{Forwarded: "b", ForwardedToken: "forged"}); rw == nil {
+		t.Fatal("forwarded request with a forged token accepted")
+	}
+	if rw := forward(map[string]string{Forwarded: "b", ForwardedToken: "b-token"}); rw != nil {
+		t.Fatal("forwarded request of the owner not accepted")
+	}
+
+	if rw := forward(nil); rw == nil {
+		t.Fatal("request for a key owned by another member accepted")
+	}
+	if rw := httptest.NewRecorder(); server.forwardToOwner(rw, httptest.NewRequest(http.MethodGet, "/connect", nil), keyOwnedBy(server.Cluster, "a")) {
+		t.Fatal("request for an owned key forwarded")
+	}
+}
+
+func TestSameDomain(t *testing.T) {
+	tests := []struct {
+		host, proxyHost string
+		same            bool
+	}{
+		{"a.example.com", "a.example.com", true},
+		{"b.example.com", "a.example.com", true},
+		{"B.Example.com", "a.example.com", true},
+		{"evil.com", "a.example.com", false},
+		{"example.com", "a.example.com", false},
+		{"a.b.example.com", "c.example.com", false},
+		{"evil.com", "example.com", false},
+		{"127.0.0.1", "127.0.0.1", true},
+		{"127.0.0.2", "127.0.0.1", false},
+		{"a.127.0.0.1", "127.0.0.1", false},
+	}
+	for _, test := range tests {
+		if sameDomain(test.host, test.proxyHost) != test.same {
+			t.Errorf("sameDomain(%s, %s) != %v", test.host, test.proxyHost, test.same)
+		}
+	}
+}
+
+func TestRedirectConfinedToDomain(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	hs := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/connect":
+			ws, err := upgrader.Upgrade(rw, req, nil)
+			if err == nil {
+				ws.Close()
+			}
+		default:
+			location := req.URL.Query().Get("to")
+			http.Redirect(rw, req, location, http.StatusTemporaryRedirect)
+		}
+	}))
+	defer hs.Close()
+
+	// Every host name resolves to the test server
+	var (
+		lock   sync.Mutex
+		dialed []string
+	)
+	dialer := &websocket.Dialer{
+		NetDial: func(network, address string) (net.Conn, error) {
+			lock.Lock()
+			dialed = append(dialed, address)
+			lock.Unlock()
+			return net.Dial(network, strings.TrimPrefix(hs.URL, "http://"))
+		},
+	}
+
+	tests := []struct {
+		to       string
+		followed bool
+	}{
+		{"ws://b.example.com/connect", true},
+		{"/connect", true},
+		{"ws://evil.com/connect", false},
+		{"ws://example.com/connect", false},
+		{"wss://a.example.com/connect", false},
+	}
+	for _, test := range tests {
+		lock.Lock()
+		dialed = nil
+		lock.Unlock()
+
+		ws, resp, err := dialFollowingRedirects(dialer, "ws://a.example.com/redirect?to="+test.to, nil)
+		if test.followed {
+			if err != nil {
+				t.Errorf("redirect to %s not followed: %v", test.to, err)
+				continue
+			}
+			ws.Close()
+		} else if err == nil || resp == nil || resp.StatusCode != http.StatusTemporaryRedirect {
+			t.Errorf("redirect to %s followed", test.to)
+		}
+
+		lock.Lock()
+		if !test.followed && len(dialed) != 1 {
+			t.Errorf("redirect to %s dialed %v", test.to, dialed)
+		}
+		lock.Unlock()
+	}
+}
+
+func testClusterMode(t *testing.T, mode ClusterMode) {
+	echo, closeEcho := listenEcho(t)
+	defer closeEcho()
+	a, aURL, closeA := newPeerServer("a")
+	defer closeA()
+	b, bURL, closeB := newPeerServer("b")
+	defer closeB()
+
+	cluster := NewCluster(mode, PeerInfo{ID: "a", URL: aURL}, PeerInfo{ID: "b", URL: bURL})
+	a.Cluster, b.Cluster = cluster, cluster
+	a.AddPeer(bURL, "b", "b-token")
+	b.AddPeer(aURL, "a", "a-token")
+
+	// The client connects to a, the key is owned by b
+	key := keyOwnedBy(cluster, "b")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connectClient(ctx, aURL, key, ClientOptions{})
+
+	if !waitFor(func() bool { return len(clientSessions(b, key)) == 1 }) {
+		t.Fatal("client did not end up on its owner")
+	}
+	if len(clientSessions(a, key)) != 0 {
+		t.Fatal("client accepted by a member not owning its key")
+	}
+	// Dials on a are forwarded to the owner over the peer session
+	if !waitFor(func() bool {
+		a.sessions.Lock()
+		defer a.sessions.Unlock()
+		return len(a.sessions.peers["b"]) > 0
+	}) {
+		t.Fatal("no peer session to the owner")
+	}
+	checkEcho(t, a, key, echo)
+	checkEcho(t, b, key, echo)
+}
+
+func TestClusterRedirect(t *testing.T) {
+	testClusterMode(t, ClusterRedirect)
+}
+
+func TestClusterProxy(t *testing.T) {
+	testClusterMode(t, ClusterProxy)
+}
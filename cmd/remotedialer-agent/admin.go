@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// serveAdmin serves the status, and closing tunneled connections with DELETE
+// /connections/<id>, on the unix socket path, accessible only to the user running the agent.
+func (a *agent) serveAdmin(path string) error {
+	// Remove the socket left by a previous run
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	l, err := listenPrivate(path)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", a.serveStatus)
+	mux.HandleFunc("/connections/", a.serveConnection)
+	go func() {
+		logrus.Fatal(http.Serve(l, mux))
+	}()
+	return nil
+}
+
+func (a *agent) serveConnection(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodDelete {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(req.URL.Path, "/connections/"), 10, 64)
+	if err != nil {
+		http.Error(rw, "invalid connection ID", http.StatusBadRequest)
+		return
+	}
+	if !a.closeConnection(id) {
+		http.Error(rw, "connection not found", http.StatusNotFound)
+		return
+	}
+
+	logrus.Infof("Closed connection %d", id)
+	rw.WriteHeader(http.StatusNoContent)
+}
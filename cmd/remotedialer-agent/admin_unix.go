@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// listenPrivate listens on the unix socket path, made accessible only to the user running the
+// agent. Until the chmod the socket has the access the umask gives, which lets no one else
+// connect unless the umask grants others write access.
+func listenPrivate(path string) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
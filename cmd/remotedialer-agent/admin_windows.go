@@ -0,0 +1,8 @@
+package main
+
+import "net"
+
+// listenPrivate listens on the unix socket path, its access being that of its directory.
+func listenPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
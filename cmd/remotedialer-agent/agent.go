@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rancher/remotedialer"
+	"github.com/rancher/remotedialer/audit"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	stateConnecting   = "connecting"
+	stateConnected    = "connected"
+	stateDisconnected = "disconnected"
+
+	// maxDenied is how many denied connections are kept for the status.
+	maxDenied = 50
+)
+
+// Denied is a connection refused by the policy or the limits.
+type Denied struct {
+	Time    time.Time `json:"time"`
+	Network string    `json:"network"`
+	Address string    `json:"address"`
+	Reason  string    `json:"reason"`
+}
+
+// Status is reported by the status endpoint.
+type Status struct {
+	State  string    `json:"state"`
+	Server string    `json:"server,omitempty"`
+	Since  time.Time `json:"since"`
+	// Failures counts the connection attempts that failed since the last connection.
+	Failures  int    `json:"failures"`
+	LastError string `json:"lastError,omitempty"`
+	// RTT is the smoothed round trip time to the server.
+	RTT     time.Duration                 `json:"rtt"`
+	Tunnels []remotedialer.ConnectionInfo `json:"tunnels"`
+	// Denied are the latest connections refused by the policy or the limits, oldest first.
+	Denied []Denied `json:"denied"`
+}
+
+type agent struct {
+	sync.Mutex
+
+	config  *Config
+	options remotedialer.ClientOptions
+	status  Status
+	session *remotedialer.Session
+	denied  []Denied
+	audit   *audit.Log
+}
+
+func newAgent(config *Config) (*agent, error) {
+	policy, err := newPolicy(config.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := http.Header{}
+	for k, v := range config.Identity.Headers {
+		headers.Set(k, v)
+	}
+
+	instanceID := config.Identity.InstanceID
+	if instanceID == "" {
+		instanceID = randomID()
+	}
+
+	a := &agent{
+		config: config,
+		status: Status{
+			State: stateDisconnected,
+			Since: time.Now(),
+		},
+	}
+	a.options = remotedialer.ClientOptions{
+		Headers:    headers,
+		Auth:       policy.authorize,
+		Dial:       policy.dial,
+		OnDenied:   a.recordDenied,
+		Stripes:    config.Stripes,
+		InstanceID: instanceID,
+		OnSession:  a.connected,
+	}
+	if config.Identity.TokenFile != "" {
+		a.options.TokenSource = tokenFile(config.Identity.TokenFile)
+	}
+	if a.audit, err = audit.New(config.Audit, "remotedialer-agent"); err != nil {
+		return nil, err
+	}
+	if a.audit != nil {
+		a.options.Audit = a.audit
+	}
+	if config.Resume {
+		a.options.Resume = remotedialer.NewClientResume()
+	}
+	if config.Compression {
+		a.options.Compression = remotedialer.CompressionConfig{
+			WebsocketDeflate: true,
+			Deflate:          true,
+		}
+	}
+
+	// Fail on start rather than on every connection attempt
+	if _, err := a.dialer(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func randomID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func tokenFile(path string) remotedialer.TokenSource {
+	return func(context.Context) (string, error) {
+		token, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(token)), nil
+	}
+}
+
+// dialer builds the websocket dialer, re-reading the certificates so they can be rotated.
+func (a *agent) dialer() (*websocket.Dialer, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         a.config.TLS.ServerName,
+		InsecureSkipVerify: a.config.TLS.InsecureSkipVerify,
+	}
+
+	if a.config.TLS.CA != "" {
+		pem, err := ioutil.ReadFile(a.config.TLS.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", a.config.TLS.CA)
+		}
+	}
+
+	if a.config.Identity.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(a.config.Identity.Cert, a.config.Identity.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: remotedialer.HandshakeTimeOut,
+		TLSClientConfig:  tlsConfig,
+	}
+	switch a.config.Proxy {
+	case "":
+	case "direct":
+		dialer.Proxy = nil
+	default:
+		proxyURL, err := url.Parse(a.config.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %s: %v", a.config.Proxy, err)
+		}
+		dialer.Proxy = http.ProxyURL(proxyURL)
+	}
+	return dialer, nil
+}
+
+// run connects to the servers in turn until ctx is done, backing off exponentially while they
+// fail.
+func (a *agent) run(ctx context.Context) {
+	for i := 0; ctx.Err() == nil; i++ {
+		server := a.config.Servers[i%len(a.config.Servers)]
+		a.setState(stateConnecting, server, nil)
+
+		opts := a.options
+		dialer, err := a.dialer()
+		if err == nil {
+			opts.Dialer = dialer
+			err = remotedialer.ConnectToProxyWithOptions(ctx, server, opts)
+		}
+
+		a.Lock()
+		a.session = nil
+		a.Unlock()
+
+		// Even a clean close, such as by a draining server, waits MinBackoff so that a server
+		// closing every session right away is not reconnected to in a loop
+		a.setState(stateDisconnected, server, err)
+		delay := a.backoff()
+		logrus.Infof("Reconnecting in %s", delay)
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff returns a random delay up to MinBackoff doubled for each failure, capped at
+// MaxBackoff.
+func (a *agent) backoff() time.Duration {
+	a.Lock()
+	failures := a.status.Failures
+	a.Unlock()
+
+	min := float64(a.config.Reconnect.MinBackoff)
+	max := min * math.Pow(2, float64(failures-1))
+	if max > float64(a.config.Reconnect.MaxBackoff) {
+		max = float64(a.config.Reconnect.MaxBackoff)
+	}
+	if max < min {
+		max = min
+	}
+	return time.Duration(min + mathrand.Float64()*(max-min))
+}
+
+func (a *agent) connected(session *remotedialer.Session) {
+	a.Lock()
+	a.session = session
+	a.status.Failures = 0
+	a.Unlock()
+
+	a.setState(stateConnected, "", nil)
+	logrus.Info("Connected to proxy")
+}
+
+// recordDenied keeps the refused connections for the status.
+func (a *agent) recordDenied(network, address string, reason error) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.denied = append(a.denied, Denied{
+		Time:    time.Now(),
+		Network: network,
+		Address: address,
+		Reason:  reason.Error(),
+	})
+	if len(a.denied) > maxDenied {
+		a.denied = a.denied[len(a.denied)-maxDenied:]
+	}
+}
+
+func (a *agent) setState(state, server string, err error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if state != a.status.State {
+		a.status.State = state
+		a.status.Since = time.Now()
+	}
+	if server != "" {
+		a.status.Server = server
+	}
+	if err != nil {
+		a.status.Failures++
+		a.status.LastError = err.Error()
+	}
+}
+
+func (a *agent) getStatus() Status {
+	a.Lock()
+	status := a.status
+	status.Denied = append([]Denied{}, a.denied...)
+	session := a.session
+	a.Unlock()
+
+	status.Tunnels = []remotedialer.ConnectionInfo{}
+	if session != nil {
+		status.RTT, _ = session.RTT()
+		status.Tunnels = session.Connections()
+	}
+	return status
+}
+
+func (a *agent) serveStatus(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(a.getStatus())
+}
+
+// closeConnection closes the tunneled connection id, returning false if there is no such
+// connection.
+func (a *agent) closeConnection(id int64) bool {
+	a.Lock()
+	session := a.session
+	a.Unlock()
+
+	return session != nil && session.CloseConnection(id)
+}
+
+func (a *agent) serveHealth(rw http.ResponseWriter, req *http.Request) {
+	if a.getStatus().State != stateConnected {
+		http.Error(rw, "not connected", http.StatusServiceUnavailable)
+		return
+	}
+	rw.Write([]byte("ok"))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/rancher/remotedialer/audit"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the YAML configuration of the agent.
+type Config struct {
+	// Servers are the websocket URLs of the servers, tried in turn until one accepts.
+	Servers  []string `yaml:"servers"`
+	Identity Identity `yaml:"identity"`
+	TLS      TLS      `yaml:"tls"`
+	// Proxy is the URL of an HTTP proxy to reach the servers through, by default taken from
+	// the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables. "direct" disables it.
+	Proxy     string    `yaml:"proxy"`
+	Policy    Policy    `yaml:"policy"`
+	Reconnect Reconnect `yaml:"reconnect"`
+	// Status serves the connection state and active tunnels as JSON on /status, and /healthz,
+	// on this address if set.
+	Status string `yaml:"status"`
+	// AdminSocket is a unix socket serving the status and closing tunneled connections, as
+	// used by the status subcommand, if set.
+	AdminSocket string `yaml:"adminSocket"`
+	// Audit records the connections dialed for the server and those denied by the policy. The
+	// file is reopened on SIGHUP.
+	Audit audit.Config `yaml:"audit"`
+	// LogLevel is a logrus level, "info" by default.
+	LogLevel string `yaml:"logLevel"`
+
+	// Resume lets tunneled connections survive reconnects if the server allows it.
+	Resume bool `yaml:"resume"`
+	// Stripes is the number of websockets used by the session.
+	Stripes int `yaml:"stripes"`
+	// Compression requests deflate compression of tunneled data.
+	Compression bool `yaml:"compression"`
+}
+
+// Identity is how the agent authenticates to the server.
+type Identity struct {
+	// TokenFile holds a bearer token, re-read before each connection so it can be rotated.
+	TokenFile string `yaml:"tokenFile"`
+	// Cert and Key are a client certificate, re-read before each connection.
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// Headers are sent with the websocket request, such as the client key for header auth.
+	Headers map[string]string `yaml:"headers"`
+	// InstanceID identifies this agent to the server's duplicate policy, random by default.
+	InstanceID string `yaml:"instanceID"`
+}
+
+// TLS configures verification of the servers.
+type TLS struct {
+	// CA verifies the servers instead of the system roots.
+	CA         string `yaml:"ca"`
+	ServerName string `yaml:"serverName"`
+	// InsecureSkipVerify disables verification of the servers. Only for testing.
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+}
+
+// Policy lists the destinations the server may dial through the agent, see rule. Deny
+// rules take precedence, and nothing is allowed if Allow is empty.
+type Policy struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// Reconnect is the exponential backoff between connection attempts.
+type Reconnect struct {
+	// MinBackoff is the first delay, 1s by default.
+	MinBackoff time.Duration `yaml:"minBackoff"`
+	// MaxBackoff caps the delay, 1m by default.
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+
+	if config.LogLevel == "" {
+		config.LogLevel = "info"
+	}
+	if config.Reconnect.MinBackoff <= 0 {
+		config.Reconnect.MinBackoff = time.Second
+	}
+	if config.Reconnect.MaxBackoff < config.Reconnect.MinBackoff {
+		config.Reconnect.MaxBackoff = time.Minute
+	}
+
+	if len(config.Servers) == 0 {
+		return nil, fmt.Errorf("no servers configured")
+	}
+	if (config.Identity.Cert == "") != (config.Identity.Key == "") {
+		return nil, fmt.Errorf("identity.cert and identity.key must be set together")
+	}
+	return config, nil
+}
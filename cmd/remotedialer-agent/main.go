@@ -0,0 +1,87 @@
+// remotedialer-agent connects to a remotedialer server and dials the destinations its policy
+// allows on behalf of the server, reconnecting with backoff, as configured by a YAML file.
+//
+// "remotedialer-agent status" prints the state, tunneled connections and denied connections of
+// a running agent, read from its admin socket. SIGHUP reopens the audit log.
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultConfig = "/etc/remotedialer/agent.yaml"
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		if err := runStatus(os.Args[2:]); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+
+	configFile := flag.String("config", defaultConfig, "Config file")
+	flag.Parse()
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	level, err := logrus.ParseLevel(config.LogLevel)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.SetLevel(level)
+
+	a, err := newAgent(config)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	if config.Status != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/status", a.serveStatus)
+		mux.HandleFunc("/healthz", a.serveHealth)
+		go func() {
+			logrus.Fatal(http.ListenAndServe(config.Status, mux))
+		}()
+	}
+
+	if config.AdminSocket != "" {
+		if err := a.serveAdmin(config.AdminSocket); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				if a.audit != nil {
+					if err := a.audit.Reopen(); err != nil {
+						logrus.Errorf("Failed to reopen audit log: %v", err)
+					}
+				}
+				continue
+			}
+
+			logrus.Infof("Received %s, disconnecting", sig)
+			cancel()
+			return
+		}
+	}()
+
+	a.run(ctx)
+	if a.audit != nil {
+		a.audit.Close()
+	}
+}
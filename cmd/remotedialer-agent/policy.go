@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dialTimeout bounds the dials of the destinations allowed by the policy.
+const dialTimeout = 30 * time.Second
+
+var errDenied = errors.New("denied by policy")
+
+// rule matches destinations written as [network://]host:port, where the network defaults to tcp
+// and also matches tcp4 and tcp6 (udp likewise). The host is an IP address or a CIDR, also
+// matching the host names resolving to it, or a glob such as *.internal, and the port a number,
+// a range like 8000-8999, or *. Unix socket rules are unix://path, the path being a glob.
+type rule struct {
+	network string
+	cidr    *net.IPNet
+	host    string
+	minPort int
+	maxPort int
+}
+
+func parseRule(s string) (rule, error) {
+	r := rule{network: "tcp"}
+	if i := strings.Index(s, "://"); i >= 0 {
+		r.network, s = s[:i], s[i+len("://"):]
+	}
+
+	if r.network == "unix" {
+		if _, err := path.Match(s, ""); err != nil {
+			return r, fmt.Errorf("invalid rule %s: %v", s, err)
+		}
+		r.host = s
+		return r, nil
+	}
+	if r.network != "tcp" && r.network != "udp" {
+		return r, fmt.Errorf("invalid rule %s: unsupported network %s", s, r.network)
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return r, fmt.Errorf("invalid rule %s: %v", s, err)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		// Also matches the host names resolving to ip
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		r.cidr = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else if strings.Contains(host, "/") {
+		if _, r.cidr, err = net.ParseCIDR(host); err != nil {
+			return r, fmt.Errorf("invalid rule %s: %v", s, err)
+		}
+	} else if _, err := path.Match(host, ""); err != nil {
+		return r, fmt.Errorf("invalid rule %s: %v", s, err)
+	}
+	r.host = strings.ToLower(host)
+
+	r.minPort, r.maxPort = 0, 65535
+	if port != "*" {
+		ports := strings.SplitN(port, "-", 2)
+		if r.minPort, err = strconv.Atoi(ports[0]); err != nil {
+			return r, fmt.Errorf("invalid rule %s: bad port %s", s, port)
+		}
+		r.maxPort = r.minPort
+		if len(ports) == 2 {
+			if r.maxPort, err = strconv.Atoi(ports[1]); err != nil {
+				return r, fmt.Errorf("invalid rule %s: bad port %s", s, port)
+			}
+		}
+	}
+	return r, nil
+}
+
+// matches reports whether the rule matches a destination, ip being the address of host if
+// known. For unix sockets, host is the path and port is ignored.
+func (r rule) matches(network, host string, ip net.IP, port int) bool {
+	if network == "unix" {
+		if r.network != "unix" {
+			return false
+		}
+		ok, _ := path.Match(r.host, host)
+		return ok
+	}
+	if strings.TrimRight(network, "46") != r.network {
+		return false
+	}
+	if port < r.minPort || port > r.maxPort {
+		return false
+	}
+
+	if r.cidr != nil {
+		return ip != nil && r.cidr.Contains(ip)
+	}
+	ok, _ := path.Match(r.host, strings.ToLower(host))
+	return ok
+}
+
+// policy allows the destinations matched by an allow rule and no deny rule.
+type policy struct {
+	allow []rule
+	deny  []rule
+	// resolve is set if a rule is an IP address or a CIDR, the host names of destinations
+	// being then resolved to match the rules against their addresses.
+	resolve bool
+}
+
+func newPolicy(config Policy) (*policy, error) {
+	allow, err := parseRules(config.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseRules(config.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &policy{
+		allow: allow,
+		deny:  deny,
+	}
+	for _, r := range append(allow, deny...) {
+		if r.cidr != nil {
+			p.resolve = true
+		}
+	}
+	return p, nil
+}
+
+func (p *policy) allowed(network, host string, ip net.IP, port int) bool {
+	return !matchesAny(p.deny, network, host, ip, port) && matchesAny(p.allow, network, host, ip, port)
+}
+
+// vet returns the addresses to dial for a destination, or an error if the policy denies it.
+// Host names are resolved if a rule is an IP address or a CIDR, every address they resolve to
+// having to be allowed, and the addresses are returned so that the vetted ones are dialed.
+func (p *policy) vet(network, address string) ([]string, error) {
+	if network == "unix" {
+		if !p.allowed(network, address, nil, 0) {
+			return nil, errDenied
+		}
+		return []string{address}, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s", address)
+	}
+
+	ip := net.ParseIP(host)
+	if ip != nil || !p.resolve {
+		if !p.allowed(network, host, ip, port) {
+			return nil, errDenied
+		}
+		return []string{address}, nil
+	}
+
+	ips, err := lookupIP(network, host)
+	if err != nil {
+		return nil, err
+	}
+	var addresses []string
+	for _, ip := range ips {
+		if !p.allowed(network, host, ip, port) {
+			return nil, errDenied
+		}
+		addresses = append(addresses, net.JoinHostPort(ip.String(), portStr))
+	}
+	return addresses, nil
+}
+
+// lookupIP resolves host to the addresses of the IP version of network.
+func lookupIP(network, host string) ([]net.IP, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	var result []net.IP
+	for _, ip := range ips {
+		switch {
+		case strings.HasSuffix(network, "4") && ip.To4() == nil:
+		case strings.HasSuffix(network, "6") && ip.To4() != nil:
+		default:
+			result = append(result, ip)
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no %s address found for %s", network, host)
+	}
+	return result, nil
+}
+
+// authorize is the ConnectAuthorizer of the policy.
+func (p *policy) authorize(network, address string) bool {
+	if _, err := p.vet(network, address); err != nil {
+		logrus.Infof("Denied connection to %s://%s: %v", network, address, err)
+		return false
+	}
+	return true
+}
+
+// dial is the Dialer of the policy, dialing the addresses it vetted in turn rather than
+// resolving host names again.
+func (p *policy) dial(network, address string) (net.Conn, error) {
+	addresses, err := p.vet(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, address := range addresses {
+		var conn net.Conn
+		if conn, err = net.DialTimeout(network, address, dialTimeout); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func parseRules(rules []string) ([]rule, error) {
+	var result []rule
+	for _, s := range rules {
+		r, err := parseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+func matchesAny(rules []rule, network, host string, ip net.IP, port int) bool {
+	for _, r := range rules {
+		if r.matches(network, host, ip, port) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import "testing"
+
+type policyTest struct {
+	network string
+	address string
+	allowed bool
+}
+
+func checkPolicy(t *testing.T, config Policy, tests []policyTest) {
+	p, err := newPolicy(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		if allowed := p.authorize(test.network, test.address); allowed != test.allowed {
+			t.Errorf("%s://%s: allowed %v, expected %v", test.network, test.address, allowed, test.allowed)
+		}
+	}
+}
+
+func TestPolicyHostNames(t *testing.T) {
+	// Without IP rules host names are matched as is, not resolved
+	checkPolicy(t, Policy{
+		Allow: []string{
+			"*.internal:443",
+			"udp://dns.internal:53",
+			"unix:///run/app/*.sock",
+		},
+		Deny: []string{
+			"admin.internal:*",
+		},
+	}, []policyTest{
+		{"tcp", "db.internal:443", true},
+		{"tcp6", "db.internal:443", true},
+		{"tcp", "DB.Internal:443", true},
+		{"tcp", "db.internal:80", false},
+		{"tcp", "admin.internal:443", false},
+		{"udp", "dns.internal:53", true},
+		{"udp4", "dns.internal:53", true},
+		{"tcp", "dns.internal:53", false},
+		{"unix", "/run/app/api.sock", true},
+		{"unix", "/run/other/api.sock", false},
+	})
+}
+
+func TestPolicyAddresses(t *testing.T) {
+	checkPolicy(t, Policy{
+		Allow: []string{
+			"10.0.0.0/8:8000-8999",
+			"127.0.0.0/8:*",
+		},
+		Deny: []string{
+			"127.0.0.1:22",
+		},
+	}, []policyTest{
+		{"tcp", "10.1.2.3:8080", true},
+		{"tcp", "10.1.2.3:9000", false},
+		{"tcp", "192.168.0.1:8080", false},
+		{"tcp", "127.0.0.2:22", true},
+		{"tcp", "127.0.0.1:22", false},
+		// Host names are matched by the addresses they resolve to
+		{"tcp4", "localhost:80", true},
+		{"tcp4", "localhost:22", false},
+		{"tcp", "nonexistent.invalid:80", false},
+	})
+}
+
+func TestPolicyDialsVettedAddresses(t *testing.T) {
+	p, err := newPolicy(Policy{Allow: []string{"127.0.0.1:*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addresses, err := p.vet("tcp4", "localhost:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 1 || addresses[0] != "127.0.0.1:80" {
+		t.Fatalf("vetted %v, expected [127.0.0.1:80]", addresses)
+	}
+}
+
+func TestPolicyEmptyAllowsNothing(t *testing.T) {
+	p, err := newPolicy(Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.authorize("tcp", "127.0.0.1:80") {
+		t.Fatal("empty policy allowed a connection")
+	}
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	for _, s := range []string{
+		"host",
+		"sctp://host:80",
+		"10.0.0.0/33:80",
+		"host:port",
+		"[:80",
+		"unix://[",
+	} {
+		if _, err := parseRule(s); err == nil {
+			t.Errorf("parsed invalid rule %s", s)
+		}
+	}
+}
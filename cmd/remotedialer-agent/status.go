@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runStatus implements the status subcommand, printing the status of the agent read from its
+// admin socket, or closing a tunneled connection.
+func runStatus(args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	configFile := flags.String("config", defaultConfig, "Config file of the agent, naming its admin socket")
+	socket := flags.String("socket", "", "Admin socket, overriding the config file")
+	kill := flags.Int64("kill", 0, "Close the tunneled connection with this ID")
+	flags.Parse(args)
+
+	if *socket == "" {
+		config, err := loadConfig(*configFile)
+		if err != nil {
+			return err
+		}
+		if config.AdminSocket == "" {
+			return fmt.Errorf("adminSocket is not set in %s", *configFile)
+		}
+		*socket = config.AdminSocket
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", *socket)
+			},
+		},
+	}
+
+	if *kill != 0 {
+		req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://agent/connections/%d", *kill), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			body, _ := ioutil.ReadAll(resp.Body)
+			return fmt.Errorf("failed to close connection %d: %s", *kill, strings.TrimSpace(string(body)))
+		}
+		fmt.Printf("Closed connection %d\n", *kill)
+		return nil
+	}
+
+	resp, err := client.Get("http://agent/status")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var status Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return err
+	}
+	printStatus(status)
+	return nil
+}
+
+func printStatus(status Status) {
+	now := time.Now()
+
+	fmt.Printf("State:    %s since %s\n", status.State, status.Since.Format(time.RFC3339))
+	fmt.Printf("Server:   %s\n", status.Server)
+	if status.State == stateConnected {
+		fmt.Printf("RTT:      %s\n", status.RTT)
+	}
+	if status.Failures > 0 {
+		fmt.Printf("Failures: %d\n", status.Failures)
+	}
+	if status.LastError != "" {
+		fmt.Printf("Last error: %s\n", status.LastError)
+	}
+
+	fmt.Printf("\nConnections: %d\n", len(status.Tunnels))
+	if len(status.Tunnels) > 0 {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tPROTO\tADDRESS\tSENT\tRECEIVED\tAGE")
+		for _, t := range status.Tunnels {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%s\n", t.ID, t.Network, t.Address, t.Transmitted, t.Received,
+				now.Sub(t.Created).Round(time.Second))
+		}
+		w.Flush()
+	}
+
+	fmt.Printf("\nDenied: %d\n", len(status.Denied))
+	if len(status.Denied) > 0 {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tPROTO\tADDRESS\tREASON")
+		for _, d := range status.Denied {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.Time.Format(time.RFC3339), d.Network, d.Address, d.Reason)
+		}
+		w.Flush()
+	}
+}
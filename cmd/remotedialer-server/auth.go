@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/rancher/remotedialer"
+	"gopkg.in/yaml.v2"
+)
+
+// newAuthorizer returns the authorizer of config, clientCA being the CAs of the TLS listener
+// that also verify the CRL of the mtls type.
+func newAuthorizer(config AuthConfig, clientCA string) (remotedialer.Authorizer, error) {
+	switch config.Type {
+	case "tokens":
+		tokens, err := readMap(config.TokensFile)
+		if err != nil {
+			return nil, err
+		}
+		return tokensAuthorizer(tokens), nil
+	case "mtls":
+		keySource, err := mtlsKeySource(config.MTLS.KeySource)
+		if err != nil {
+			return nil, err
+		}
+		return remotedialer.NewMTLSAuthorizer(remotedialer.MTLSAuthorizerConfig{
+			KeySource:   keySource,
+			TrustDomain: config.MTLS.TrustDomain,
+			CRLFile:     config.MTLS.CRLFile,
+			CAFile:      clientCA,
+			Pins:        config.MTLS.Pins,
+		})
+	case "jwt":
+		keys, err := readMap(config.JWT.KeysFile)
+		if err != nil {
+			return nil, err
+		}
+		secrets := map[string][]byte{}
+		for id, secret := range keys {
+			secrets[id] = []byte(secret)
+		}
+		return remotedialer.NewTokenAuthorizer(remotedialer.TokenAuthorizerConfig{
+			Keys:           secrets,
+			Audience:       config.JWT.Audience,
+			ClientKeyClaim: config.JWT.ClientKeyClaim,
+			Leeway:         config.JWT.Leeway,
+		}).Authorize, nil
+	case "header":
+		return func(req *http.Request) (string, bool, error) {
+			clientKey := req.Header.Get(config.Header)
+			return clientKey, clientKey != "", nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown auth.type %q", config.Type)
+}
+
+// tokensAuthorizer authorizes requests whose bearer token is a key of tokens, the client key
+// being its value.
+func tokensAuthorizer(tokens map[string]string) remotedialer.Authorizer {
+	return func(req *http.Request) (string, bool, error) {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return "", false, nil
+		}
+		clientKey, ok := tokens[strings.TrimPrefix(auth, "Bearer ")]
+		return clientKey, ok && clientKey != "", nil
+	}
+}
+
+// requireClientCert refuses agents without a verified client certificate. The listener only
+// verifies those given, as peers and front-end users authenticate otherwise.
+func requireClientCert(auth remotedialer.Authorizer) remotedialer.Authorizer {
+	return func(req *http.Request) (string, bool, error) {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			return "", false, nil
+		}
+		return auth(req)
+	}
+}
+
+// frontendUser is a user of the front-ends, allowed to dial through ClientKeys.
+type frontendUser struct {
+	Password   string   `yaml:"password"`
+	ClientKeys []string `yaml:"clientKeys"`
+}
+
+func (u frontendUser) allows(clientKey string) bool {
+	for _, k := range u.ClientKeys {
+		if k == clientKey {
+			return true
+		}
+	}
+	return false
+}
+
+func (u frontendUser) defaultClientKey() (string, bool) {
+	if len(u.ClientKeys) == 0 {
+		return "", false
+	}
+	return u.ClientKeys[0], true
+}
+
+type frontendUsers map[string]frontendUser
+
+func (u frontendUsers) authenticate(username, password string) (frontendUser, bool) {
+	user, ok := u[username]
+	if !ok || user.Password == "" || subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) != 1 {
+		return frontendUser{}, false
+	}
+	return user, true
+}
+
+func readUsers(path string) (frontendUsers, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	users := frontendUsers{}
+	if err := yaml.UnmarshalStrict(content, &users); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	return users, nil
+}
+
+func readMap(path string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]string{}
+	if err := yaml.Unmarshal(content, &result); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	return result, nil
+}
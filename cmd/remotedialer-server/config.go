@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/rancher/remotedialer"
+	"github.com/rancher/remotedialer/audit"
+	"github.com/rancher/remotedialer/portforward"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the YAML configuration of the server. Fields marked reloadable are applied again on
+// SIGHUP, the others need a restart.
+type Config struct {
+	// Listen is the address agents and peers connect to, ":8123" by default.
+	Listen string `yaml:"listen"`
+	// Path is the websocket endpoint, "/connect" by default.
+	Path string    `yaml:"path"`
+	TLS  TLSConfig `yaml:"tls"`
+	// LogLevel is a logrus level, "info" by default. Reloadable.
+	LogLevel string      `yaml:"logLevel"`
+	Auth     AuthConfig  `yaml:"auth"`
+	Peers    PeersConfig `yaml:"peers"`
+	Metrics  Metrics     `yaml:"metrics"`
+	Admin    Admin       `yaml:"admin"`
+	// Audit records tunneled connections and refused agents. The file is reopened on SIGHUP.
+	Audit audit.Config `yaml:"audit"`
+
+	Limits remotedialer.Limits `yaml:"limits"`
+	// DuplicatePolicy is allow, replace or reject.
+	DuplicatePolicy   string        `yaml:"duplicatePolicy"`
+	ResumeGracePeriod time.Duration `yaml:"resumeGracePeriod"`
+	MaxStripes        int           `yaml:"maxStripes"`
+
+	Frontends Frontends `yaml:"frontends"`
+	// DialTimeout bounds dials of the front-ends, 15s by default.
+	DialTimeout time.Duration `yaml:"dialTimeout"`
+	// ShutdownTimeout is how long tunneled connections are drained on SIGTERM, 30s by default.
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+}
+
+// TLSConfig enables TLS on the listener. Reloadable.
+type TLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ClientCA verifies client certificates, as the mtls authorizer needs. Agents must present
+	// one signed by these CAs, peers and front-end users authenticate with their credentials.
+	ClientCA string `yaml:"clientCA"`
+}
+
+// AuthConfig selects how agents are authorized. Reloadable.
+type AuthConfig struct {
+	// Type is tokens, mtls, jwt or header.
+	Type string `yaml:"type"`
+	// TokensFile is a YAML map of bearer tokens to client keys, for the tokens type.
+	TokensFile string `yaml:"tokensFile"`
+	// Header holds the client key, unauthenticated, for the header type. Only for testing.
+	Header string     `yaml:"header"`
+	MTLS   MTLSConfig `yaml:"mtls"`
+	JWT    JWTConfig  `yaml:"jwt"`
+}
+
+type MTLSConfig struct {
+	// KeySource is cn, uri or spiffe.
+	KeySource   string `yaml:"keySource"`
+	TrustDomain string `yaml:"trustDomain"`
+	// CRLFile must be signed by a CA of tls.clientCA.
+	CRLFile string   `yaml:"crlFile"`
+	Pins    []string `yaml:"pins"`
+}
+
+type JWTConfig struct {
+	// KeysFile is a YAML map of key IDs to HMAC secrets.
+	KeysFile       string        `yaml:"keysFile"`
+	Audience       string        `yaml:"audience"`
+	ClientKeyClaim string        `yaml:"clientKeyClaim"`
+	Leeway         time.Duration `yaml:"leeway"`
+}
+
+type PeersConfig struct {
+	ID string `yaml:"id"`
+	// Token is presented to and expected from peers. Reloadable.
+	Token string `yaml:"token"`
+	// CA verifies the certificates of wss peers, the system roots if unset.
+	CA string `yaml:"ca"`
+	// Static peers. Reloadable.
+	Static []remotedialer.PeerInfo `yaml:"static"`
+	// File is a JSON/YAML file of peers, re-read when changed.
+	File string `yaml:"file"`
+	// DNS discovers peers from DNS records.
+	DNS *remotedialer.DNSDiscovery `yaml:"dns"`
+	// DiscoveryInterval is how often File and DNS are polled, 10s by default.
+	DiscoveryInterval time.Duration `yaml:"discoveryInterval"`
+}
+
+type Metrics struct {
+	// Listen serves prometheus metrics on /metrics if set.
+	Listen string `yaml:"listen"`
+}
+
+// Admin serves the admin API of the admin package.
+type Admin struct {
+	// Listen serves the API on /admin if set.
+	Listen string `yaml:"listen"`
+	// TokensFile is a YAML map of bearer tokens to operator names. Reloadable.
+	TokensFile string `yaml:"tokensFile"`
+}
+
+type Frontends struct {
+	// UsersFile is a YAML map of usernames to their password and the client keys they may dial
+	// through, required by the SOCKS5, HTTP and reverse proxies. Reloadable.
+	UsersFile string `yaml:"usersFile"`
+	// SocksListen serves a SOCKS5 proxy if set. The username is a user, dialing through its
+	// first client key, or user/clientKey.
+	SocksListen string `yaml:"socksListen"`
+	// HTTPProxy serves an HTTP forward proxy on Listen.
+	HTTPProxy HTTPProxyConfig `yaml:"httpProxy"`
+	// ReverseProxyPrefix serves the reverse proxy under this path, such as "/client", if set.
+	// Users authenticate with Basic credentials.
+	ReverseProxyPrefix string `yaml:"reverseProxyPrefix"`
+	// Forwards are port forwards. Reloadable.
+	Forwards []portforward.Forward `yaml:"forwards"`
+}
+
+// HTTPProxyConfig serves an HTTP forward proxy. Users authenticate with Proxy-Authorization,
+// selecting their first client key, or another one with Header or Suffix, see httpproxy.Handler.
+type HTTPProxyConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Header  string `yaml:"header"`
+	Suffix  string `yaml:"suffix"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+	config.setDefaults()
+	return config, config.validate()
+}
+
+func (c *Config) setDefaults() {
+	if c.Listen == "" {
+		c.Listen = ":8123"
+	}
+	if c.Path == "" {
+		c.Path = "/connect"
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+	if c.DialTimeout <= 0 {
+		c.DialTimeout = 15 * time.Second
+	}
+	if c.ShutdownTimeout <= 0 {
+		c.ShutdownTimeout = 30 * time.Second
+	}
+	if c.Peers.DiscoveryInterval <= 0 {
+		c.Peers.DiscoveryInterval = 10 * time.Second
+	}
+}
+
+func (c *Config) validate() error {
+	if _, err := duplicatePolicy(c.DuplicatePolicy); err != nil {
+		return err
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return fmt.Errorf("tls.cert and tls.key must be set together")
+	}
+	if c.TLS.ClientCA != "" && c.TLS.Cert == "" {
+		return fmt.Errorf("tls.clientCA requires tls.cert and tls.key")
+	}
+
+	switch c.Auth.Type {
+	case "tokens":
+		if c.Auth.TokensFile == "" {
+			return fmt.Errorf("auth.tokensFile is required by the tokens authorizer")
+		}
+	case "mtls":
+		if c.TLS.ClientCA == "" {
+			return fmt.Errorf("tls.clientCA is required by the mtls authorizer")
+		}
+		if _, err := mtlsKeySource(c.Auth.MTLS.KeySource); err != nil {
+			return err
+		}
+	case "jwt":
+		if c.Auth.JWT.KeysFile == "" {
+			return fmt.Errorf("auth.jwt.keysFile is required by the jwt authorizer")
+		}
+	case "header":
+		if c.Auth.Header == "" {
+			return fmt.Errorf("auth.header is required by the header authorizer")
+		}
+	default:
+		return fmt.Errorf("unknown auth.type %q, expected tokens, mtls, jwt or header", c.Auth.Type)
+	}
+
+	frontends := c.Frontends
+	if (frontends.SocksListen != "" || frontends.HTTPProxy.Enabled || frontends.ReverseProxyPrefix != "") && frontends.UsersFile == "" {
+		return fmt.Errorf("frontends.usersFile is required by the SOCKS5, HTTP and reverse proxies")
+	}
+
+	if c.Admin.Listen != "" && c.Admin.TokensFile == "" {
+		return fmt.Errorf("admin.tokensFile is required by the admin API")
+	}
+
+	for _, f := range c.Frontends.Forwards {
+		if f.Listen == "" || f.ClientKey == "" || f.Address == "" {
+			return fmt.Errorf("invalid forward %s, listen, clientKey and address are required", f)
+		}
+	}
+	return nil
+}
+
+func duplicatePolicy(policy string) (remotedialer.DuplicatePolicy, error) {
+	switch policy {
+	case "", "allow":
+		return remotedialer.DuplicateAllow, nil
+	case "replace":
+		return remotedialer.DuplicateReplace, nil
+	case "reject":
+		return remotedialer.DuplicateReject, nil
+	}
+	return 0, fmt.Errorf("unknown duplicatePolicy %q, expected allow, replace or reject", policy)
+}
+
+func mtlsKeySource(source string) (remotedialer.MTLSKeySource, error) {
+	switch source {
+	case "", "cn":
+		return remotedialer.MTLSCommonName, nil
+	case "uri":
+		return remotedialer.MTLSURI, nil
+	case "spiffe":
+		return remotedialer.MTLSSPIFFEID, nil
+	}
+	return 0, fmt.Errorf("unknown auth.mtls.keySource %q, expected cn, uri or spiffe", source)
+}
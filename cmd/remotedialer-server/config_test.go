@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/remotedialer"
+	"github.com/rancher/remotedialer/portforward"
+)
+
+func writeConfig(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "remotedialer-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadConfig(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+listen: ":9443"
+logLevel: debug
+auth:
+  type: mtls
+  mtls:
+    keySource: spiffe
+    trustDomain: example.org
+tls:
+  cert: server.pem
+  key: server-key.pem
+  clientCA: ca.pem
+peers:
+  id: a
+  token: secret
+  static:
+  - id: b
+    url: wss://b.example.com/connect
+limits:
+  maxSessionsPerKey: 2
+  connectRate: 10
+duplicatePolicy: replace
+resumeGracePeriod: 30s
+maxStripes: 4
+frontends:
+  usersFile: users.yaml
+  socksListen: ":1080"
+  httpProxy:
+    enabled: true
+    suffix: .tunnel
+  forwards:
+  - listen: localhost:15432
+    clientKey: agent
+    address: db:5432
+dialTimeout: 5s
+`)
+	defer cleanup()
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Listen != ":9443" || config.Path != "/connect" || config.LogLevel != "debug" {
+		t.Errorf("unexpected listener settings %q %q %q", config.Listen, config.Path, config.LogLevel)
+	}
+	if config.Auth.Type != "mtls" || config.Auth.MTLS.KeySource != "spiffe" || config.Auth.MTLS.TrustDomain != "example.org" {
+		t.Errorf("unexpected auth %+v", config.Auth)
+	}
+	if len(config.Peers.Static) != 1 || config.Peers.Static[0].ID != "b" || config.Peers.Static[0].URL != "wss://b.example.com/connect" {
+		t.Errorf("unexpected peers %+v", config.Peers.Static)
+	}
+	if config.Limits != (remotedialer.Limits{MaxSessionsPerKey: 2, ConnectRate: 10}) {
+		t.Errorf("unexpected limits %+v", config.Limits)
+	}
+	if config.DuplicatePolicy != "replace" || config.ResumeGracePeriod != 30*time.Second || config.MaxStripes != 4 {
+		t.Errorf("unexpected session settings %q %v %d", config.DuplicatePolicy, config.ResumeGracePeriod, config.MaxStripes)
+	}
+	if !config.Frontends.HTTPProxy.Enabled || config.Frontends.HTTPProxy.Suffix != ".tunnel" {
+		t.Errorf("unexpected HTTP proxy %+v", config.Frontends.HTTPProxy)
+	}
+	forward := portforward.Forward{Listen: "localhost:15432", ClientKey: "agent", Address: "db:5432"}
+	if len(config.Frontends.Forwards) != 1 || config.Frontends.Forwards[0] != forward {
+		t.Errorf("unexpected forwards %+v", config.Frontends.Forwards)
+	}
+
+	// Defaults
+	if config.DialTimeout != 5*time.Second || config.ShutdownTimeout != 30*time.Second || config.Peers.DiscoveryInterval != 10*time.Second {
+		t.Errorf("unexpected timeouts %v %v %v", config.DialTimeout, config.ShutdownTimeout, config.Peers.DiscoveryInterval)
+	}
+}
+
+func TestLoadConfigStrict(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+auth:
+  type: header
+  header: X-Client
+maxstripes: 4
+`)
+	defer cleanup()
+
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "maxstripes") {
+		t.Fatalf("expected an error for the unknown field, got %v", err)
+	}
+	if _, err := loadConfig(path + ".missing"); err == nil {
+		t.Fatal("missing config loaded")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{"auth: {type: header, header: X-Client}", ""},
+		{"auth: {type: tokens, tokensFile: tokens.yaml}", ""},
+		{"auth: {type: jwt, jwt: {keysFile: keys.yaml}}", ""},
+		{"auth: {type: basic}", "unknown auth.type"},
+		{"auth: {type: tokens}", "auth.tokensFile"},
+		{"auth: {type: jwt}", "auth.jwt.keysFile"},
+		{"auth: {type: header}", "auth.header"},
+		{"auth: {type: mtls}", "tls.clientCA"},
+		{"auth: {type: mtls, mtls: {keySource: dns}}\ntls: {cert: c, key: k, clientCA: ca}", "keySource"},
+		{"auth: {type: header, header: X}\ntls: {cert: c}", "tls.cert and tls.key"},
+		{"auth: {type: header, header: X}\ntls: {clientCA: ca}", "tls.clientCA requires"},
+		{"auth: {type: header, header: X}\nduplicatePolicy: drop", "duplicatePolicy"},
+		{"auth: {type: header, header: X}\nfrontends: {socksListen: ':1080'}", "frontends.usersFile"},
+		{"auth: {type: header, header: X}\nfrontends: {reverseProxyPrefix: /client}", "frontends.usersFile"},
+		{"auth: {type: header, header: X}\nadmin: {listen: ':9000'}", "admin.tokensFile"},
+		{"auth: {type: header, header: X}\nfrontends: {forwards: [{listen: ':15432', clientKey: agent}]}", "invalid forward"},
+	}
+	for _, test := range tests {
+		path, cleanup := writeConfig(t, test.config)
+		_, err := loadConfig(path)
+		cleanup()
+
+		if test.err == "" && err != nil {
+			t.Errorf("%s: %v", test.config, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected an error about %s, got %v", test.config, test.err, err)
+		}
+	}
+}
+
+func TestFrontendUsers(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+alice:
+  password: secret
+  clientKeys: [a, b]
+bob:
+  clientKeys: [a]
+`)
+	defer cleanup()
+
+	users, err := readUsers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{}
+	s.users.Store(users)
+
+	tests := []struct {
+		username, password string
+		clientKey          string
+		ok                 bool
+	}{
+		{"alice", "secret", "a", true},
+		{"alice/b", "secret", "b", true},
+		{"alice/c", "secret", "c", false},
+		{"alice", "wrong", "", false},
+		// Users without a password can't authenticate
+		{"bob", "", "", false},
+		{"carol", "", "", false},
+	}
+	for _, test := range tests {
+		clientKey, ok := s.authenticateSocks(test.username, test.password)
+		if ok != test.ok || (ok && clientKey != test.clientKey) {
+			t.Errorf("%s: got %q, %v", test.username, clientKey, ok)
+		}
+	}
+
+	if !s.authorizeReverse("alice", "secret", "b") || s.authorizeReverse("alice", "secret", "c") {
+		t.Fatal("reverse proxy authorization doesn't follow clientKeys")
+	}
+	if !s.authorizeProxy("alice", "b") || s.authorizeProxy("bob", "b") {
+		t.Fatal("proxy authorization doesn't follow clientKeys")
+	}
+}
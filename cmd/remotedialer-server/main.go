@@ -0,0 +1,55 @@
+// remotedialer-server accepts agents and serves the front-ends dialing through them, as
+// configured by a YAML file. SIGHUP reloads the file and reopens the audit log, SIGTERM and
+// SIGINT drain the sessions before exiting.
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	configFile := flag.String("config", "/etc/remotedialer/server.yaml", "Config file")
+	flag.Parse()
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	s, err := newServer(*configFile, config)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	errs := make(chan error, 1)
+	if err := s.start(errs); err != nil {
+		logrus.Fatal(err)
+	}
+
+	for {
+		select {
+		case err := <-errs:
+			logrus.Fatal(err)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				s.reload()
+				continue
+			}
+
+			logrus.Infof("Received %s, draining sessions for up to %s", sig, s.config.ShutdownTimeout)
+			ctx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+			s.shutdown(ctx)
+			cancel()
+			return
+		}
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rancher/remotedialer"
+	"github.com/rancher/remotedialer/admin"
+	"github.com/rancher/remotedialer/audit"
+	"github.com/rancher/remotedialer/httpproxy"
+	"github.com/rancher/remotedialer/metrics"
+	"github.com/rancher/remotedialer/portforward"
+	"github.com/rancher/remotedialer/socks5"
+	"github.com/sirupsen/logrus"
+)
+
+type server struct {
+	sync.Mutex
+
+	configFile string
+	config     *Config
+
+	handler    *remotedialer.Server
+	authorizer atomic.Value
+	adminAuth  atomic.Value
+	users      atomic.Value
+	tlsConfig  atomic.Value
+	forwards   *portforward.PortForward
+	audit      *audit.Log
+	peers      map[string]remotedialer.PeerInfo
+
+	listener      net.Listener
+	httpServer    *http.Server
+	metricsServer *http.Server
+	adminServer   *http.Server
+	socks         net.Listener
+	cancel        func()
+	stopping      int32
+}
+
+func newServer(configFile string, config *Config) (*server, error) {
+	s := &server{
+		configFile: configFile,
+		peers:      map[string]remotedialer.PeerInfo{},
+	}
+
+	policy, err := duplicatePolicy(config.DuplicatePolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	s.handler = remotedialer.New(s.authorize, remotedialer.DefaultErrorWriter)
+	s.handler.PeerID = config.Peers.ID
+	s.handler.PeerToken = config.Peers.Token
+	s.handler.Limits = config.Limits
+	s.handler.DuplicatePolicy = policy
+	s.handler.ResumeGracePeriod = config.ResumeGracePeriod
+	s.handler.MaxStripes = config.MaxStripes
+	if s.handler.PeerTLSConfig, err = newPeerTLSConfig(config.Peers); err != nil {
+		return nil, err
+	}
+	s.forwards = portforward.New(s.handler, config.DialTimeout)
+
+	if s.audit, err = audit.New(config.Audit, "remotedialer-server"); err != nil {
+		return nil, err
+	}
+	if s.audit != nil {
+		s.handler.Audit = s.audit
+	}
+
+	if err := s.apply(config); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *server) authorize(req *http.Request) (string, bool, error) {
+	return s.authorizer.Load().(remotedialer.Authorizer)(req)
+}
+
+func (s *server) authorizeAdmin(req *http.Request) (string, bool, error) {
+	return s.adminAuth.Load().(remotedialer.Authorizer)(req)
+}
+
+func (s *server) getUsers() frontendUsers {
+	users, _ := s.users.Load().(frontendUsers)
+	return users
+}
+
+// authenticateSocks authenticates a SOCKS username of the form user or user/clientKey.
+func (s *server) authenticateSocks(username, password string) (string, bool) {
+	clientKey := ""
+	if i := strings.Index(username, "/"); i >= 0 {
+		username, clientKey = username[:i], username[i+1:]
+	}
+	user, ok := s.getUsers().authenticate(username, password)
+	if !ok {
+		return "", false
+	}
+	if clientKey == "" {
+		return user.defaultClientKey()
+	}
+	return clientKey, user.allows(clientKey)
+}
+
+func (s *server) authenticateProxy(username, password string) (string, bool) {
+	user, ok := s.getUsers().authenticate(username, password)
+	if !ok {
+		return "", false
+	}
+	return user.defaultClientKey()
+}
+
+func (s *server) authorizeProxy(username, clientKey string) bool {
+	return s.getUsers()[username].allows(clientKey)
+}
+
+func (s *server) authorizeReverse(username, password, clientKey string) bool {
+	user, ok := s.getUsers().authenticate(username, password)
+	return ok && user.allows(clientKey)
+}
+
+// apply applies the reloadable settings of config.
+func (s *server) apply(config *Config) error {
+	level, err := logrus.ParseLevel(config.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	authorizer, err := newAuthorizer(config.Auth, config.TLS.ClientCA)
+	if err != nil {
+		return err
+	}
+	if config.TLS.ClientCA != "" {
+		authorizer = requireClientCert(authorizer)
+	}
+
+	var users frontendUsers
+	if config.Frontends.UsersFile != "" {
+		if users, err = readUsers(config.Frontends.UsersFile); err != nil {
+			return err
+		}
+	}
+
+	adminAuth := tokensAuthorizer(nil)
+	if config.Admin.TokensFile != "" {
+		tokens, err := readMap(config.Admin.TokensFile)
+		if err != nil {
+			return err
+		}
+		adminAuth = tokensAuthorizer(tokens)
+	}
+
+	var tlsConfig *tls.Config
+	if config.TLS.Cert != "" {
+		if tlsConfig, err = newTLSConfig(config.TLS); err != nil {
+			return err
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.config != nil {
+		warnRestart(s.config, config)
+	}
+	s.config = config
+
+	logrus.SetLevel(level)
+	s.authorizer.Store(authorizer)
+	s.adminAuth.Store(adminAuth)
+	s.users.Store(users)
+	if tlsConfig != nil {
+		s.tlsConfig.Store(tlsConfig)
+	}
+
+	s.handler.SetPeerToken(config.Peers.Token)
+	s.applyPeers(config.Peers)
+
+	return s.forwards.Set(config.Frontends.Forwards)
+}
+
+func (s *server) applyPeers(config PeersConfig) {
+	wanted := map[string]remotedialer.PeerInfo{}
+	for _, p := range config.Static {
+		if p.Token == "" {
+			p.Token = config.Token
+		}
+		wanted[p.ID] = p
+	}
+
+	for id := range s.peers {
+		if _, ok := wanted[id]; !ok {
+			s.handler.RemovePeer(id)
+		}
+	}
+	for _, p := range wanted {
+		s.handler.AddPeer(p.URL, p.ID, p.Token)
+	}
+	s.peers = wanted
+}
+
+// warnRestart logs the settings that changed but are only applied on start.
+func warnRestart(before, after *Config) {
+	var changed []string
+	if before.Listen != after.Listen || before.Path != after.Path || (before.TLS.Cert == "") != (after.TLS.Cert == "") {
+		changed = append(changed, "listen")
+	}
+	if before.Peers.ID != after.Peers.ID || before.Peers.CA != after.Peers.CA || before.Peers.File != after.Peers.File || fmt.Sprint(before.Peers.DNS) != fmt.Sprint(after.Peers.DNS) {
+		changed = append(changed, "peers")
+	}
+	if before.Metrics != after.Metrics {
+		changed = append(changed, "metrics")
+	}
+	if before.Admin.Listen != after.Admin.Listen {
+		changed = append(changed, "admin")
+	}
+	if before.Audit != after.Audit {
+		changed = append(changed, "audit")
+	}
+	if before.Limits != after.Limits || before.DuplicatePolicy != after.DuplicatePolicy ||
+		before.ResumeGracePeriod != after.ResumeGracePeriod || before.MaxStripes != after.MaxStripes {
+		changed = append(changed, "session settings")
+	}
+	if before.Frontends.SocksListen != after.Frontends.SocksListen || before.Frontends.HTTPProxy != after.Frontends.HTTPProxy ||
+		before.Frontends.ReverseProxyPrefix != after.Frontends.ReverseProxyPrefix || before.DialTimeout != after.DialTimeout {
+		changed = append(changed, "front-ends")
+	}
+	if len(changed) > 0 {
+		logrus.Warnf("Changes to %s are applied on restart", strings.Join(changed, ", "))
+	}
+}
+
+func newTLSConfig(config TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if config.ClientCA != "" {
+		pem, err := ioutil.ReadFile(config.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.ClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		// Peers have no client certificate, agents are required one by requireClientCert
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// newPeerTLSConfig verifies peers against config.CA.
+func newPeerTLSConfig(config PeersConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if config.CA != "" {
+		pem, err := ioutil.ReadFile(config.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CA)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// reload re-reads the config file, keeping the current config if it is invalid, and reopens
+// the audit file.
+func (s *server) reload() {
+	if s.audit != nil {
+		if err := s.audit.Reopen(); err != nil {
+			logrus.Errorf("Failed to reopen audit log: %v", err)
+		}
+	}
+
+	config, err := loadConfig(s.configFile)
+	if err == nil {
+		err = s.apply(config)
+	}
+	if err != nil {
+		logrus.Errorf("Failed to reload %s: %v", s.configFile, err)
+		return
+	}
+	logrus.Infof("Reloaded %s", s.configFile)
+}
+
+// start starts the listeners, errors of those failing later are sent to errs.
+func (s *server) start(errs chan<- error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	config := s.config
+
+	if config.Peers.File != "" {
+		go s.handler.DiscoverPeers(ctx, &remotedialer.FileDiscovery{Path: config.Peers.File}, config.Peers.DiscoveryInterval)
+	}
+	if config.Peers.DNS != nil {
+		dns := *config.Peers.DNS
+		if dns.Token == "" {
+			dns.Token = config.Peers.Token
+		}
+		go s.handler.DiscoverPeers(ctx, &dns, config.Peers.DiscoveryInterval)
+	}
+
+	router := mux.NewRouter()
+	router.Handle(config.Path, s.handler)
+	if prefix := strings.TrimSuffix(config.Frontends.ReverseProxyPrefix, "/"); prefix != "" {
+		route := httpproxy.AuthRoute(httpproxy.PathRoute(prefix), s.authorizeReverse)
+		router.PathPrefix(prefix + "/").Handler(httpproxy.NewReverseProxy(s.handler, config.DialTimeout, route))
+	}
+
+	var handler http.Handler = router
+	if config.Frontends.HTTPProxy.Enabled {
+		proxy := httpproxy.New(s.handler, config.DialTimeout, router)
+		proxy.Header = config.Frontends.HTTPProxy.Header
+		proxy.Suffix = config.Frontends.HTTPProxy.Suffix
+		proxy.Authenticate = s.authenticateProxy
+		proxy.Authorize = s.authorizeProxy
+		handler = proxy
+	}
+
+	l, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return err
+	}
+	if config.TLS.Cert != "" {
+		l = tls.NewListener(l, &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return s.tlsConfig.Load().(*tls.Config), nil
+			},
+		})
+	}
+	s.listener = &onceCloseListener{Listener: l}
+	s.httpServer = &http.Server{Handler: handler}
+	go s.serve(errs, "websocket", func() error { return s.httpServer.Serve(s.listener) })
+	logrus.Infof("Listening on %s", config.Listen)
+
+	if config.Metrics.Listen != "" {
+		metrics.Enable()
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.Handler())
+		s.metricsServer = &http.Server{Addr: config.Metrics.Listen, Handler: metricsMux}
+		go s.serve(errs, "metrics", s.metricsServer.ListenAndServe)
+		logrus.Infof("Serving metrics on %s", config.Metrics.Listen)
+	}
+
+	if config.Admin.Listen != "" {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/admin/", admin.New(s.handler, s.authorizeAdmin, "/admin"))
+		s.adminServer = &http.Server{Addr: config.Admin.Listen, Handler: adminMux}
+		go s.serve(errs, "admin", s.adminServer.ListenAndServe)
+		logrus.Infof("Serving admin API on %s", config.Admin.Listen)
+	}
+
+	if config.Frontends.SocksListen != "" {
+		if s.socks, err = net.Listen("tcp", config.Frontends.SocksListen); err != nil {
+			return err
+		}
+		socks := socks5.New(s.handler, config.DialTimeout)
+		socks.Authenticate = s.authenticateSocks
+		go s.serve(errs, "SOCKS", func() error { return socks.Serve(s.socks) })
+		logrus.Infof("Serving SOCKS5 on %s", config.Frontends.SocksListen)
+	}
+
+	return nil
+}
+
+func (s *server) serve(errs chan<- error, name string, f func() error) {
+	if err := f(); err != nil && err != http.ErrServerClosed && atomic.LoadInt32(&s.stopping) == 0 {
+		errs <- fmt.Errorf("%s listener failed: %v", name, err)
+	}
+}
+
+// shutdown stops accepting connections, drains the sessions and then finishes the HTTP
+// requests left, all before ctx is done.
+func (s *server) shutdown(ctx context.Context) {
+	atomic.StoreInt32(&s.stopping, 1)
+	s.listener.Close()
+	if s.socks != nil {
+		s.socks.Close()
+	}
+	s.forwards.Stop()
+
+	if err := s.handler.Shutdown(ctx); err != nil {
+		logrus.Errorf("Failed to drain sessions: %v", err)
+	}
+
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		logrus.Errorf("Failed to finish HTTP requests: %v", err)
+		s.httpServer.Close()
+	}
+	s.forwards.Close()
+
+	s.cancel()
+	if s.metricsServer != nil {
+		s.metricsServer.Close()
+	}
+	if s.adminServer != nil {
+		s.adminServer.Close()
+	}
+	if s.audit != nil {
+		s.audit.Close()
+	}
+}
+
+// onceCloseListener lets the listener be closed before the http.Server using it is shut down.
+type onceCloseListener struct {
+	net.Listener
+	once sync.Once
+	err  error
+}
+
+func (l *onceCloseListener) Close() error {
+	l.once.Do(func() {
+		l.err = l.Listener.Close()
+	})
+	return l.err
+}
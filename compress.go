@@ -0,0 +1,125 @@
+package remotedialer
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/rancher/remotedialer/metrics"
+)
+
+// Compression is sent by the client with the payload compression it supports, and returned by
+// the server if it agrees to use it.
+var Compression = "X-API-Tunnel-Compression"
+
+const (
+	deflateEncoding = "deflate"
+
+	// flagCompressed marks an extended Data message whose payload is deflated
+	flagCompressed = 1
+
+	defaultCompressionThreshold = 512
+
+	// maxInflated bounds the inflated payload of a Data message. Senders compress at most
+	// MaxRead bytes at a time.
+	maxInflated = 4 * MaxRead
+)
+
+var errInflateLimit = errors.New("compressed payload exceeds inflate limit")
+
+type CompressionConfig struct {
+	// WebsocketDeflate negotiates permessage-deflate on the websocket.
+	WebsocketDeflate bool
+	// Deflate compresses the payload of Data messages, if the other side supports it.
+	Deflate bool
+	// Threshold is the smallest payload that is compressed, 512 bytes by default.
+	Threshold int
+	// Exclude returns true for destinations whose streams are already compressed, such as TLS,
+	// so no time is spent compressing them again.
+	Exclude func(proto, address string) bool
+}
+
+func (c CompressionConfig) threshold() int {
+	if c.Threshold <= 0 {
+		return defaultCompressionThreshold
+	}
+	return c.Threshold
+}
+
+func (c CompressionConfig) excluded(proto, address string) bool {
+	return c.Exclude != nil && c.Exclude(proto, address)
+}
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// extendedData reports whether Data messages on the session carry the extended header.
+func (s *Session) extendedData() bool {
+	return s.resumable() || s.deflate
+}
+
+// compress deflates the payload of msg if the session negotiated it, the destination isn't
+// excluded and it makes the payload smaller.
+func (c *connection) compress(msg *message) {
+	config := c.session.compression
+	if !c.session.deflate || !config.Deflate || len(msg.bytes) < config.threshold() ||
+		config.excluded(c.addr.proto, c.addr.address) {
+		return
+	}
+
+	compressed, err := deflate(msg.bytes)
+	if err != nil || len(compressed) >= len(msg.bytes) {
+		return
+	}
+
+	metrics.AddSMTotalCompression(c.session.clientKey, float64(len(msg.bytes)), float64(len(compressed)))
+	msg.bytes = compressed
+	msg.flags |= flagCompressed
+}
+
+// payload returns the reader for the payload of a Data message, inflating it if needed. The
+// inflating reader fails past maxInflated bytes, to resist decompression bombs.
+func (m *message) payload() io.Reader {
+	if m.flags&flagCompressed != 0 {
+		return &inflateReader{
+			reader:    io.LimitReader(flate.NewReader(m), maxInflated+1),
+			remaining: maxInflated,
+		}
+	}
+	return m
+}
+
+type inflateReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (r *inflateReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n + int(r.remaining), errInflateLimit
+	}
+	return n, err
+}
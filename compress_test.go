@@ -0,0 +1,129 @@
+package remotedialer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressThreshold(t *testing.T) {
+	session := &Session{
+		deflate: true,
+		compression: CompressionConfig{
+			Deflate:   true,
+			Threshold: 100,
+			Exclude: func(proto, address string) bool {
+				return strings.HasSuffix(address, ":443")
+			},
+		},
+	}
+	payload := []byte(strings.Repeat("a", 100))
+
+	tests := []struct {
+		address    string
+		payload    []byte
+		compressed bool
+	}{
+		{"example.com:80", payload, true},
+		{"example.com:80", payload[:99], false},
+		{"example.com:443", payload, false},
+	}
+	for _, test := range tests {
+		conn := &connection{session: session, addr: addr{proto: "tcp", address: test.address}}
+		msg := newMessage(1, 0, test.payload)
+		conn.compress(msg)
+		if compressed := msg.flags&flagCompressed != 0; compressed != test.compressed {
+			t.Errorf("%s with %d bytes: compressed %v, expected %v", test.address, len(test.payload), compressed, test.compressed)
+		}
+	}
+
+	// Payloads that don't shrink are sent as is
+	random := make([]byte, 1000)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	conn := &connection{session: session, addr: addr{proto: "tcp", address: "example.com:80"}}
+	msg := newMessage(1, 0, random)
+	if conn.compress(msg); msg.flags&flagCompressed != 0 {
+		t.Fatal("incompressible payload compressed")
+	}
+
+	session.deflate = false
+	msg = newMessage(1, 0, payload)
+	if conn.compress(msg); msg.flags&flagCompressed != 0 {
+		t.Fatal("payload compressed on a session without compression")
+	}
+}
+
+func TestInflateLimit(t *testing.T) {
+	bomb, err := deflate(make([]byte, 10*MaxRead))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &message{flags: flagCompressed, body: bytes.NewReader(bomb)}
+	if n, err := io.Copy(ioutil.Discard, m.payload()); err != errInflateLimit || n != maxInflated {
+		t.Fatalf("inflated %d bytes: %v", n, err)
+	}
+
+	data, err := deflate(make([]byte, MaxRead))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = &message{flags: flagCompressed, body: bytes.NewReader(data)}
+	if n, err := io.Copy(ioutil.Discard, m.payload()); err != nil || n != MaxRead {
+		t.Fatalf("inflated %d bytes: %v", n, err)
+	}
+}
+
+func TestInflateLimitFailsConnection(t *testing.T) {
+	echo, closeEcho := listenEcho(t)
+	defer closeEcho()
+	server, url, closeServer := newTestServer()
+	defer closeServer()
+	server.Compression = CompressionConfig{Deflate: true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connectClient(ctx, url, "foo", ClientOptions{Compression: CompressionConfig{Deflate: true}})
+	if !waitFor(func() bool { return server.HasSession("foo") }) {
+		t.Fatal("client did not connect")
+	}
+	session := clientSessions(server, "foo")[0]
+	if !session.deflate {
+		t.Fatal("compression not negotiated")
+	}
+	checkEcho(t, server, "foo", echo)
+
+	conn, err := server.Dial("foo", 5*time.Second, "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	bomb, err := deflate(make([]byte, 10*MaxRead))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := newMessage(conn.(*connection).connID, 0, bomb)
+	msg.extended = true
+	msg.flags = flagCompressed
+	if _, err := session.writeMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, conn); err == nil || !strings.Contains(err.Error(), errInflateLimit.Error()) {
+		t.Fatalf("expected the connection to fail with %v, got %v", errInflateLimit, err)
+	}
+
+	// Only the connection failed
+	if sessions := clientSessions(server, "foo"); len(sessions) != 1 || sessions[0] != session {
+		t.Fatal("session closed")
+	}
+	checkEcho(t, server, "foo", echo)
+}
@@ -36,10 +36,19 @@ type connection struct {
 	err           error
 	writeDeadline time.Time
 	buf           chan []byte
+	closed        chan struct{}
 	readBuf       []byte
 	addr          addr
 	session       *Session
 	connID        int64
+	stripe        int64
+	priority      Priority
+	limiter       rateLimiter
+	replay        *replayBuffer
+	created       time.Time
+	transmitted   int64
+	received      int64
+	caller        string
 }
 
 func newConnection(connID int64, session *Session, proto, address string) *connection {
@@ -51,6 +60,11 @@ func newConnection(connID int64, session *Session, proto, address string) *conne
 		connID:  connID,
 		session: session,
 		buf:     make(chan []byte, 1024),
+		closed:  make(chan struct{}),
+		created: time.Now(),
+	}
+	if session.resumable() {
+		c.replay = &replayBuffer{}
 	}
 	metrics.IncSMTotalAddConnectionsForWS(session.clientKey, proto, address)
 	return c
@@ -64,9 +78,8 @@ func (c *connection) tunnelClose(err error) {
 
 func (c *connection) doTunnelClose(err error) {
 	c.Lock()
-	defer c.Unlock()
-
 	if c.err != nil {
+		c.Unlock()
 		return
 	}
 
@@ -76,6 +89,20 @@ func (c *connection) doTunnelClose(err error) {
 	}
 
 	close(c.buf)
+	close(c.closed)
+	c.Unlock()
+
+	c.audit(AuditClose, err)
+}
+
+func (c *connection) closeErr() error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.err == nil {
+		return io.ErrClosedPipe
+	}
+	return c.err
 }
 
 func (c *connection) tunnelWriter() io.Writer {
@@ -101,6 +128,8 @@ func (c *connection) Read(b []byte) (int, error) {
 	n := c.copyData(b)
 	if n > 0 {
 		metrics.AddSMTotalReceiveBytesOnWS(c.session.clientKey, float64(n))
+		// Once closed the rest of the buffered data is read without waiting
+		c.waitReceive(n)
 		return n, nil
 	}
 
@@ -118,6 +147,7 @@ func (c *connection) Read(b []byte) (int, error) {
 	c.readBuf = next
 	n = c.copyData(b)
 	metrics.AddSMTotalReceiveBytesOnWS(c.session.clientKey, float64(n))
+	c.waitReceive(n)
 	return n, nil
 }
 
@@ -129,20 +159,52 @@ func (c *connection) Write(b []byte) (int, error) {
 	}
 	c.Unlock()
 
+	// Large writes are split so they take turns with the other connections of the session
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > MaxRead {
+			chunk = chunk[:MaxRead]
+		}
+		if err := c.writeChunk(chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *connection) writeChunk(b []byte) error {
+	if err := c.waitTransmit(len(b)); err != nil {
+		return err
+	}
+
 	deadline := int64(0)
 	if !c.writeDeadline.IsZero() {
 		deadline = c.writeDeadline.Sub(time.Now()).Nanoseconds() / 1000000
 	}
 	msg := newMessage(c.connID, deadline, b)
+	msg.priority = c.getPriority()
+	msg.extended = c.session.extendedData()
+	c.compress(msg)
 	metrics.AddSMTotalTransmitBytesOnWS(c.session.clientKey, float64(len(msg.Bytes())))
-	return c.session.writeMessage(msg)
+
+	var err error
+	if c.replay != nil {
+		_, err = c.replay.write(c, msg)
+	} else {
+		_, err = c.session.writeMessageOn(c.getStripe(), msg)
+	}
+	return err
 }
 
 func (c *connection) writeErr(err error) {
 	if err != nil {
 		msg := newErrorMessage(c.connID, err)
+		msg.priority = c.getPriority()
 		metrics.AddSMTotalTransmitErrorBytesOnWS(c.session.clientKey, float64(len(msg.Bytes())))
-		c.session.writeMessage(msg)
+		c.session.writeMessageOn(c.getStripe(), msg)
 	}
 }
 
@@ -205,6 +267,11 @@ func (c chanWriter) Write(buf []byte) (int, error) {
 	case c.C <- buf:
 		return len(buf), nil
 	default:
+		// Waiting blocks the reader shared by the session, don't for a connection whose
+		// reads are paced
+		if c.conn.receiveLimited() {
+			return 0, errReceiveOverflow
+		}
 		select {
 		case c.C <- buf:
 			return len(buf), nil
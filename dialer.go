@@ -13,10 +13,38 @@ func (s *Server) HasSession(clientKey string) bool {
 }
 
 func (s *Server) Dial(clientKey string, deadline time.Duration, proto, address string) (net.Conn, error) {
-	d, err := s.sessions.getDialer(clientKey, deadline)
+	return s.dialTTL(clientKey, deadline, MaxPeerHops, "", proto, address)
+}
+
+// DialOptions are applied to a connection by DialWithOptions.
+type DialOptions struct {
+	Priority  Priority
+	RateLimit RateLimit
+	// Caller identifies who asked for the connection in the events of the Server's Audit sink.
+	Caller string
+}
+
+// DialWithOptions is Dial with a Priority and RateLimit for the connection, which can later
+// be changed with SetPriority and SetRateLimit.
+func (s *Server) DialWithOptions(clientKey string, deadline time.Duration, proto, address string, opts DialOptions) (net.Conn, error) {
+	conn, err := s.dialTTL(clientKey, deadline, MaxPeerHops, opts.Caller, proto, address)
 	if err != nil {
 		return nil, err
 	}
+	SetPriority(conn, opts.Priority)
+	SetRateLimit(conn, opts.RateLimit)
+	return conn, nil
+}
+
+func (s *Server) dialTTL(clientKey string, deadline time.Duration, ttl int, caller, proto, address string) (net.Conn, error) {
+	d, err := s.sessions.getDialerTTL(clientKey, deadline, ttl, caller)
+	if err != nil {
+		clusterDialer, ok := s.clusterDialer(clientKey, deadline, caller)
+		if !ok || ttl <= 0 {
+			return nil, err
+		}
+		d = clusterDialer
+	}
 
 	return d(proto, address)
 }
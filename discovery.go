@@ -0,0 +1,189 @@
+package remotedialer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// PeerInfo describes a peer found by a PeerDiscovery.
+type PeerInfo struct {
+	ID    string `json:"id" yaml:"id"`
+	URL   string `json:"url" yaml:"url"`
+	Token string `json:"token" yaml:"token"`
+}
+
+// PeerDiscovery returns the current set of peers. It is polled by Server.DiscoverPeers.
+type PeerDiscovery interface {
+	Peers(ctx context.Context) ([]PeerInfo, error)
+}
+
+// DNSDiscovery finds peers by resolving the A/AAAA records of a headless service or, if
+// Service is set, the SRV records _Service._Proto.Name. The peer ID is the resolved IP for
+// A/AAAA records and the target host name for SRV records, so servers must use the same
+// value as their PeerID.
+type DNSDiscovery struct {
+	Name    string
+	Service string
+	Proto   string
+	// Port is used for A/AAAA records, SRV records carry their own port.
+	Port int
+	// Scheme and Path build the peer URL, "ws" and "/connect" by default.
+	Scheme string
+	Path   string
+	Token  string
+	// Server, if set, is the host:port of the DNS server to query instead of the system
+	// resolver.
+	Server string
+}
+
+func (d *DNSDiscovery) resolver() *net.Resolver {
+	if d.Server == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialer := net.Dialer{}
+			return dialer.DialContext(ctx, network, d.Server)
+		},
+	}
+}
+
+func (d *DNSDiscovery) url(host string, port int) string {
+	scheme := d.Scheme
+	if scheme == "" {
+		scheme = "ws"
+	}
+	path := d.Path
+	if path == "" {
+		path = "/connect"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, strconv.Itoa(port)), path)
+}
+
+func (d *DNSDiscovery) Peers(ctx context.Context) ([]PeerInfo, error) {
+	var result []PeerInfo
+	resolver := d.resolver()
+
+	if d.Service != "" {
+		_, records, err := resolver.LookupSRV(ctx, d.Service, d.Proto, d.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to lookup SRV records for %s", d.Name)
+		}
+		for _, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			result = append(result, PeerInfo{
+				ID:    host,
+				URL:   d.url(host, int(record.Port)),
+				Token: d.Token,
+			})
+		}
+		return result, nil
+	}
+
+	addrs, err := resolver.LookupHost(ctx, d.Name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to lookup %s", d.Name)
+	}
+	for _, addr := range addrs {
+		result = append(result, PeerInfo{
+			ID:    addr,
+			URL:   d.url(addr, d.Port),
+			Token: d.Token,
+		})
+	}
+	return result, nil
+}
+
+// FileDiscovery reads peers from a JSON or YAML file containing a list of PeerInfo. The file is
+// re-read when its modification time changes.
+type FileDiscovery struct {
+	sync.Mutex
+
+	Path string
+
+	modTime time.Time
+	peers   []PeerInfo
+}
+
+func (f *FileDiscovery) Peers(ctx context.Context) ([]PeerInfo, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	stat, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	if stat.ModTime().Equal(f.modTime) {
+		return f.peers, nil
+	}
+
+	bytes, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []PeerInfo
+	if err := yaml.Unmarshal(bytes, &peers); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse peers file %s", f.Path)
+	}
+
+	f.peers = peers
+	f.modTime = stat.ModTime()
+	return peers, nil
+}
+
+// DiscoverPeers polls discovery every interval until ctx is done, calling AddPeer for new
+// peers and RemovePeer for peers that are no longer returned. Entries matching PeerID are
+// ignored. If Cluster is set its members are replaced with the discovered peers, which should
+// include this server.
+func (s *Server) DiscoverPeers(ctx context.Context, discovery PeerDiscovery, interval time.Duration) {
+	known := map[string]bool{}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		peers, err := discovery.Peers(ctx)
+		if err != nil {
+			logrus.Errorf("Failed to discover peers: %v", err)
+		} else {
+			if s.Cluster != nil {
+				s.Cluster.SetMembers(peers)
+			}
+
+			current := map[string]bool{}
+			for _, p := range peers {
+				if p.ID == "" || p.ID == s.PeerID {
+					continue
+				}
+				current[p.ID] = true
+				s.AddPeer(p.URL, p.ID, p.Token)
+			}
+
+			for id := range known {
+				if !current[id] {
+					s.RemovePeer(id)
+				}
+			}
+			known = current
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package remotedialer
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/rancher/remotedialer/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// InstanceID is sent by the client with an ID unique to the running agent, so the server can
+// tell a reconnecting agent from another agent using the same client key.
+var InstanceID = "X-API-Tunnel-Instance"
+
+var ErrDuplicateSession = errors.New("client key is connected by another instance")
+
+// DuplicatePolicy decides what happens when a client connects while sessions for its client
+// key already exist. If the client sends an InstanceID only the sessions of the same instance
+// are considered its own, the others belong to different agents.
+type DuplicatePolicy int
+
+const (
+	// DuplicateAllow keeps every session, dials use the oldest one.
+	DuplicateAllow DuplicatePolicy = iota
+	// DuplicateReplace closes the previous sessions of the instance once the new one is
+	// connected, so dials don't go to a websocket that is not yet known to be dead.
+	DuplicateReplace
+	// DuplicateReject refuses new sessions while another instance is connected. Sessions of
+	// the same instance are replaced.
+	DuplicateReject
+)
+
+// duplicates returns the sessions of clientKey a new session from instanceID would replace, or
+// ErrDuplicateSession if it must be rejected.
+func (sm *sessionManager) duplicates(clientKey, instanceID string, policy DuplicatePolicy) ([]*Session, error) {
+	if policy == DuplicateAllow {
+		return nil, nil
+	}
+
+	sm.Lock()
+	defer sm.Unlock()
+
+	var same []*Session
+	for _, session := range sm.clients[clientKey] {
+		if instanceID == "" || session.instanceID == instanceID {
+			same = append(same, session)
+		} else if policy == DuplicateReject {
+			return nil, ErrDuplicateSession
+		}
+	}
+
+	if policy == DuplicateReject && instanceID == "" && len(same) > 0 {
+		return nil, ErrDuplicateSession
+	}
+	return same, nil
+}
+
+// checkDuplicates applies DuplicatePolicy to a new session of clientKey, returning the sessions
+// to replace once it is connected, or false after writing the error.
+func (s *Server) checkDuplicates(rw http.ResponseWriter, req *http.Request, clientKey string) ([]*Session, bool) {
+	replaced, err := s.sessions.duplicates(clientKey, req.Header.Get(InstanceID), s.DuplicatePolicy)
+	if err != nil {
+		metrics.IncSMTotalLimitRejected(clientKey, err.Error())
+		s.errorWriter(rw, req, http.StatusConflict, err)
+		return nil, false
+	}
+	return replaced, true
+}
+
+// replace removes sessions superseded by a new session and closes their websockets.
+func (sm *sessionManager) replace(sessions []*Session) {
+	for _, session := range sessions {
+		logrus.Infof("Replacing backend connection [%s] %d", session.clientKey, session.sessionKey)
+		sm.remove(session)
+		session.getConn().conn.Close()
+	}
+}
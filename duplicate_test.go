@@ -0,0 +1,96 @@
+package remotedialer
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// connectInstance connects a client session of foo as instance, returning the status code of
+// the handshake.
+func connectInstance(ctx context.Context, t *testing.T, url, instance string) int {
+	ws, resp, err := websocket.DefaultDialer.Dial(url, http.Header{
+		clientKeyHeader: {"foo"},
+		InstanceID:      {instance},
+	})
+	if err != nil {
+		if resp == nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	session := NewClientSession(func(string, string) bool { return true }, ws)
+	go session.Serve(ctx)
+	return resp.StatusCode
+}
+
+func instances(server *Server) []string {
+	var result []string
+	for _, session := range clientSessions(server, "foo") {
+		result = append(result, session.instanceID)
+	}
+	return result
+}
+
+func TestDuplicateReplace(t *testing.T) {
+	echo, closeEcho := listenEcho(t)
+	defer closeEcho()
+	server, url, closeServer := newTestServer()
+	defer closeServer()
+	server.DuplicatePolicy = DuplicateReplace
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	connectInstance(ctx, t, url, "one")
+	if !waitFor(func() bool { return len(instances(server)) == 1 }) {
+		t.Fatal("first instance did not connect")
+	}
+	first := clientSessions(server, "foo")[0]
+
+	// Another instance is another agent, its session is kept
+	connectInstance(ctx, t, url, "two")
+	if !waitFor(func() bool { return len(instances(server)) == 2 }) {
+		t.Fatalf("second instance did not connect: %v", instances(server))
+	}
+
+	// The same instance reconnecting replaces its session
+	connectInstance(ctx, t, url, "one")
+	if !waitFor(func() bool {
+		sessions := clientSessions(server, "foo")
+		return len(sessions) == 2 && sessions[0] != first && sessions[1] != first
+	}) {
+		t.Fatalf("reconnected instance did not replace its session: %v", instances(server))
+	}
+	checkEcho(t, server, "foo", echo)
+}
+
+func TestDuplicateReject(t *testing.T) {
+	server, url, closeServer := newTestServer()
+	defer closeServer()
+	server.DuplicatePolicy = DuplicateReject
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	connectInstance(ctx, t, url, "one")
+	if !waitFor(func() bool { return len(instances(server)) == 1 }) {
+		t.Fatal("first instance did not connect")
+	}
+
+	if code := connectInstance(ctx, t, url, "two"); code != http.StatusConflict {
+		t.Fatalf("second instance got %d, expected %d", code, http.StatusConflict)
+	}
+
+	// The same instance replaces its session
+	first := clientSessions(server, "foo")[0]
+	connectInstance(ctx, t, url, "one")
+	if !waitFor(func() bool {
+		sessions := clientSessions(server, "foo")
+		return len(sessions) == 1 && sessions[0] != first
+	}) {
+		t.Fatalf("reconnected instance did not replace its session: %v", instances(server))
+	}
+}
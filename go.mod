@@ -8,4 +8,5 @@ require (
 	github.com/pkg/errors v0.8.1
 	github.com/prometheus/client_golang v1.4.0
 	github.com/sirupsen/logrus v1.4.2
+	gopkg.in/yaml.v2 v2.2.5
 )
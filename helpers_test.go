@@ -0,0 +1,100 @@
+package remotedialer
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientKeyHeader carries the client key of the test clients, accepted as is.
+const clientKeyHeader = "X-Test-Client"
+
+// newTestServer returns a Server accepting any client key and the websocket URL it is served
+// on. The returned function stops it.
+func newTestServer() (*Server, string, func()) {
+	server := New(func(req *http.Request) (string, bool, error) {
+		clientKey := req.Header.Get(clientKeyHeader)
+		return clientKey, clientKey != "", nil
+	}, DefaultErrorWriter)
+	hs := httptest.NewServer(server)
+	return server, "ws" + strings.TrimPrefix(hs.URL, "http"), hs.Close
+}
+
+// connectClient connects clientKey to url, reconnecting until ctx is done. Every connection is
+// allowed unless opts.Auth is set.
+func connectClient(ctx context.Context, url, clientKey string, opts ClientOptions) {
+	opts.Headers = http.Header{clientKeyHeader: {clientKey}}
+	if opts.Auth == nil {
+		opts.Auth = func(string, string) bool { return true }
+	}
+	go func() {
+		for ctx.Err() == nil {
+			ConnectToProxyWithOptions(ctx, url, opts)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+}
+
+// listenEcho returns the address of a local server writing back what it reads.
+func listenEcho(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+// waitFor polls f for up to 5 seconds.
+func waitFor(f func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if f() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// clientSessions returns the sessions of clientKey on server.
+func clientSessions(server *Server, clientKey string) []*Session {
+	server.sessions.Lock()
+	defer server.sessions.Unlock()
+
+	return append([]*Session{}, server.sessions.clients[clientKey]...)
+}
+
+// checkEcho dials address through clientKey and checks that data makes the round trip.
+func checkEcho(t *testing.T, server *Server, clientKey, address string) {
+	conn, err := server.Dial(clientKey, 5*time.Second, "tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msg := strings.Repeat("hello", 5000)
+	go conn.Write([]byte(msg))
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatal("echo mismatch")
+	}
+}
@@ -0,0 +1,256 @@
+// Package httpproxy proxies HTTP through remotedialer agents, either as a forward proxy for
+// tools that support HTTP proxies but not SOCKS, or as a reverse proxy to services reachable by
+// the agents.
+package httpproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/remotedialer"
+	"github.com/sirupsen/logrus"
+)
+
+// Agent is the default request header naming the client key of the agent to dial through.
+var Agent = "X-API-Tunnel-Agent"
+
+type clientKeyCtx struct{}
+
+type callerCtx struct{}
+
+// DialFunc dials address through the agent of clientKey for caller, the authenticated
+// username of the request.
+type DialFunc func(clientKey, caller, network, address string) (net.Conn, error)
+
+// Handler proxies CONNECT requests and plain HTTP requests with an absolute URI. Every request
+// is authenticated with its Proxy-Authorization header, which selects the agent. A hostname of
+// the form host.agent-<client key><Suffix>, or else the Header request header, may select
+// another agent the user is authorized to use.
+type Handler struct {
+	// Dial dials through the agent, Server.DialWithOptions of the remotedialer server by
+	// default.
+	Dial DialFunc
+	// Header names the request header selecting the agent, Agent by default.
+	Header string
+	// Suffix enables selecting the agent by hostname, such as ".tunnel" for
+	// host.agent-foo.tunnel.
+	Suffix string
+	// Authenticate returns the client key for the Proxy-Authorization credentials. It is
+	// required, requests are refused without it.
+	Authenticate func(username, password string) (clientKey string, ok bool)
+	// Authorize reports whether username may use clientKey when it is selected by hostname or
+	// header. If nil, only the client key returned by Authenticate may be selected.
+	Authorize func(username, clientKey string) bool
+	// Next serves requests that are not proxy requests, such as the /connect route of the
+	// remotedialer server. They are answered with 404 if nil.
+	Next http.Handler
+
+	initOnce sync.Once
+	proxy    *httputil.ReverseProxy
+}
+
+// New returns a Handler dialing through server, waiting up to deadline for each connection,
+// and passing other requests to next.
+func New(server *remotedialer.Server, deadline time.Duration, next http.Handler) *Handler {
+	return &Handler{
+		Dial: func(clientKey, caller, network, address string) (net.Conn, error) {
+			return server.DialWithOptions(clientKey, deadline, network, address, remotedialer.DialOptions{
+				Caller: caller,
+			})
+		},
+		Next: next,
+	}
+}
+
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodConnect && !req.URL.IsAbs() {
+		if h.Next == nil {
+			http.NotFound(rw, req)
+			return
+		}
+		h.Next.ServeHTTP(rw, req)
+		return
+	}
+
+	username, clientKey, host, code := h.route(req)
+	switch code {
+	case http.StatusOK:
+	case http.StatusProxyAuthRequired:
+		rw.Header().Set("Proxy-Authenticate", `Basic realm="remotedialer"`)
+		http.Error(rw, "proxy authentication required", code)
+		return
+	default:
+		http.Error(rw, "agent not allowed", code)
+		return
+	}
+
+	if req.Method == http.MethodConnect {
+		h.connect(rw, clientKey, username, host)
+		return
+	}
+
+	h.initOnce.Do(h.init)
+	req.URL.Host = host
+	req.Host = host
+	req.Header.Del(h.header())
+	req.Header.Del("Proxy-Authorization")
+	ctx := context.WithValue(req.Context(), clientKeyCtx{}, clientKey)
+	ctx = context.WithValue(ctx, callerCtx{}, username)
+	h.proxy.ServeHTTP(rw, req.WithContext(ctx))
+}
+
+func (h *Handler) init() {
+	h.proxy = &httputil.ReverseProxy{
+		Director: func(*http.Request) {},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return h.Dial(ctx.Value(clientKeyCtx{}).(string), ctx.Value(callerCtx{}).(string), network, address)
+			},
+			// Pooled connections are keyed by address only, they would be shared by agents
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+func (h *Handler) header() string {
+	if h.Header == "" {
+		return Agent
+	}
+	return h.Header
+}
+
+// route authenticates req and returns the username, the client key it selects and the
+// host:port to dial, or the status code refusing it.
+func (h *Handler) route(req *http.Request) (string, string, string, int) {
+	username, password, ok := proxyAuth(req)
+	if !ok {
+		return "", "", "", http.StatusProxyAuthRequired
+	}
+	clientKey, ok := h.authenticate(username, password)
+	if !ok {
+		return "", "", "", http.StatusProxyAuthRequired
+	}
+
+	host := req.URL.Host
+	if req.Method == http.MethodConnect && host == "" {
+		host = req.Host
+	}
+
+	selected, target, ok := h.routeSuffix(host)
+	if ok {
+		host = target
+	} else {
+		selected = req.Header.Get(h.header())
+	}
+	if selected != "" && selected != clientKey {
+		if !h.authorize(username, selected) {
+			logrus.Infof("Proxy user %s is not allowed to use agent [%s]", username, selected)
+			return "", "", "", http.StatusForbidden
+		}
+		clientKey = selected
+	}
+	return username, clientKey, host, http.StatusOK
+}
+
+// routeSuffix splits host.agent-<client key><Suffix>:port into the client key and host:port.
+func (h *Handler) routeSuffix(hostport string) (string, string, bool) {
+	if h.Suffix == "" {
+		return "", "", false
+	}
+
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, ""
+	}
+	if !strings.HasSuffix(host, h.Suffix) {
+		return "", "", false
+	}
+	host = strings.TrimSuffix(host, h.Suffix)
+
+	i := strings.LastIndex(host, ".agent-")
+	if i <= 0 {
+		return "", "", false
+	}
+	clientKey := host[i+len(".agent-"):]
+	host = host[:i]
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	return clientKey, host, clientKey != ""
+}
+
+func (h *Handler) authenticate(username, password string) (string, bool) {
+	if h.Authenticate == nil {
+		logrus.Error("httpproxy: Authenticate is required")
+		return "", false
+	}
+	return h.Authenticate(username, password)
+}
+
+func (h *Handler) authorize(username, clientKey string) bool {
+	return h.Authorize != nil && h.Authorize(username, clientKey)
+}
+
+func proxyAuth(req *http.Request) (string, string, bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func (h *Handler) connect(rw http.ResponseWriter, clientKey, caller, address string) {
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, "CONNECT is not supported over this protocol", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	target, err := h.Dial(clientKey, caller, "tcp", address)
+	if err != nil {
+		logrus.Debugf("CONNECT to %s through [%s] failed: %v", address, clientKey, err)
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		logrus.Errorf("Failed to hijack CONNECT to %s: %v", address, err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// buf may hold data the client sent right after the request
+		io.Copy(target, buf)
+		target.Close()
+	}()
+
+	io.Copy(conn, target)
+	conn.Close()
+	wg.Wait()
+}
@@ -0,0 +1,266 @@
+package httpproxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+type dialed struct {
+	clientKey, caller, network, address string
+}
+
+// newTestHandler returns a Handler authenticating alice with password as agent "a", letting
+// her also use agent "b", and dialing directly. The returned function lists its dials.
+func newTestHandler() (*Handler, func() []dialed) {
+	var (
+		lock  sync.Mutex
+		dials []dialed
+	)
+	h := &Handler{
+		Dial: func(clientKey, caller, network, address string) (net.Conn, error) {
+			lock.Lock()
+			dials = append(dials, dialed{clientKey, caller, network, address})
+			lock.Unlock()
+			return net.Dial(network, address)
+		},
+		Suffix: ".tunnel",
+		Authenticate: func(username, password string) (string, bool) {
+			return "a", username == "alice" && password == "password"
+		},
+		Authorize: func(username, clientKey string) bool {
+			return username == "alice" && clientKey == "b"
+		},
+	}
+	return h, func() []dialed {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]dialed{}, dials...)
+	}
+}
+
+// proxyClient returns a client using proxy with the credentials of user, if set.
+func proxyClient(proxy string, user *url.Userinfo) *http.Client {
+	proxyURL, _ := url.Parse(proxy)
+	proxyURL.User = user
+	return &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   5 * time.Second,
+	}
+}
+
+func TestProxyAuthentication(t *testing.T) {
+	h, dials := newTestHandler()
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	for _, user := range []*url.Userinfo{nil, url.UserPassword("alice", "wrong")} {
+		resp, err := proxyClient(proxy.URL, user).Get("http://example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Fatalf("%v: expected %d, got %d", user, http.StatusProxyAuthRequired, resp.StatusCode)
+		}
+		if resp.Header.Get("Proxy-Authenticate") == "" {
+			t.Fatalf("%v: no challenge", user)
+		}
+	}
+
+	// Authenticate is required
+	h.Authenticate = nil
+	resp, err := proxyClient(proxy.URL, url.UserPassword("alice", "password")).Get("http://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("expected %d without Authenticate, got %d", http.StatusProxyAuthRequired, resp.StatusCode)
+	}
+
+	if len(dials()) != 0 {
+		t.Fatal("dialed without authentication")
+	}
+}
+
+func TestProxyForwardsRequest(t *testing.T) {
+	var header http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header = req.Header
+		io.WriteString(rw, "hello")
+	}))
+	defer upstream.Close()
+
+	h, dials := newTestHandler()
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+	req.Header.Set(Agent, "b")
+	resp, err := proxyClient(proxy.URL, url.UserPassword("alice", "password")).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Fatalf("unexpected response %d: %s", resp.StatusCode, body)
+	}
+
+	// The credentials and the agent selection stay with the proxy
+	if header.Get("Proxy-Authorization") != "" || header.Get(Agent) != "" {
+		t.Fatalf("proxy headers forwarded upstream: %v", header)
+	}
+	expected := dialed{clientKey: "b", caller: "alice", network: "tcp", address: upstream.Listener.Addr().String()}
+	if d := dials(); len(d) != 1 || d[0] != expected {
+		t.Fatalf("expected dial %+v, got %+v", expected, d)
+	}
+}
+
+func TestProxyAuthorization(t *testing.T) {
+	h, dials := newTestHandler()
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set(Agent, "c")
+	resp, err := proxyClient(proxy.URL, url.UserPassword("alice", "password")).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+
+	// Without Authorize only the authenticated agent may be selected
+	h.Authorize = nil
+	resp, err = proxyClient(proxy.URL, url.UserPassword("alice", "password")).Get("http://example.agent-b.tunnel/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected %d without Authorize, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+
+	if len(dials()) != 0 {
+		t.Fatal("dialed an agent that is not allowed")
+	}
+}
+
+func TestRouteSuffix(t *testing.T) {
+	h := &Handler{Suffix: ".tunnel"}
+	tests := []struct {
+		host      string
+		clientKey string
+		target    string
+		ok        bool
+	}{
+		{"db.agent-foo.tunnel:5432", "foo", "db:5432", true},
+		{"db.internal.agent-foo.tunnel", "foo", "db.internal", true},
+		{"db.agent-foo.bar.tunnel:80", "foo.bar", "db:80", true},
+		{"agent-foo.tunnel:80", "", "", false},
+		{"db.agent-.tunnel:80", "", "", false},
+		{"db.agent-foo.example.com:80", "", "", false},
+		{"db:80", "", "", false},
+	}
+	for _, test := range tests {
+		clientKey, target, ok := h.routeSuffix(test.host)
+		if ok != test.ok || (ok && (clientKey != test.clientKey || target != test.target)) {
+			t.Errorf("%s: got %q, %q, %v", test.host, clientKey, target, ok)
+		}
+	}
+
+	if _, _, ok := (&Handler{}).routeSuffix("db.agent-foo.tunnel:80"); ok {
+		t.Fatal("routed by hostname without a Suffix")
+	}
+}
+
+func TestConnect(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	h, dials := newTestHandler()
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	target := "127.0.0.1.agent-b.tunnel:" + port
+	req, _ := http.NewRequest(http.MethodConnect, "", nil)
+	req.Host = target
+	req.SetBasicAuth("alice", "password")
+	req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+	delete(req.Header, "Authorization")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed with %d", resp.StatusCode)
+	}
+
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("echo mismatch", err)
+	}
+
+	expected := dialed{clientKey: "b", caller: "alice", network: "tcp", address: echo.Addr().String()}
+	if d := dials(); len(d) != 1 || d[0] != expected {
+		t.Fatalf("expected dial %+v, got %+v", expected, d)
+	}
+}
+
+func TestNext(t *testing.T) {
+	h, _ := newTestHandler()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/connect", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected %d without Next, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	h.Next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusTeapot)
+	})
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/connect", nil))
+	if rec.Code != http.StatusTeapot {
+		t.Fatalf("request not passed to Next, got %d", rec.Code)
+	}
+}
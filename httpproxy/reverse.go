@@ -0,0 +1,242 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/remotedialer"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrUnauthorized is returned by a RouteFunc refusing the credentials of a request, which is
+// answered with 401 and a Basic challenge.
+var ErrUnauthorized = errors.New("unauthorized")
+
+type routeCtx struct{}
+
+type proxyRoute struct {
+	clientKey string
+	target    *url.URL
+}
+
+// RouteFunc returns the client key of the agent a request is proxied through and the URL it is
+// sent to. Connections are audited as dialed by the caller set with SetCaller, if any.
+type RouteFunc func(req *http.Request) (clientKey string, target *url.URL, err error)
+
+// PathRoute routes requests for <prefix>/<client key>/<scheme>/<host>/<path> to
+// <scheme>://<host>/<path>, keeping the query.
+func PathRoute(prefix string) RouteFunc {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return func(req *http.Request) (string, *url.URL, error) {
+		if !strings.HasPrefix(req.URL.Path, prefix+"/") {
+			return "", nil, fmt.Errorf("path %s is not under %s", req.URL.Path, prefix)
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, prefix+"/"), "/", 4)
+		if len(parts) < 3 || parts[0] == "" || parts[2] == "" {
+			return "", nil, fmt.Errorf("path %s is not %s/<client key>/<scheme>/<host>/<path>", req.URL.Path, prefix)
+		}
+		if parts[1] != "http" && parts[1] != "https" {
+			return "", nil, fmt.Errorf("unsupported scheme %s", parts[1])
+		}
+
+		target := &url.URL{
+			Scheme:   parts[1],
+			Host:     parts[2],
+			Path:     "/",
+			RawQuery: req.URL.RawQuery,
+		}
+		if len(parts) == 4 {
+			target.Path += parts[3]
+		}
+		return parts[0], target, nil
+	}
+}
+
+// AuthRoute wraps route, requiring Basic credentials that authorize allows to use the client
+// key of the request. The username is the caller of the request. The Authorization header is not
+// proxied.
+func AuthRoute(route RouteFunc, authorize func(username, password, clientKey string) bool) RouteFunc {
+	return func(req *http.Request) (string, *url.URL, error) {
+		clientKey, target, err := route(req)
+		if err != nil {
+			return "", nil, err
+		}
+
+		username, password, ok := req.BasicAuth()
+		if !ok || !authorize(username, password, clientKey) {
+			return "", nil, ErrUnauthorized
+		}
+		req.Header.Del("Authorization")
+		SetCaller(req, username)
+		return clientKey, target, nil
+	}
+}
+
+// SetCaller records caller, who connections proxying req are dialed for, in the context of req.
+func SetCaller(req *http.Request, caller string) {
+	*req = *req.WithContext(context.WithValue(req.Context(), callerCtx{}, caller))
+}
+
+func callerOf(ctx context.Context) string {
+	caller, _ := ctx.Value(callerCtx{}).(string)
+	return caller
+}
+
+// ReverseProxy proxies requests to services reachable by agents. Requests of any method, their
+// bodies and trailers are streamed both ways, and websocket upgrades are supported. https
+// targets are reached over HTTP/2 when they negotiate it, http targets over HTTP/1.1. Each client
+// key and caller has its own pool of connections, dropped when a session of the client key is
+// removed.
+type ReverseProxy struct {
+	// Route selects the agent and target of a request.
+	Route RouteFunc
+	// ErrorWriter writes routing and proxying errors, remotedialer.DefaultErrorWriter by default.
+	ErrorWriter remotedialer.ErrorWriter
+	// TLSClientConfig is used to connect to https targets.
+	TLSClientConfig *tls.Config
+
+	proxy      *httputil.ReverseProxy
+	transports *transportPool
+}
+
+// NewReverseProxy returns a ReverseProxy dialing through server, waiting up to deadline for
+// each connection.
+func NewReverseProxy(server *remotedialer.Server, deadline time.Duration, route RouteFunc) *ReverseProxy {
+	p := &ReverseProxy{
+		Route: route,
+	}
+	p.transports = &transportPool{
+		dial: func(clientKey, caller, network, address string) (net.Conn, error) {
+			return server.DialWithOptions(clientKey, deadline, network, address, remotedialer.DialOptions{
+				Caller: caller,
+			})
+		},
+		hasSession: server.HasSession,
+		tlsConfig:  func() *tls.Config { return p.TLSClientConfig },
+		transports: map[transportKey]*http.Transport{},
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Director:      director,
+		Transport:     p.transports,
+		FlushInterval: -1,
+		ErrorHandler: func(rw http.ResponseWriter, req *http.Request, err error) {
+			r := req.Context().Value(routeCtx{}).(proxyRoute)
+			logrus.Errorf("Failed to proxy %s %s through [%s]: %v", req.Method, r.target, r.clientKey, err)
+			p.writeError(rw, req, http.StatusBadGateway, err)
+		},
+	}
+	server.OnSessionRemoved(p.transports.evict)
+	return p
+}
+
+func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	clientKey, target, err := p.Route(req)
+	if err == ErrUnauthorized {
+		rw.Header().Set("WWW-Authenticate", `Basic realm="remotedialer"`)
+		p.writeError(rw, req, http.StatusUnauthorized, err)
+		return
+	} else if err != nil {
+		p.writeError(rw, req, http.StatusNotFound, err)
+		return
+	}
+
+	ctx := context.WithValue(req.Context(), routeCtx{}, proxyRoute{
+		clientKey: clientKey,
+		target:    target,
+	})
+	p.proxy.ServeHTTP(rw, req.WithContext(ctx))
+}
+
+func (p *ReverseProxy) writeError(rw http.ResponseWriter, req *http.Request, code int, err error) {
+	if p.ErrorWriter == nil {
+		remotedialer.DefaultErrorWriter(rw, req, code, err)
+		return
+	}
+	p.ErrorWriter(rw, req, code, err)
+}
+
+func director(req *http.Request) {
+	r := req.Context().Value(routeCtx{}).(proxyRoute)
+	req.URL.Scheme = r.target.Scheme
+	req.URL.Host = r.target.Host
+	req.URL.Path = r.target.Path
+	req.URL.RawPath = r.target.RawPath
+	req.URL.RawQuery = r.target.RawQuery
+	req.Host = r.target.Host
+}
+
+// transportPool keeps a Transport per client key and caller, so pooled connections through one
+// agent are never used for another, nor audited as dialed by another caller.
+type transportPool struct {
+	sync.Mutex
+
+	dial       func(clientKey, caller, network, address string) (net.Conn, error)
+	hasSession func(clientKey string) bool
+	tlsConfig  func() *tls.Config
+	transports map[transportKey]*http.Transport
+}
+
+type transportKey struct {
+	clientKey string
+	caller    string
+}
+
+func (t *transportPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	r, ok := req.Context().Value(routeCtx{}).(proxyRoute)
+	if !ok {
+		return nil, errors.New("request has no route")
+	}
+	resp, err := t.get(transportKey{r.clientKey, callerOf(req.Context())}).RoundTrip(req)
+	if err != nil && !t.hasSession(r.clientKey) {
+		// Don't keep transports for client keys that never connect
+		t.evict(r.clientKey)
+	}
+	return resp, err
+}
+
+func (t *transportPool) get(key transportKey) *http.Transport {
+	t.Lock()
+	defer t.Unlock()
+
+	transport := t.transports[key]
+	if transport == nil {
+		transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return t.dial(key.clientKey, key.caller, network, address)
+			},
+			TLSClientConfig:     t.tlsConfig(),
+			ForceAttemptHTTP2:   true,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		}
+		t.transports[key] = transport
+	}
+	return transport
+}
+
+// evict drops the Transports of clientKey, their connections went through a removed session.
+func (t *transportPool) evict(clientKey string) {
+	var evicted []*http.Transport
+	t.Lock()
+	for key, transport := range t.transports {
+		if key.clientKey == clientKey {
+			evicted = append(evicted, transport)
+			delete(t.transports, key)
+		}
+	}
+	t.Unlock()
+
+	for _, transport := range evicted {
+		transport.CloseIdleConnections()
+	}
+}
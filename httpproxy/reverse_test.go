@@ -0,0 +1,241 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rancher/remotedialer"
+)
+
+type auditRecorder struct {
+	sync.Mutex
+	events []remotedialer.AuditEvent
+}
+
+func (r *auditRecorder) Audit(event remotedialer.AuditEvent) {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, event)
+}
+
+// callers returns the callers of the connections dialed so far.
+func (r *auditRecorder) callers() []string {
+	r.Lock()
+	defer r.Unlock()
+
+	var callers []string
+	for _, event := range r.events {
+		if event.Type == remotedialer.AuditConnect {
+			callers = append(callers, event.Caller)
+		}
+	}
+	return callers
+}
+
+// newReverseTest serves a ReverseProxy routing with route under /client/, connects the agent
+// "foo" and returns the URL of the server.
+func newReverseTest(t *testing.T, ctx context.Context, route RouteFunc) (*ReverseProxy, *auditRecorder, string, func()) {
+	server := remotedialer.New(func(req *http.Request) (string, bool, error) {
+		clientKey := req.Header.Get("X-Test-Client")
+		return clientKey, clientKey != "", nil
+	}, remotedialer.DefaultErrorWriter)
+	recorder := &auditRecorder{}
+	server.Audit = recorder
+
+	proxy := NewReverseProxy(server, 5*time.Second, route)
+	mux := http.NewServeMux()
+	mux.Handle("/connect", server)
+	mux.Handle("/client/", proxy)
+	hs := httptest.NewServer(mux)
+
+	go remotedialer.ConnectToProxyWithOptions(ctx, "ws"+strings.TrimPrefix(hs.URL, "http")+"/connect", remotedialer.ClientOptions{
+		Headers: http.Header{"X-Test-Client": {"foo"}},
+		Auth:    func(string, string) bool { return true },
+	})
+	for deadline := time.Now().Add(5 * time.Second); !server.HasSession("foo"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("agent did not connect")
+		}
+	}
+	return proxy, recorder, hs.URL, hs.Close
+}
+
+func TestPathRoute(t *testing.T) {
+	route := PathRoute("/client/")
+	tests := []struct {
+		path      string
+		clientKey string
+		target    string
+	}{
+		{"/client/foo/http/example.com/a/b?x=1", "foo", "http://example.com/a/b?x=1"},
+		{"/client/foo/https/example.com:8443", "foo", "https://example.com:8443/"},
+		{"/client/foo/ftp/example.com/", "", ""},
+		{"/client//http/example.com/", "", ""},
+		{"/client/foo/http/", "", ""},
+		{"/other/foo/http/example.com/", "", ""},
+	}
+	for _, test := range tests {
+		clientKey, target, err := route(httptest.NewRequest(http.MethodGet, test.path, nil))
+		if test.target == "" {
+			if err == nil {
+				t.Errorf("%s: routed to %s", test.path, target)
+			}
+			continue
+		}
+		if err != nil || clientKey != test.clientKey || target.String() != test.target {
+			t.Errorf("%s: got %q, %v, %v", test.path, clientKey, target, err)
+		}
+	}
+}
+
+func TestReverseProxy(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/ws" {
+			conn, err := upgrader.Upgrade(rw, req, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			messageType, data, _ := conn.ReadMessage()
+			conn.WriteMessage(messageType, append(data, '!'))
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		rw.Header().Set("Trailer", "X-Trailer")
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(rw, "%s %s %s %s %s %s", req.Method, req.Host, req.URL.Path, req.URL.RawQuery, body, req.Header.Get("Authorization"))
+		rw.Header().Set("X-Trailer", "done")
+	}))
+	defer target.Close()
+	host := strings.TrimPrefix(target.URL, "http://")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxy, recorder, base, closeServer := newReverseTest(t, ctx, AuthRoute(PathRoute("/client"), func(username, password, clientKey string) bool {
+		return username == "alice" && password == "password" && clientKey == "foo"
+	}))
+	defer closeServer()
+
+	req, _ := http.NewRequest(http.MethodPut, base+"/client/foo/http/"+host+"/a/b?x=1", strings.NewReader("data"))
+	req.SetBasicAuth("alice", "password")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	// The credentials of the proxy aren't sent to the target
+	if expected := "PUT " + host + " /a/b x=1 data "; resp.StatusCode != http.StatusCreated || string(body) != expected {
+		t.Fatalf("expected %d %q, got %d %q", http.StatusCreated, expected, resp.StatusCode, body)
+	}
+	if resp.Trailer.Get("X-Trailer") != "done" {
+		t.Fatal("trailer not proxied")
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", req.Header.Get("Authorization"))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/client/foo/http/"+host+"/ws", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "hello!" {
+		t.Fatal("websocket echo mismatch", err)
+	}
+
+	// Connections are dialed for the authenticated user
+	callers := recorder.callers()
+	if len(callers) == 0 {
+		t.Fatal("no connection audited")
+	}
+	for _, caller := range callers {
+		if caller != "alice" {
+			t.Fatalf("expected connections dialed for alice, got %v", callers)
+		}
+	}
+
+	// Transports are dropped with the session of the agent
+	cancel()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		proxy.transports.Lock()
+		transports := len(proxy.transports.transports)
+		proxy.transports.Unlock()
+		if transports == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("transports not evicted")
+		}
+	}
+}
+
+func TestReverseProxyErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, base, closeServer := newReverseTest(t, ctx, AuthRoute(PathRoute("/client"), func(username, password, clientKey string) bool {
+		return username == "alice" && password == "password"
+	}))
+	defer closeServer()
+
+	get := func(path string, user *url.Userinfo) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, base+path, nil)
+		if user != nil {
+			password, _ := user.Password()
+			req.SetBasicAuth(user.Username(), password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get("/client/foo/http/example.com/", url.UserPassword("alice", "wrong"))
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("expected %d with a challenge, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if resp := get("/client/foo/ftp/example.com/", url.UserPassword("alice", "password")); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected %d for an invalid route, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+	if resp := get("/client/bar/http/example.com/", url.UserPassword("alice", "password")); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected %d for an agent that is not connected, got %d", http.StatusBadGateway, resp.StatusCode)
+	}
+}
+
+func TestReverseProxyHTTP2OverTLS(t *testing.T) {
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.Proto))
+	}))
+	target.EnableHTTP2 = true
+	target.StartTLS()
+	defer target.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxy, _, base, closeServer := newReverseTest(t, ctx, PathRoute("/client"))
+	defer closeServer()
+	proxy.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+
+	resp, err := http.Get(base + "/client/foo/https/" + strings.TrimPrefix(target.URL, "https://") + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/2.0" {
+		t.Fatalf("expected HTTP/2.0, got %s", body)
+	}
+}
@@ -0,0 +1,227 @@
+package remotedialer
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SessionInfo describes a websocket session connected to the server.
+type SessionInfo struct {
+	ClientKey   string    `json:"clientKey"`
+	SessionKey  int64     `json:"sessionKey"`
+	Peer        bool      `json:"peer"`
+	Connections int       `json:"connections"`
+	RateLimit   RateLimit `json:"rateLimit"`
+	// TransmitRate and ReceiveRate are the bytes per second sent to and read from the tunneled
+	// connections of the session during the last second.
+	TransmitRate int64 `json:"transmitRate"`
+	ReceiveRate  int64 `json:"receiveRate"`
+	// RTT is the smoothed round trip time of the websocket and Jitter its mean deviation.
+	RTT    time.Duration `json:"rtt"`
+	Jitter time.Duration `json:"jitter"`
+}
+
+// ConnectionInfo describes a tunneled connection of a session.
+type ConnectionInfo struct {
+	ID      int64     `json:"id"`
+	Network string    `json:"network"`
+	Address string    `json:"address"`
+	Created time.Time `json:"created"`
+	// Transmitted and Received are the bytes written to and read from the connection.
+	Transmitted int64 `json:"transmitted"`
+	Received    int64 `json:"received"`
+}
+
+// PeerStatus describes a peer of the server.
+type PeerStatus struct {
+	ID string `json:"id"`
+	// URL is where the server connects to the peer, empty if it was not added with AddPeer.
+	URL string `json:"url,omitempty"`
+	// Sessions are the session keys of the websockets the peer connected to the server.
+	Sessions []int64 `json:"sessions"`
+	// RemoteClientKeys maps the client keys reachable through the peer to the fewest hops.
+	RemoteClientKeys map[string]int `json:"remoteClientKeys"`
+}
+
+var errClosedByAdmin = errors.New("closed by administrator")
+
+// Sessions returns the sessions of clients and peers connected to the server.
+func (s *Server) Sessions() []SessionInfo {
+	return s.sessions.inventory()
+}
+
+func (sm *sessionManager) inventory() []SessionInfo {
+	sm.Lock()
+	defer sm.Unlock()
+
+	var result []SessionInfo
+	for i, store := range []map[string][]*Session{sm.clients, sm.peers} {
+		for _, sessions := range store {
+			for _, session := range sessions {
+				result = append(result, session.info(i == 1))
+			}
+		}
+	}
+	return result
+}
+
+func (s *Session) info(peer bool) SessionInfo {
+	s.Lock()
+	connections := len(s.conns)
+	s.Unlock()
+
+	info := SessionInfo{
+		ClientKey:    s.clientKey,
+		SessionKey:   s.sessionKey,
+		Peer:         peer,
+		Connections:  connections,
+		TransmitRate: s.transmitted.rate(),
+		ReceiveRate:  s.received.rate(),
+	}
+	info.RTT, info.Jitter = s.RTT()
+	if s.limiter != nil {
+		info.RateLimit = s.limiter.get()
+	}
+	return info
+}
+
+// Connections returns the tunneled connections of the session, oldest first.
+func (s *Session) Connections() []ConnectionInfo {
+	s.Lock()
+	conns := make([]*connection, 0, len(s.conns))
+	for _, conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.Unlock()
+
+	result := make([]ConnectionInfo, 0, len(conns))
+	for _, conn := range conns {
+		result = append(result, ConnectionInfo{
+			ID:          conn.connID,
+			Network:     conn.addr.Network(),
+			Address:     conn.addr.String(),
+			Created:     conn.created,
+			Transmitted: atomic.LoadInt64(&conn.transmitted),
+			Received:    atomic.LoadInt64(&conn.received),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// CloseConnection closes the tunneled connection connID of the session, returning false if
+// there is no such connection.
+func (s *Session) CloseConnection(connID int64) bool {
+	s.Lock()
+	_, ok := s.conns[connID]
+	s.Unlock()
+	if ok {
+		s.closeConnection(connID, errClosedByAdmin)
+	}
+	return ok
+}
+
+// SessionConnections returns the tunneled connections of the client or peer session with
+// sessionKey, or false if there is no such session.
+func (s *Server) SessionConnections(sessionKey int64) ([]ConnectionInfo, bool) {
+	session := s.sessions.get(sessionKey)
+	if session == nil {
+		return nil, false
+	}
+	return session.Connections(), true
+}
+
+// CloseSession disconnects the client or peer session with sessionKey, closing its tunneled
+// connections without waiting for resumption. It returns false if there is no such session.
+func (s *Server) CloseSession(sessionKey int64) bool {
+	session := s.sessions.get(sessionKey)
+	if session == nil {
+		return false
+	}
+	logrus.Infof("Closing backend connection [%s] %d", session.clientKey, session.sessionKey)
+	s.sessions.remove(session)
+	session.getConn().conn.Close()
+	return true
+}
+
+// CloseConnection closes the tunneled connection connID of the session with sessionKey,
+// returning false if there is no such connection.
+func (s *Server) CloseConnection(sessionKey, connID int64) bool {
+	session := s.sessions.get(sessionKey)
+	if session == nil {
+		return false
+	}
+
+	return session.CloseConnection(connID)
+}
+
+// Peers returns the peers added with AddPeer and those connected to the server, sorted by ID.
+func (s *Server) Peers() []PeerStatus {
+	peers := map[string]*PeerStatus{}
+	get := func(id string) *PeerStatus {
+		if peers[id] == nil {
+			peers[id] = &PeerStatus{
+				ID:               id,
+				Sessions:         []int64{},
+				RemoteClientKeys: map[string]int{},
+			}
+		}
+		return peers[id]
+	}
+
+	s.peerLock.Lock()
+	for id, p := range s.peers {
+		get(id).URL = p.url
+	}
+	s.peerLock.Unlock()
+
+	s.sessions.Lock()
+	for id, sessions := range s.sessions.peers {
+		status := get(id)
+		for _, session := range sessions {
+			status.Sessions = append(status.Sessions, session.sessionKey)
+
+			session.Lock()
+			for clientKey, routes := range session.remoteClientKeys {
+				for _, r := range routes {
+					if hops, ok := status.RemoteClientKeys[clientKey]; !ok || r.hops < hops {
+						status.RemoteClientKeys[clientKey] = r.hops
+					}
+				}
+			}
+			session.Unlock()
+		}
+	}
+	s.sessions.Unlock()
+
+	result := make([]PeerStatus, 0, len(peers))
+	for _, status := range peers {
+		result = append(result, *status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+func (sm *sessionManager) get(sessionKey int64) *Session {
+	sm.Lock()
+	defer sm.Unlock()
+
+	for _, store := range []map[string][]*Session{sm.clients, sm.peers} {
+		for _, sessions := range store {
+			for _, session := range sessions {
+				if session.sessionKey == sessionKey {
+					return session
+				}
+			}
+		}
+	}
+	return nil
+}
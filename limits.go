@@ -0,0 +1,152 @@
+package remotedialer
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/rancher/remotedialer/metrics"
+)
+
+var (
+	ErrTooManySessions     = errors.New("too many sessions for client")
+	ErrTooManyConnections  = errors.New("too many connections for session")
+	ErrTooManyPendingDials = errors.New("too many pending dials")
+	ErrConnectRateExceeded = errors.New("connect rate exceeded")
+
+	// limitErrors lets the side that sent a Connect tell which limit or policy refused it
+	limitErrors = map[string]error{
+		ErrConnectNotAllowed.Error():   ErrConnectNotAllowed,
+		ErrTooManySessions.Error():     ErrTooManySessions,
+		ErrTooManyConnections.Error():  ErrTooManyConnections,
+		ErrTooManyPendingDials.Error(): ErrTooManyPendingDials,
+		ErrConnectRateExceeded.Error(): ErrConnectRateExceeded,
+	}
+)
+
+// Limits protects each end of a session from the other. Zero values are unlimited. On the
+// server they apply to client sessions, not to peers.
+type Limits struct {
+	// MaxSessionsPerKey is the most websockets a client key may have connected to the server.
+	MaxSessionsPerKey int `json:"maxSessionsPerKey,omitempty" yaml:"maxSessionsPerKey,omitempty"`
+	// MaxConnectionsPerSession is the most tunneled connections a session may hold.
+	MaxConnectionsPerSession int `json:"maxConnectionsPerSession,omitempty" yaml:"maxConnectionsPerSession,omitempty"`
+	// MaxPendingDials is the most Connects from the remote side being dialed at once.
+	MaxPendingDials int `json:"maxPendingDials,omitempty" yaml:"maxPendingDials,omitempty"`
+	// ConnectRate is the most connections opened per second, allowing bursts of ConnectBurst
+	// which defaults to ConnectRate.
+	ConnectRate  int `json:"connectRate,omitempty" yaml:"connectRate,omitempty"`
+	ConnectBurst int `json:"connectBurst,omitempty" yaml:"connectBurst,omitempty"`
+}
+
+func (s *Session) setLimits(limits Limits) {
+	s.limits = limits
+	burst := limits.ConnectBurst
+	if burst <= 0 {
+		burst = limits.ConnectRate
+	}
+	s.connectRate.set(int64(limits.ConnectRate), int64(burst))
+}
+
+// allowConnection returns an error if the session may not open another connection. Connects
+// from the remote side also count as pending dials until dialDone is called.
+func (s *Session) allowConnection(remote bool) error {
+	err := s.checkLimits(remote)
+	if err != nil {
+		metrics.IncSMTotalLimitRejected(s.clientKey, err.Error())
+	}
+	return err
+}
+
+func (s *Session) checkLimits(remote bool) error {
+	if max := s.limits.MaxConnectionsPerSession; max > 0 {
+		s.Lock()
+		connections := len(s.conns)
+		s.Unlock()
+		if connections >= max {
+			return ErrTooManyConnections
+		}
+	}
+
+	if remote {
+		pending := atomic.AddInt32(&s.pendingDials, 1)
+		if max := s.limits.MaxPendingDials; max > 0 && int(pending) > max {
+			s.dialDone()
+			return ErrTooManyPendingDials
+		}
+	}
+
+	if !s.connectRate.allow(1) {
+		if remote {
+			s.dialDone()
+		}
+		return ErrConnectRateExceeded
+	}
+	return nil
+}
+
+func (s *Session) dialDone() {
+	atomic.AddInt32(&s.pendingDials, -1)
+}
+
+// allow takes n tokens if they are available.
+func (b *tokenBucket) allow(n int) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.rate <= 0 {
+		return true
+	}
+
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// allowSession reports whether clientKey may connect another session while replacing some of
+// its existing ones, writing the error if not. If allowed, the session is reserved until it is
+// added, or unreserve is called.
+func (s *Server) allowSession(rw http.ResponseWriter, req *http.Request, clientKey string, replacing int) bool {
+	if s.sessions.reserve(clientKey, s.Limits.MaxSessionsPerKey, replacing) {
+		return true
+	}
+
+	metrics.IncSMTotalLimitRejected(clientKey, ErrTooManySessions.Error())
+	s.errorWriter(rw, req, http.StatusTooManyRequests, ErrTooManySessions)
+	return false
+}
+
+// reserve counts a session of clientKey about to be added, if it has less than max sessions,
+// ignoring replacing ones, counting the reserved ones. A max of zero sets no limit.
+func (sm *sessionManager) reserve(clientKey string, max, replacing int) bool {
+	sm.Lock()
+	defer sm.Unlock()
+
+	if max > 0 && len(sm.clients[clientKey])+sm.reserved[clientKey]-replacing >= max {
+		return false
+	}
+	sm.reserved[clientKey]++
+	return true
+}
+
+// release gives back a reservation of clientKey whose session could not be added.
+func (sm *sessionManager) release(clientKey string) {
+	sm.Lock()
+	defer sm.Unlock()
+
+	sm.unreserve(clientKey)
+}
+
+// unreserve gives back a reservation of clientKey. It is called with the sessionManager
+// locked.
+func (sm *sessionManager) unreserve(clientKey string) {
+	if sm.reserved[clientKey] <= 1 {
+		delete(sm.reserved, clientKey)
+	} else {
+		sm.reserved[clientKey]--
+	}
+}
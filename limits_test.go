@@ -0,0 +1,151 @@
+package remotedialer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSessionReservation(t *testing.T) {
+	sm := newSessionManager()
+	if !sm.reserve("foo", 2, 0) || !sm.reserve("foo", 2, 0) {
+		t.Fatal("reservation under the limit refused")
+	}
+	if sm.reserve("foo", 2, 0) {
+		t.Fatal("reservation over the limit accepted")
+	}
+	// Sessions being replaced don't count
+	if !sm.reserve("foo", 2, 1) {
+		t.Fatal("reservation replacing a session refused")
+	}
+	if !sm.reserve("bar", 0, 0) {
+		t.Fatal("reservation without a limit refused")
+	}
+
+	sm.release("foo")
+	sm.release("foo")
+	if sm.reserved["foo"] != 1 {
+		t.Fatalf("expected 1 reservation left, got %d", sm.reserved["foo"])
+	}
+	sm.release("foo")
+	if _, ok := sm.reserved["foo"]; ok {
+		t.Fatal("released reservations not removed")
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	s := &Session{conns: map[int64]*connection{}}
+	s.setLimits(Limits{MaxConnectionsPerSession: 2})
+	s.conns[1] = &connection{}
+	if err := s.allowConnection(false); err != nil {
+		t.Fatal(err)
+	}
+	s.conns[2] = &connection{}
+	if err := s.allowConnection(false); err != ErrTooManyConnections {
+		t.Fatalf("expected %v, got %v", ErrTooManyConnections, err)
+	}
+
+	s = &Session{}
+	s.setLimits(Limits{MaxPendingDials: 2})
+	for i := 0; i < 2; i++ {
+		if err := s.allowConnection(true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.allowConnection(true); err != ErrTooManyPendingDials {
+		t.Fatalf("expected %v, got %v", ErrTooManyPendingDials, err)
+	}
+	// Local dials aren't pending
+	if err := s.allowConnection(false); err != nil {
+		t.Fatal(err)
+	}
+	s.dialDone()
+	if err := s.allowConnection(true); err != nil {
+		t.Fatal("pending dial not released", err)
+	}
+	if s.pendingDials != 2 {
+		t.Fatalf("expected 2 pending dials, got %d", s.pendingDials)
+	}
+}
+
+func TestConnectRate(t *testing.T) {
+	s := &Session{}
+	s.setLimits(Limits{ConnectRate: 1, ConnectBurst: 3})
+	for i := 0; i < 3; i++ {
+		if err := s.allowConnection(false); err != nil {
+			t.Fatalf("connection %d of the burst refused: %v", i, err)
+		}
+	}
+	if err := s.allowConnection(false); err != ErrConnectRateExceeded {
+		t.Fatalf("expected %v, got %v", ErrConnectRateExceeded, err)
+	}
+
+	// A refused remote Connect isn't left pending
+	if err := s.allowConnection(true); err != ErrConnectRateExceeded || s.pendingDials != 0 {
+		t.Fatalf("expected %v without pending dials, got %v and %d", ErrConnectRateExceeded, err, s.pendingDials)
+	}
+
+	// The burst defaults to the rate
+	s = &Session{}
+	s.setLimits(Limits{ConnectRate: 2})
+	if s.allowConnection(false) != nil || s.allowConnection(false) != nil || s.allowConnection(false) == nil {
+		t.Fatal("expected a burst of 2")
+	}
+}
+
+func TestLimitErrorsOverTheWire(t *testing.T) {
+	for _, expected := range limitErrors {
+		msg, err := newServerMessage(bytes.NewReader(newErrorMessage(1, expected).Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := msg.Err(); err != expected {
+			t.Errorf("expected %v, got %v", expected, err)
+		}
+	}
+}
+
+func TestLimitsEnforcedByClient(t *testing.T) {
+	echo, closeEcho := listenEcho(t)
+	defer closeEcho()
+	server, url, closeServer := newTestServer()
+	defer closeServer()
+	server.Limits = Limits{MaxSessionsPerKey: 1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connectClient(ctx, url, "foo", ClientOptions{Limits: Limits{MaxConnectionsPerSession: 1}})
+	if !waitFor(func() bool { return server.HasSession("foo") }) {
+		t.Fatal("client did not connect")
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{clientKeyHeader: {"foo"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected a second session to be refused with %d, got %v", http.StatusTooManyRequests, err)
+	}
+
+	conn, err := server.Dial("foo", 5*time.Second, "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hi"))
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	refused, err := server.Dial("foo", 5*time.Second, "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+	refused.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(refused, make([]byte, 1)); err != ErrTooManyConnections {
+		t.Fatalf("expected %v, got %v", ErrTooManyConnections, err)
+	}
+}
@@ -11,8 +11,6 @@ import (
 	"strings"
 	"sync/atomic"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 const (
@@ -21,8 +19,12 @@ const (
 	Error
 	AddClient
 	RemoveClient
+	Resume
 )
 
+// maxAddressLength bounds Connect addresses and AddClient routes, which carry client keys
+const maxAddressLength = 1024
+
 var (
 	idCounter int64
 )
@@ -44,6 +46,13 @@ type message struct {
 	body        io.Reader
 	proto       string
 	address     string
+	// extended Data messages carry flags and a sequence number, used on resumable sessions
+	// and for compressed payloads
+	extended bool
+	flags    int64
+	seq      int64
+	// priority schedules the message among those of other connections
+	priority Priority
 }
 
 func nextid() int64 {
@@ -82,6 +91,17 @@ func newErrorMessage(connID int64, err error) *message {
 	}
 }
 
+func newResume(connID int64, seq int64) *message {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return &message{
+		id:          nextid(),
+		connID:      connID,
+		messageType: Resume,
+		seq:         seq,
+		bytes:       buf[:binary.PutVarint(buf, seq)],
+	}
+}
+
 func newAddClient(client string) *message {
 	return &message{
 		id:          nextid(),
@@ -134,7 +154,7 @@ func newServerMessage(reader io.Reader) (*message, error) {
 	}
 
 	if m.messageType == Connect {
-		bytes, err := ioutil.ReadAll(io.LimitReader(buf, 100))
+		bytes, err := ioutil.ReadAll(io.LimitReader(buf, maxAddressLength))
 		if err != nil {
 			return nil, err
 		}
@@ -146,17 +166,46 @@ func newServerMessage(reader io.Reader) (*message, error) {
 		m.address = parts[1]
 		m.bytes = bytes
 	} else if m.messageType == AddClient || m.messageType == RemoveClient {
-		bytes, err := ioutil.ReadAll(io.LimitReader(buf, 100))
+		bytes, err := ioutil.ReadAll(io.LimitReader(buf, maxAddressLength))
 		if err != nil {
 			return nil, err
 		}
 		m.address = string(bytes)
 		m.bytes = bytes
+	} else if m.messageType == Resume {
+		seq, err := binary.ReadVarint(buf)
+		if err != nil {
+			return nil, err
+		}
+		m.seq = seq
 	}
 
 	return m, nil
 }
 
+// readExtension reads the flags and sequence number following the header of an extended Data
+// message.
+func (m *message) readExtension() error {
+	reader, ok := m.body.(io.ByteReader)
+	if !ok {
+		return errors.New("invalid message body")
+	}
+
+	flags, err := binary.ReadVarint(reader)
+	if err != nil {
+		return err
+	}
+	seq, err := binary.ReadVarint(reader)
+	if err != nil {
+		return err
+	}
+
+	m.extended = true
+	m.flags = flags
+	m.seq = seq
+	return nil
+}
+
 func (m *message) Err() error {
 	if m.err != nil {
 		return m.err
@@ -169,6 +218,8 @@ func (m *message) Err() error {
 	str := string(bytes)
 	if str == "EOF" {
 		m.err = io.EOF
+	} else if err, ok := limitErrors[str]; ok {
+		m.err = err
 	} else {
 		m.err = errors.New(str)
 	}
@@ -180,7 +231,7 @@ func (m *message) Bytes() []byte {
 }
 
 func (m *message) header() []byte {
-	buf := make([]byte, 24)
+	buf := make([]byte, 6*binary.MaxVarintLen64)
 	offset := 0
 	offset += binary.PutVarint(buf[offset:], m.id)
 	offset += binary.PutVarint(buf[offset:], m.connID)
@@ -188,6 +239,10 @@ func (m *message) header() []byte {
 	if m.messageType == Data || m.messageType == Connect {
 		offset += binary.PutVarint(buf[offset:], m.deadline)
 	}
+	if m.messageType == Data && m.extended {
+		offset += binary.PutVarint(buf[offset:], m.flags)
+		offset += binary.PutVarint(buf[offset:], m.seq)
+	}
 	return buf[:offset]
 }
 
@@ -196,7 +251,7 @@ func (m *message) Read(p []byte) (int, error) {
 }
 
 func (m *message) WriteTo(wsConn *wsConn) (int, error) {
-	err := wsConn.WriteMessage(websocket.BinaryMessage, m.Bytes())
+	err := wsConn.write(m.connID, m.priority, m.Bytes())
 	return len(m.bytes), err
 }
 
@@ -215,6 +270,8 @@ func (m *message) String() string {
 		return fmt.Sprintf("%d ADDCLIENT    [%s]", m.id, m.address)
 	case RemoveClient:
 		return fmt.Sprintf("%d REMOVECLIENT [%s]", m.id, m.address)
+	case Resume:
+		return fmt.Sprintf("%d RESUME       [%d]: seq %d", m.id, m.connID, m.seq)
 	}
 	return fmt.Sprintf("%d UNKNOWN[%d]: %d", m.id, m.connID, m.messageType)
 }
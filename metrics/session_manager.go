@@ -2,13 +2,17 @@ package metrics
 
 import (
 	"os"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 const metricsEnv = "CATTLE_PROMETHEUS_METRICS"
 
-var prometheusMetrics = false
+var (
+	prometheusMetrics = false
+	enableOnce        sync.Once
+)
 
 var (
 	TotalAddWS = prometheus.NewCounterVec(
@@ -72,6 +76,33 @@ var (
 		[]string{"clientkey"},
 	)
 
+	TotalCompressionInputBytesOnWS = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "session_server",
+			Name:      "total_compression_input_bytes",
+			Help:      "Total bytes compressed, before compression",
+		},
+		[]string{"clientkey"},
+	)
+
+	TotalCompressionOutputBytesOnWS = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "session_server",
+			Name:      "total_compression_output_bytes",
+			Help:      "Total bytes compressed, after compression",
+		},
+		[]string{"clientkey"},
+	)
+
+	TotalLimitRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "session_server",
+			Name:      "total_limit_rejected",
+			Help:      "Total count of sessions and connections rejected because a limit was exceeded",
+		},
+		[]string{"clientkey", "limit"},
+	)
+
 	TotalAddPeerAttempt = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Subsystem: "session_server",
@@ -100,6 +131,14 @@ var (
 
 func init() {
 	if os.Getenv(metricsEnv) == "true" {
+		Enable()
+	}
+}
+
+// Enable registers the metrics with the default prometheus registry, as setting
+// CATTLE_PROMETHEUS_METRICS=true does.
+func Enable() {
+	enableOnce.Do(func() {
 		prometheusMetrics = true
 		// Session metrics
 		prometheus.MustRegister(TotalAddWS)
@@ -109,10 +148,13 @@ func init() {
 		prometheus.MustRegister(TotalTransmitBytesOnWS)
 		prometheus.MustRegister(TotalTransmitErrorBytesOnWS)
 		prometheus.MustRegister(TotalReceiveBytesOnWS)
+		prometheus.MustRegister(TotalCompressionInputBytesOnWS)
+		prometheus.MustRegister(TotalCompressionOutputBytesOnWS)
+		prometheus.MustRegister(TotalLimitRejected)
 		prometheus.MustRegister(TotalAddPeerAttempt)
 		prometheus.MustRegister(TotalPeerConnected)
 		prometheus.MustRegister(TotalPeerDisConnected)
-	}
+	})
 }
 
 func IncSMTotalAddWS(clientKey string, peer bool) {
@@ -174,6 +216,26 @@ func AddSMTotalReceiveBytesOnWS(clientKey string, size float64) {
 	}
 }
 
+func AddSMTotalCompression(clientKey string, in, out float64) {
+	if prometheusMetrics {
+		labels := prometheus.Labels{
+			"clientkey": clientKey,
+		}
+		TotalCompressionInputBytesOnWS.With(labels).Add(in)
+		TotalCompressionOutputBytesOnWS.With(labels).Add(out)
+	}
+}
+
+func IncSMTotalLimitRejected(clientKey, limit string) {
+	if prometheusMetrics {
+		TotalLimitRejected.With(
+			prometheus.Labels{
+				"clientkey": clientKey,
+				"limit":     limit,
+			}).Inc()
+	}
+}
+
 func IncSMTotalAddConnectionsForWS(clientKey, proto, addr string) {
 	if prometheusMetrics {
 		TotalAddConnectionsForWS.With(
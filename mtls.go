@@ -0,0 +1,334 @@
+package remotedialer
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// MTLSKeySource selects which field of a verified client certificate is used as the client key.
+type MTLSKeySource int
+
+const (
+	// MTLSCommonName uses the subject common name.
+	MTLSCommonName MTLSKeySource = iota
+	// MTLSURI uses the first URI subject alternative name.
+	MTLSURI
+	// MTLSSPIFFEID uses the spiffe:// URI subject alternative name.
+	MTLSSPIFFEID
+)
+
+type MTLSAuthorizerConfig struct {
+	KeySource MTLSKeySource
+	// TrustDomain, if set, restricts SPIFFE IDs to spiffe://<TrustDomain>/...
+	TrustDomain string
+	// CRLFile holds certificate revocation lists, PEM encoded or a single DER list. It is
+	// re-read when its modification time changes. Each list must be signed by a CA in CAFile
+	// and is rejected, failing authorization, once past its next update.
+	CRLFile string
+	// CAFile holds the PEM encoded CAs verifying the lists of CRLFile, required with it.
+	CAFile string
+	// Pins are hex encoded SHA-256 fingerprints of client certificates. If any are
+	// set, only certificates matching a pin are accepted.
+	Pins []string
+}
+
+type mtlsAuthorizer struct {
+	sync.Mutex
+
+	config  MTLSAuthorizerConfig
+	pins    map[string]bool
+	cas     []*x509.Certificate
+	revoked map[revokedKey]bool
+	// nextUpdate is the earliest next update of the lists, after which they are stale.
+	nextUpdate time.Time
+	crlMod     time.Time
+}
+
+// revokedKey identifies a certificate by its issuer, as serial numbers are only unique per CA.
+type revokedKey struct {
+	issuer string
+	serial string
+}
+
+// NewMTLSAuthorizer returns an Authorizer that derives the client key from the verified TLS
+// client certificate of the request. The http.Server must be configured to request and verify
+// client certificates, see NewMTLSServerConfig.
+func NewMTLSAuthorizer(config MTLSAuthorizerConfig) (Authorizer, error) {
+	a := &mtlsAuthorizer{
+		config: config,
+		pins:   map[string]bool{},
+	}
+
+	for _, pin := range config.Pins {
+		pin = strings.ToLower(strings.Replace(pin, ":", "", -1))
+		if _, err := hex.DecodeString(pin); err != nil || len(pin) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid certificate pin %s", pin)
+		}
+		a.pins[pin] = true
+	}
+
+	if config.CRLFile != "" {
+		if config.CAFile == "" {
+			return nil, fmt.Errorf("a CA file is required to verify CRL %s", config.CRLFile)
+		}
+		cas, err := loadCerts(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		a.cas = cas
+		if err := a.loadCRL(); err != nil {
+			return nil, err
+		}
+	}
+
+	return a.authorize, nil
+}
+
+func (a *mtlsAuthorizer) authorize(req *http.Request) (string, bool, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return "", false, nil
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+
+	if len(a.pins) > 0 {
+		sum := sha256.Sum256(cert.Raw)
+		if !a.pins[hex.EncodeToString(sum[:])] {
+			logrus.Infof("Rejecting client certificate %s: not pinned", cert.Subject)
+			return "", false, nil
+		}
+	}
+
+	if a.config.CRLFile != "" {
+		revoked, err := a.isRevoked(cert)
+		if err != nil {
+			return "", false, err
+		}
+		if revoked {
+			logrus.Infof("Rejecting client certificate %s: revoked", cert.Subject)
+			return "", false, nil
+		}
+	}
+
+	clientKey := a.clientKey(cert)
+	return clientKey, clientKey != "", nil
+}
+
+func (a *mtlsAuthorizer) clientKey(cert *x509.Certificate) string {
+	switch a.config.KeySource {
+	case MTLSURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	case MTLSSPIFFEID:
+		for _, uri := range cert.URIs {
+			if uri.Scheme != "spiffe" {
+				continue
+			}
+			if a.config.TrustDomain != "" && uri.Host != a.config.TrustDomain {
+				continue
+			}
+			return uri.String()
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+	return ""
+}
+
+func (a *mtlsAuthorizer) isRevoked(cert *x509.Certificate) (bool, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	stat, err := os.Stat(a.config.CRLFile)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read CRL %s", a.config.CRLFile)
+	}
+	if !stat.ModTime().Equal(a.crlMod) {
+		if err := a.readCRL(stat.ModTime()); err != nil {
+			return false, err
+		}
+	}
+
+	if !a.nextUpdate.IsZero() && time.Now().After(a.nextUpdate) {
+		return false, fmt.Errorf("CRL %s is stale since %s", a.config.CRLFile, a.nextUpdate)
+	}
+
+	return a.revoked[revokedKey{
+		issuer: string(cert.RawIssuer),
+		serial: cert.SerialNumber.String(),
+	}], nil
+}
+
+func (a *mtlsAuthorizer) loadCRL() error {
+	a.Lock()
+	defer a.Unlock()
+
+	stat, err := os.Stat(a.config.CRLFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read CRL %s", a.config.CRLFile)
+	}
+	return a.readCRL(stat.ModTime())
+}
+
+func (a *mtlsAuthorizer) readCRL(modTime time.Time) error {
+	bytes, err := ioutil.ReadFile(a.config.CRLFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read CRL %s", a.config.CRLFile)
+	}
+
+	var ders [][]byte
+	for rest := bytes; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		ders = append(ders, block.Bytes)
+	}
+	if len(ders) == 0 {
+		ders = [][]byte{bytes}
+	}
+
+	var (
+		revoked    = map[revokedKey]bool{}
+		nextUpdate time.Time
+	)
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse CRL %s", a.config.CRLFile)
+		}
+		if err := a.verifyCRL(crl); err != nil {
+			return errors.Wrapf(err, "invalid CRL %s", a.config.CRLFile)
+		}
+
+		if !crl.NextUpdate.IsZero() && (nextUpdate.IsZero() || crl.NextUpdate.Before(nextUpdate)) {
+			nextUpdate = crl.NextUpdate
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			revoked[revokedKey{
+				issuer: string(crl.RawIssuer),
+				serial: entry.SerialNumber.String(),
+			}] = true
+		}
+	}
+
+	a.revoked = revoked
+	a.nextUpdate = nextUpdate
+	a.crlMod = modTime
+	return nil
+}
+
+// verifyCRL checks that crl is signed by one of the CAs and not stale.
+func (a *mtlsAuthorizer) verifyCRL(crl *x509.RevocationList) error {
+	if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+		return fmt.Errorf("stale since %s", crl.NextUpdate)
+	}
+	for _, ca := range a.cas {
+		if string(ca.RawSubject) == string(crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("not signed by a trusted CA")
+}
+
+func loadCerts(caFile string) ([]*x509.Certificate, error) {
+	bytes, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read CA %s", caFile)
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		if block, bytes = pem.Decode(bytes); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse CA %s", caFile)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return certs, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	bytes, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read CA %s", caFile)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bytes) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// NewMTLSServerConfig returns a tls.Config for the server's http.Server that requires client
+// certificates signed by the CAs in caFile.
+func NewMTLSServerConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// NewMTLSDialer returns a websocket.Dialer for ClientConnect that presents the client
+// certificate in certFile/keyFile. If caFile is set it is used to verify the server instead
+// of the system roots.
+func NewMTLSDialer(certFile, keyFile, caFile string) (*websocket.Dialer, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: HandshakeTimeOut,
+		TLSClientConfig:  tlsConfig,
+	}, nil
+}
@@ -0,0 +1,294 @@
+package remotedialer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64, commonName string, uris ...string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	for _, s := range uris {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = append(template.URIs, u)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+var crlWrites int
+
+// writeCRL writes a list revoking serials, valid until nextUpdate, to path.
+func (ca *testCA) writeCRL(t *testing.T, path string, nextUpdate time.Time, serials ...int64) {
+	var entries []x509.RevocationListEntry
+	for _, serial := range serials {
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(time.Now().UnixNano()),
+		ThisUpdate:                time.Now().Add(-time.Hour),
+		NextUpdate:                nextUpdate,
+		RevokedCertificateEntries: entries,
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The list is re-read when its modification time changes, which may not be the case
+	// within the resolution of the file system
+	crlWrites++
+	modTime := time.Now().Add(time.Duration(crlWrites) * time.Second)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeCAs(t *testing.T, path string, cas ...*testCA) {
+	var data []byte
+	for _, ca := range cas {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func requestWithCert(cert *x509.Certificate) *http.Request {
+	return &http.Request{
+		TLS: &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{cert}},
+		},
+	}
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "remotedialer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestMTLSKeySource(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	cert := ca.issue(t, 2, "agent-cn",
+		"https://example.com/agent",
+		"spiffe://other.org/agent",
+		"spiffe://example.org/ns/default/agent")
+
+	tests := []struct {
+		config MTLSAuthorizerConfig
+		key    string
+	}{
+		{MTLSAuthorizerConfig{}, "agent-cn"},
+		{MTLSAuthorizerConfig{KeySource: MTLSURI}, "https://example.com/agent"},
+		{MTLSAuthorizerConfig{KeySource: MTLSSPIFFEID}, "spiffe://other.org/agent"},
+		{MTLSAuthorizerConfig{KeySource: MTLSSPIFFEID, TrustDomain: "example.org"}, "spiffe://example.org/ns/default/agent"},
+		{MTLSAuthorizerConfig{KeySource: MTLSSPIFFEID, TrustDomain: "unknown.org"}, ""},
+	}
+	for _, test := range tests {
+		auth, err := NewMTLSAuthorizer(test.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, ok, err := auth(requestWithCert(cert))
+		if err != nil || ok != (test.key != "") || key != test.key {
+			t.Errorf("%+v: got %q, %v, %v, expected %q", test.config, key, ok, err, test.key)
+		}
+	}
+
+	auth, err := NewMTLSAuthorizer(MTLSAuthorizerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := auth(&http.Request{}); ok {
+		t.Fatal("request without a client certificate accepted")
+	}
+}
+
+func TestMTLSPins(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	pinned := ca.issue(t, 2, "pinned")
+	other := ca.issue(t, 3, "other")
+
+	sum := sha256.Sum256(pinned.Raw)
+	auth, err := NewMTLSAuthorizer(MTLSAuthorizerConfig{
+		Pins: []string{hex.EncodeToString(sum[:])},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, ok, _ := auth(requestWithCert(pinned)); !ok || key != "pinned" {
+		t.Fatal("pinned certificate rejected")
+	}
+	if _, ok, _ := auth(requestWithCert(other)); ok {
+		t.Fatal("certificate without a pin accepted")
+	}
+
+	if _, err := NewMTLSAuthorizer(MTLSAuthorizerConfig{Pins: []string{"abcd"}}); err == nil {
+		t.Fatal("invalid pin accepted")
+	}
+}
+
+func TestMTLSRevocation(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	caFile := filepath.Join(dir, "ca.pem")
+	crlFile := filepath.Join(dir, "crl.pem")
+
+	a, b := newTestCA(t, "a"), newTestCA(t, "b")
+	writeCAs(t, caFile, a, b)
+	a.writeCRL(t, crlFile, time.Now().Add(time.Hour), 5)
+
+	if _, err := NewMTLSAuthorizer(MTLSAuthorizerConfig{CRLFile: crlFile}); err == nil {
+		t.Fatal("CRL accepted without a CA file")
+	}
+
+	auth, err := NewMTLSAuthorizer(MTLSAuthorizerConfig{CRLFile: crlFile, CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := auth(requestWithCert(a.issue(t, 5, "revoked"))); ok {
+		t.Fatal("revoked certificate accepted")
+	}
+	// Serial numbers are only unique per CA
+	if key, ok, err := auth(requestWithCert(b.issue(t, 5, "valid"))); !ok || key != "valid" {
+		t.Fatalf("certificate of another CA with a revoked serial rejected: %v", err)
+	}
+
+	// The list is re-read once changed
+	a.writeCRL(t, crlFile, time.Now().Add(time.Hour), 6)
+	if _, ok, _ := auth(requestWithCert(a.issue(t, 5, "restored"))); !ok {
+		t.Fatal("certificate removed from the CRL still rejected")
+	}
+	if _, ok, _ := auth(requestWithCert(a.issue(t, 6, "revoked"))); ok {
+		t.Fatal("certificate added to the CRL accepted")
+	}
+}
+
+func TestMTLSCRLVerification(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	caFile := filepath.Join(dir, "ca.pem")
+	crlFile := filepath.Join(dir, "crl.pem")
+
+	trusted := newTestCA(t, "ca")
+	writeCAs(t, caFile, trusted)
+
+	// Same name, different key
+	forger := newTestCA(t, "ca")
+	forger.writeCRL(t, crlFile, time.Now().Add(time.Hour))
+	if _, err := NewMTLSAuthorizer(MTLSAuthorizerConfig{CRLFile: crlFile, CAFile: caFile}); err == nil {
+		t.Fatal("CRL signed by an untrusted CA accepted")
+	}
+
+	trusted.writeCRL(t, crlFile, time.Now().Add(-time.Minute))
+	if _, err := NewMTLSAuthorizer(MTLSAuthorizerConfig{CRLFile: crlFile, CAFile: caFile}); err == nil {
+		t.Fatal("stale CRL accepted")
+	}
+
+	trusted.writeCRL(t, crlFile, time.Now().Add(time.Hour))
+	auth, err := NewMTLSAuthorizer(MTLSAuthorizerConfig{CRLFile: crlFile, CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := trusted.issue(t, 2, "agent")
+	if _, ok, _ := auth(requestWithCert(cert)); !ok {
+		t.Fatal("certificate rejected")
+	}
+
+	// A forged update fails authorization rather than clearing the revocations
+	forger.writeCRL(t, crlFile, time.Now().Add(time.Hour))
+	if _, ok, err := auth(requestWithCert(cert)); ok || err == nil {
+		t.Fatal("forged CRL update accepted")
+	}
+}
+
+func TestMTLSCRLBecomesStale(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	caFile := filepath.Join(dir, "ca.pem")
+	crlFile := filepath.Join(dir, "crl.pem")
+
+	ca := newTestCA(t, "ca")
+	writeCAs(t, caFile, ca)
+	// CRL times have a resolution of a second
+	ca.writeCRL(t, crlFile, time.Now().Add(time.Second))
+
+	auth, err := NewMTLSAuthorizer(MTLSAuthorizerConfig{CRLFile: crlFile, CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if _, ok, err := auth(requestWithCert(ca.issue(t, 2, "agent"))); ok || err == nil {
+		t.Fatal("certificate accepted with a stale CRL")
+	}
+}
@@ -2,11 +2,11 @@ package remotedialer
 
 import (
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
-	"fmt"
 	"net"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -17,10 +17,45 @@ import (
 var (
 	Token = "X-API-Tunnel-Token"
 	ID    = "X-API-Tunnel-ID"
+	// PeerVersion is the peer protocol version, sent by the dialing peer and echoed by the
+	// accepting server if it supports it. Peers not sending it are spoken to in version 1.
+	PeerVersion = "X-API-Tunnel-Peer-Version"
+
+	// PeerTokenGracePeriod is how long a peer's previous token is still accepted after
+	// AddPeer is called with a new token for the same peer.
+	PeerTokenGracePeriod = 10 * time.Minute
 )
 
+// PeerToken is a token accepted from a peer within an optional validity window. A zero
+// NotBefore or NotAfter leaves that side of the window open.
+type PeerToken struct {
+	Token     string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+func (t PeerToken) valid(now time.Time) bool {
+	if !t.NotBefore.IsZero() && now.Before(t.NotBefore) {
+		return false
+	}
+	if !t.NotAfter.IsZero() && now.After(t.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// peerTLSConfig returns the TLS config of connections to peers.
+func (s *Server) peerTLSConfig() *tls.Config {
+	if s.PeerTLSConfig == nil {
+		return &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	}
+	return s.PeerTLSConfig.Clone()
+}
+
 func (s *Server) AddPeer(url, id, token string) {
-	if s.PeerID == "" || s.PeerToken == "" {
+	if s.PeerID == "" || s.getPeerToken() == "" {
 		return
 	}
 
@@ -32,22 +67,83 @@ func (s *Server) AddPeer(url, id, token string) {
 		cancel: cancel,
 	}
 
-	logrus.Infof("Adding peer %s, %s", url, id)
-
 	s.peerLock.Lock()
 	defer s.peerLock.Unlock()
 
 	if p, ok := s.peers[id]; ok {
 		if p.equals(peer) {
+			cancel()
+			return
+		}
+		if p.url == peer.url {
+			// Only the token changed, keep the established sessions and accept the
+			// previous token for the grace period
+			logrus.Infof("Rotating token for peer %s", id)
+			cancel()
+			p.tokens = append(p.validTokens(time.Now()), PeerToken{
+				Token:    p.token,
+				NotAfter: time.Now().Add(PeerTokenGracePeriod),
+			})
+			p.token = token
+			s.peers[id] = p
 			return
 		}
 		p.cancel()
 	}
 
+	logrus.Infof("Adding peer %s, %s", url, id)
 	s.peers[id] = peer
 	go peer.start(ctx, s)
 }
 
+// SetPeerTokens sets additional tokens accepted from the peer id, each within its validity
+// window. It does not affect established sessions.
+func (s *Server) SetPeerTokens(id string, tokens ...PeerToken) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	if p, ok := s.peers[id]; ok {
+		p.tokens = append([]PeerToken(nil), tokens...)
+		s.peers[id] = p
+	}
+}
+
+// SetPeerToken changes the token this server presents to its peers. It is used the next time
+// each peer connection is established, current sessions are left running.
+func (s *Server) SetPeerToken(token string) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	s.PeerToken = token
+}
+
+func (s *Server) getPeerToken() string {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	return s.PeerToken
+}
+
+func (s *Server) checkPeerToken(id, token string) bool {
+	s.peerLock.Lock()
+	p, ok := s.peers[id]
+	s.peerLock.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(p.token), []byte(token)) == 1 {
+		return true
+	}
+	for _, t := range p.validTokens(time.Now()) {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Server) RemovePeer(id string) {
 	s.peerLock.Lock()
 	defer s.peerLock.Unlock()
@@ -59,11 +155,33 @@ func (s *Server) RemovePeer(id string) {
 	delete(s.peers, id)
 }
 
+// peerRoutingVersion is the first peer protocol version relaying routes over several hops.
+const peerRoutingVersion = 2
+
+func peerVersion(header http.Header) int {
+	version, err := strconv.Atoi(header.Get(PeerVersion))
+	if err != nil {
+		return 1
+	}
+	return version
+}
+
 type peer struct {
 	url, id, token string
+	tokens         []PeerToken
 	cancel         func()
 }
 
+func (p peer) validTokens(now time.Time) []PeerToken {
+	var result []PeerToken
+	for _, t := range p.tokens {
+		if t.valid(now) {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
 func (p peer) equals(other peer) bool {
 	return p.url == other.url &&
 		p.id == other.id &&
@@ -71,15 +189,8 @@ func (p peer) equals(other peer) bool {
 }
 
 func (p *peer) start(ctx context.Context, s *Server) {
-	headers := http.Header{
-		ID:    {s.PeerID},
-		Token: {s.PeerToken},
-	}
-
 	dialer := &websocket.Dialer{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
+		TLSClientConfig:  s.peerTLSConfig(),
 		HandshakeTimeout: HandshakeTimeOut,
 	}
 
@@ -91,8 +202,14 @@ outer:
 		default:
 		}
 
+		headers := http.Header{
+			ID:          {s.PeerID},
+			Token:       {s.getPeerToken()},
+			PeerVersion: {strconv.Itoa(peerRoutingVersion)},
+		}
+
 		metrics.IncSMTotalAddPeerAttempt(p.id)
-		ws, _, err := dialer.Dial(p.url, headers)
+		ws, resp, err := dialer.Dial(p.url, headers)
 		if err != nil {
 			logrus.Errorf("Failed to connect to peer %s [local ID=%s]: %v", p.url, s.PeerID, err)
 			time.Sleep(5 * time.Second)
@@ -101,16 +218,24 @@ outer:
 		metrics.IncSMTotalPeerConnected(p.id)
 
 		session := NewClientSession(func(string, string) bool { return true }, ws)
+		session.localPeerID = s.PeerID
+		session.remotePeerID = p.id
+		session.peerRouting = peerVersion(resp.Header) >= peerRoutingVersion
+		session.auditSink = s.Audit
 		session.dialer = func(network, address string) (net.Conn, error) {
-			parts := strings.SplitN(network, "::", 2)
-			if len(parts) != 2 {
-				return nil, fmt.Errorf("invalid clientKey/proto: %s", network)
+			clientKey, proto, ttl, err := parseForwardedNetwork(network)
+			if err != nil {
+				return nil, err
 			}
-			return s.Dial(parts[0], 15*time.Second, parts[1], address)
+			return s.dialTTL(clientKey, 15*time.Second, ttl, "peer "+p.id, proto, address)
 		}
 
-		s.sessions.addListener(session)
-		_, err = session.Serve(context.Background())
+		// In cluster mode dials are sent to the owner of the client key, so there is no need
+		// to advertise clients to peers
+		if s.Cluster == nil {
+			s.sessions.addListener(session)
+		}
+		_, err = session.ServeWithOptions(ctx, s.ServeOptions)
 		s.sessions.removeListener(session)
 		session.Close()
 
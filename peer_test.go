@@ -0,0 +1,86 @@
+package remotedialer
+
+import (
+	"testing"
+	"time"
+)
+
+func newPeerTestServer() *Server {
+	server := New(nil, DefaultErrorWriter)
+	server.PeerID = "a"
+	server.PeerToken = "a-token"
+	return server
+}
+
+func TestPeerTokenRotation(t *testing.T) {
+	defer func(period time.Duration) { PeerTokenGracePeriod = period }(PeerTokenGracePeriod)
+	PeerTokenGracePeriod = 200 * time.Millisecond
+
+	server := newPeerTestServer()
+	// Nothing listens there, the peer keeps retrying in the background
+	const url = "ws://127.0.0.1:1/connect"
+	server.AddPeer(url, "b", "old")
+	defer server.RemovePeer("b")
+
+	if !server.checkPeerToken("b", "old") {
+		t.Fatal("peer token rejected")
+	}
+	if server.checkPeerToken("b", "new") || server.checkPeerToken("c", "old") {
+		t.Fatal("unknown token accepted")
+	}
+
+	server.AddPeer(url, "b", "new")
+	if !server.checkPeerToken("b", "new") {
+		t.Fatal("new token rejected")
+	}
+	if !server.checkPeerToken("b", "old") {
+		t.Fatal("old token rejected within the grace period")
+	}
+
+	time.Sleep(PeerTokenGracePeriod + 50*time.Millisecond)
+	if server.checkPeerToken("b", "old") {
+		t.Fatal("old token accepted after the grace period")
+	}
+	if !server.checkPeerToken("b", "new") {
+		t.Fatal("new token rejected after the grace period")
+	}
+}
+
+func TestPeerTokenURLChange(t *testing.T) {
+	server := newPeerTestServer()
+	server.AddPeer("ws://127.0.0.1:1/connect", "b", "old")
+	defer server.RemovePeer("b")
+
+	// Another URL is another peer, its previous token is not kept
+	server.AddPeer("ws://127.0.0.1:2/connect", "b", "new")
+	if server.checkPeerToken("b", "old") {
+		t.Fatal("token of the replaced peer accepted")
+	}
+	if !server.checkPeerToken("b", "new") {
+		t.Fatal("new token rejected")
+	}
+}
+
+func TestPeerTokenWindows(t *testing.T) {
+	server := newPeerTestServer()
+	server.AddPeer("ws://127.0.0.1:1/connect", "b", "current")
+	defer server.RemovePeer("b")
+
+	now := time.Now()
+	server.SetPeerTokens("b",
+		PeerToken{Token: "next", NotBefore: now.Add(time.Hour)},
+		PeerToken{Token: "expired", NotAfter: now.Add(-time.Minute)},
+		PeerToken{Token: "extra", NotBefore: now.Add(-time.Minute), NotAfter: now.Add(time.Hour)},
+	)
+
+	for token, valid := range map[string]bool{
+		"current": true,
+		"next":    false,
+		"expired": false,
+		"extra":   true,
+	} {
+		if server.checkPeerToken("b", token) != valid {
+			t.Errorf("token %s: expected valid %v", token, valid)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+// Package portforward forwards local ports to addresses reachable by remotedialer agents.
+package portforward
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/remotedialer"
+	"github.com/sirupsen/logrus"
+)
+
+// Forward forwards the connections accepted on a local address to an address reachable by the
+// agent of ClientKey.
+type Forward struct {
+	Listen    string `json:"listen" yaml:"listen"`
+	ClientKey string `json:"clientKey" yaml:"clientKey"`
+	// Network is the network dialed by the agent, tcp by default.
+	Network string `json:"network,omitempty" yaml:"network,omitempty"`
+	Address string `json:"address" yaml:"address"`
+}
+
+func (f Forward) network() string {
+	if f.Network == "" {
+		return "tcp"
+	}
+	return f.Network
+}
+
+func (f Forward) String() string {
+	return fmt.Sprintf("%s=%s/%s://%s", f.Listen, f.ClientKey, f.network(), f.Address)
+}
+
+// Parse parses listen=clientKey/address or listen=clientKey/network://address, such as
+// localhost:15432=agent/db:5432 or localhost:2375=agent/unix:///var/run/docker.sock.
+func Parse(s string) (Forward, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return Forward{}, fmt.Errorf("invalid forward %s, expected listen=clientKey/address", s)
+	}
+	target := strings.SplitN(parts[1], "/", 2)
+	if len(target) != 2 || target[0] == "" || target[1] == "" {
+		return Forward{}, fmt.Errorf("invalid forward %s, expected listen=clientKey/address", s)
+	}
+
+	f := Forward{
+		Listen:    parts[0],
+		ClientKey: target[0],
+		Address:   target[1],
+	}
+	if i := strings.Index(f.Address, "://"); i >= 0 {
+		f.Network, f.Address = f.Address[:i], f.Address[i+len("://"):]
+	}
+	return f, nil
+}
+
+// PortForward manages the listeners of Forwards, which can be added and removed at runtime.
+type PortForward struct {
+	sync.Mutex
+
+	server    *remotedialer.Server
+	deadline  time.Duration
+	listeners map[string]*forwardListener
+}
+
+// New returns a PortForward dialing through server, waiting up to deadline for each connection.
+func New(server *remotedialer.Server, deadline time.Duration) *PortForward {
+	return &PortForward{
+		server:    server,
+		deadline:  deadline,
+		listeners: map[string]*forwardListener{},
+	}
+}
+
+// Add starts listening for f.
+func (p *PortForward) Add(f Forward) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if _, ok := p.listeners[f.Listen]; ok {
+		return fmt.Errorf("%s is already forwarded", f.Listen)
+	}
+
+	l, err := net.Listen("tcp", f.Listen)
+	if err != nil {
+		return err
+	}
+
+	fl := &forwardListener{
+		forward:  f,
+		listener: l,
+		conns:    map[net.Conn]bool{},
+	}
+	p.listeners[f.Listen] = fl
+	go p.serve(fl)
+
+	logrus.Infof("Forwarding %s", f)
+	return nil
+}
+
+// Remove stops listening on listen and closes its forwarded connections.
+func (p *PortForward) Remove(listen string) error {
+	p.Lock()
+	fl, ok := p.listeners[listen]
+	delete(p.listeners, listen)
+	p.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%s is not forwarded", listen)
+	}
+	fl.close()
+
+	logrus.Infof("Stopped forwarding %s", fl.forward)
+	return nil
+}
+
+// Set replaces the forwards with forwards, keeping the listeners of those unchanged.
+func (p *PortForward) Set(forwards []Forward) error {
+	wanted := map[string]Forward{}
+	for _, f := range forwards {
+		wanted[f.Listen] = f
+	}
+
+	for _, f := range p.Forwards() {
+		if w, ok := wanted[f.Listen]; !ok || w != f {
+			p.Remove(f.Listen)
+		}
+	}
+
+	var errs []string
+	for _, f := range forwards {
+		p.Lock()
+		_, ok := p.listeners[f.Listen]
+		p.Unlock()
+		if ok {
+			continue
+		}
+		if err := p.Add(f); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to forward: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// Forwards returns the current forwards.
+func (p *PortForward) Forwards() []Forward {
+	p.Lock()
+	defer p.Unlock()
+
+	var forwards []Forward
+	for _, fl := range p.listeners {
+		forwards = append(forwards, fl.forward)
+	}
+	return forwards
+}
+
+// Stop stops accepting connections, leaving the forwarded ones open until Close.
+func (p *PortForward) Stop() {
+	p.Lock()
+	defer p.Unlock()
+
+	for _, fl := range p.listeners {
+		fl.stop()
+	}
+}
+
+// Close removes all forwards.
+func (p *PortForward) Close() {
+	for _, f := range p.Forwards() {
+		p.Remove(f.Listen)
+	}
+}
+
+func (p *PortForward) serve(fl *forwardListener) {
+	for {
+		conn, err := fl.listener.Accept()
+		if err != nil {
+			if !fl.isClosed() {
+				logrus.Errorf("Failed to accept on %s: %v", fl.forward.Listen, err)
+			}
+			return
+		}
+		if !fl.track(conn) {
+			conn.Close()
+			return
+		}
+		go p.forward(fl, conn)
+	}
+}
+
+func (p *PortForward) forward(fl *forwardListener, conn net.Conn) {
+	defer fl.untrack(conn)
+	defer conn.Close()
+
+	f := fl.forward
+	target, err := p.server.DialWithOptions(f.ClientKey, p.deadline, f.network(), f.Address, remotedialer.DialOptions{
+		Caller: conn.RemoteAddr().String(),
+	})
+	if err != nil {
+		logrus.Errorf("Failed to forward %s: %v", f, err)
+		return
+	}
+	defer target.Close()
+
+	go func() {
+		io.Copy(target, conn)
+		target.Close()
+	}()
+	io.Copy(conn, target)
+}
+
+type forwardListener struct {
+	sync.Mutex
+
+	forward  Forward
+	listener net.Listener
+	conns    map[net.Conn]bool
+	closed   bool
+}
+
+func (fl *forwardListener) track(conn net.Conn) bool {
+	fl.Lock()
+	defer fl.Unlock()
+
+	if fl.closed {
+		return false
+	}
+	fl.conns[conn] = true
+	return true
+}
+
+func (fl *forwardListener) untrack(conn net.Conn) {
+	fl.Lock()
+	defer fl.Unlock()
+
+	delete(fl.conns, conn)
+}
+
+func (fl *forwardListener) isClosed() bool {
+	fl.Lock()
+	defer fl.Unlock()
+
+	return fl.closed
+}
+
+func (fl *forwardListener) stop() {
+	fl.Lock()
+	defer fl.Unlock()
+
+	fl.closed = true
+	fl.listener.Close()
+}
+
+func (fl *forwardListener) close() {
+	fl.stop()
+
+	fl.Lock()
+	defer fl.Unlock()
+
+	for conn := range fl.conns {
+		conn.Close()
+	}
+}
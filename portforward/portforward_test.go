@@ -0,0 +1,188 @@
+package portforward
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rancher/remotedialer/remotedialertest"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		s       string
+		forward Forward
+	}{
+		{"localhost:15432=agent/db:5432", Forward{Listen: "localhost:15432", ClientKey: "agent", Address: "db:5432"}},
+		{"localhost:2375=agent/unix:///var/run/docker.sock", Forward{Listen: "localhost:2375", ClientKey: "agent", Network: "unix", Address: "/var/run/docker.sock"}},
+		{"localhost:5353=agent/udp://dns:53", Forward{Listen: "localhost:5353", ClientKey: "agent", Network: "udp", Address: "dns:53"}},
+	}
+	for _, test := range tests {
+		f, err := Parse(test.s)
+		if err != nil || f != test.forward {
+			t.Errorf("%s: parsed %+v, %v", test.s, f, err)
+		}
+	}
+
+	for _, s := range []string{"localhost:15432", "localhost:15432=agent", "localhost:15432=/db:5432", "localhost:15432=agent/"} {
+		if f, err := Parse(s); err == nil {
+			t.Errorf("%s: parsed %+v", s, f)
+		}
+	}
+
+	if s := (Forward{Listen: "localhost:15432", ClientKey: "agent", Address: "db:5432"}).String(); s != "localhost:15432=agent/tcp://db:5432" {
+		t.Fatalf("unexpected string %s", s)
+	}
+}
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// checkEcho connects to addr and checks that data makes the round trip, returning the
+// connection.
+func checkEcho(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("echo mismatch", err)
+	}
+	return conn
+}
+
+// checkClosed checks that conn is closed by the other side.
+func checkClosed(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
+
+func newHarness(t *testing.T) *remotedialertest.Harness {
+	h := remotedialertest.New()
+	client, err := h.Connect("agent")
+	if err != nil {
+		h.Close()
+		t.Fatal(err)
+	}
+	client.Handle("tcp", "echo:7", remotedialertest.Echo)
+	return h
+}
+
+func TestForward(t *testing.T) {
+	h := newHarness(t)
+	defer h.Close()
+	p := New(h.Server, 5*time.Second)
+	defer p.Close()
+
+	f := Forward{Listen: freeAddr(t), ClientKey: "agent", Address: "echo:7"}
+	if err := p.Add(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Add(f); err == nil {
+		t.Fatal("address forwarded twice")
+	}
+	conn := checkEcho(t, f.Listen)
+	defer conn.Close()
+
+	if err := p.Remove(f.Listen); err != nil {
+		t.Fatal(err)
+	}
+	checkClosed(t, conn)
+	if _, err := net.Dial("tcp", f.Listen); err == nil {
+		t.Fatal("still listening after Remove")
+	}
+	if err := p.Remove(f.Listen); err == nil {
+		t.Fatal("removed a forward twice")
+	}
+
+	// Dial failures close the accepted connection
+	unknown := Forward{Listen: freeAddr(t), ClientKey: "unknown", Address: "echo:7"}
+	if err := p.Add(unknown); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", unknown.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkClosed(t, conn)
+}
+
+func TestSet(t *testing.T) {
+	h := newHarness(t)
+	defer h.Close()
+	p := New(h.Server, 5*time.Second)
+	defer p.Close()
+
+	kept := Forward{Listen: freeAddr(t), ClientKey: "agent", Address: "echo:7"}
+	changed := Forward{Listen: freeAddr(t), ClientKey: "agent", Address: "echo:7"}
+	if err := p.Set([]Forward{kept, changed}); err != nil {
+		t.Fatal(err)
+	}
+	keptConn := checkEcho(t, kept.Listen)
+	defer keptConn.Close()
+	changedConn := checkEcho(t, changed.Listen)
+	defer changedConn.Close()
+
+	changed.Network = "tcp"
+	added := Forward{Listen: freeAddr(t), ClientKey: "agent", Address: "echo:7"}
+	if err := p.Set([]Forward{kept, changed, added}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unchanged forwards keep their connections
+	keptConn.Write([]byte("hello"))
+	if _, err := io.ReadFull(keptConn, make([]byte, 5)); err != nil {
+		t.Fatal("connection of an unchanged forward closed", err)
+	}
+	checkClosed(t, changedConn)
+	checkEcho(t, changed.Listen).Close()
+	checkEcho(t, added.Listen).Close()
+
+	if err := p.Set(nil); err != nil {
+		t.Fatal(err)
+	}
+	if forwards := p.Forwards(); len(forwards) != 0 {
+		t.Fatalf("forwards left: %v", forwards)
+	}
+	checkClosed(t, keptConn)
+}
+
+func TestStop(t *testing.T) {
+	h := newHarness(t)
+	defer h.Close()
+	p := New(h.Server, 5*time.Second)
+
+	f := Forward{Listen: freeAddr(t), ClientKey: "agent", Address: "echo:7"}
+	if err := p.Add(f); err != nil {
+		t.Fatal(err)
+	}
+	conn := checkEcho(t, f.Listen)
+	defer conn.Close()
+
+	// Forwarded connections stay open until Close
+	p.Stop()
+	if _, err := net.Dial("tcp", f.Listen); err == nil {
+		t.Fatal("still listening after Stop")
+	}
+	conn.Write([]byte("hello"))
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal("connection closed by Stop", err)
+	}
+
+	p.Close()
+	checkClosed(t, conn)
+}
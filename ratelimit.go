@@ -0,0 +1,248 @@
+package remotedialer
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimit limits the bandwidth of tunneled data in bytes per second. Zero is unlimited.
+type RateLimit struct {
+	// Transmit limits data sent to the remote side.
+	Transmit int64 `json:"transmit,omitempty" yaml:"transmit,omitempty"`
+	// Receive limits data read from the remote side. It only paces the reads of the tunneled
+	// connection: the tunnel has no flow control to slow the remote side down, so its data is
+	// buffered and the connection fails once its buffer is full, without holding up the other
+	// connections of the session.
+	Receive int64 `json:"receive,omitempty" yaml:"receive,omitempty"`
+	// Burst is the most bytes sent or read at once after being idle, Transmit or Receive by
+	// default.
+	Burst int64 `json:"burst,omitempty" yaml:"burst,omitempty"`
+}
+
+func (r RateLimit) burst(rate int64) int64 {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	return rate
+}
+
+var errReceiveOverflow = errors.New("receive buffer full, data arrives faster than the receive rate limit")
+
+// tokenBucket lets callers take tokens before they are available and makes them wait for the
+// debt to be refilled, so writes larger than the burst are still allowed.
+type tokenBucket struct {
+	sync.Mutex
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) set(rate, burst int64) {
+	b.Lock()
+	defer b.Unlock()
+
+	// Buckets start full
+	first := b.last.IsZero()
+	b.refill(time.Now())
+	b.rate = float64(rate)
+	b.burst = float64(burst)
+	if first || b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// reserve takes n tokens and returns how long to wait before using them.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type rateLimiter struct {
+	sync.Mutex
+
+	limit    RateLimit
+	transmit tokenBucket
+	receive  tokenBucket
+}
+
+func (r *rateLimiter) set(limit RateLimit) {
+	r.Lock()
+	r.limit = limit
+	r.Unlock()
+
+	r.transmit.set(limit.Transmit, limit.burst(limit.Transmit))
+	r.receive.set(limit.Receive, limit.burst(limit.Receive))
+}
+
+func (r *rateLimiter) get() RateLimit {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.limit
+}
+
+func (r *rateLimiter) limitsReceive() bool {
+	return r != nil && r.get().Receive > 0
+}
+
+func (r *rateLimiter) waitTransmit(n int, closed <-chan struct{}) bool {
+	return r == nil || wait(r.transmit.reserve(n), closed)
+}
+
+func (r *rateLimiter) waitReceive(n int, closed <-chan struct{}) bool {
+	return r == nil || wait(r.receive.reserve(n), closed)
+}
+
+// wait sleeps for d and returns true, or returns false as soon as closed is closed.
+func wait(d time.Duration, closed <-chan struct{}) bool {
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-closed:
+		return false
+	}
+}
+
+// rateMeter measures throughput over whole seconds.
+type rateMeter struct {
+	sync.Mutex
+
+	second   int64
+	current  int64
+	previous int64
+}
+
+func (m *rateMeter) add(n int) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.advance(time.Now().Unix())
+	m.current += int64(n)
+}
+
+func (m *rateMeter) advance(second int64) {
+	switch {
+	case second == m.second:
+		return
+	case second == m.second+1:
+		m.previous = m.current
+	default:
+		m.previous = 0
+	}
+	m.second = second
+	m.current = 0
+}
+
+// rate returns the bytes counted during the last second.
+func (m *rateMeter) rate() int64 {
+	m.Lock()
+	defer m.Unlock()
+
+	m.advance(time.Now().Unix())
+	return m.previous
+}
+
+// SetClientRateLimit limits the bandwidth of all sessions of clientKey, including the ones
+// already connected. A zero RateLimit removes the limit.
+func (s *Server) SetClientRateLimit(clientKey string, limit RateLimit) {
+	s.sessions.limiter(clientKey).set(limit)
+}
+
+// ClientRateLimit returns the bandwidth limit of clientKey.
+func (s *Server) ClientRateLimit(clientKey string) RateLimit {
+	s.sessions.Lock()
+	limiter := s.sessions.limiters[clientKey]
+	s.sessions.Unlock()
+
+	if limiter == nil {
+		return RateLimit{}
+	}
+	return limiter.get()
+}
+
+// SetRateLimit limits the bandwidth of conn, a connection returned by a tunnel dialer, in
+// addition to the limit of its client. It returns false if conn is not a tunneled connection.
+func SetRateLimit(conn net.Conn, limit RateLimit) bool {
+	c, ok := conn.(*connection)
+	if !ok {
+		return false
+	}
+	c.limiter.set(limit)
+	return true
+}
+
+// waitTransmit waits for the rate limits to allow sending n bytes and counts them, failing if
+// the connection is closed meanwhile.
+func (c *connection) waitTransmit(n int) error {
+	if !c.limiter.waitTransmit(n, c.closed) || !c.session.limiter.waitTransmit(n, c.closed) {
+		return c.closeErr()
+	}
+	c.session.transmitted.add(n)
+	atomic.AddInt64(&c.transmitted, int64(n))
+	return nil
+}
+
+// waitReceive counts n bytes read and waits for the rate limits, failing if the connection is
+// closed meanwhile.
+func (c *connection) waitReceive(n int) error {
+	c.session.received.add(n)
+	atomic.AddInt64(&c.received, int64(n))
+	if !c.limiter.waitReceive(n, c.closed) || !c.session.limiter.waitReceive(n, c.closed) {
+		return c.closeErr()
+	}
+	return nil
+}
+
+// receiveLimited reports whether reads of the connection are paced by a receive limit.
+func (c *connection) receiveLimited() bool {
+	return c.limiter.limitsReceive() || c.session.limiter.limitsReceive()
+}
+
+// limiter returns the rate limiter shared by the sessions of clientKey.
+func (sm *sessionManager) limiter(clientKey string) *rateLimiter {
+	sm.Lock()
+	defer sm.Unlock()
+
+	return sm.getLimiter(clientKey)
+}
+
+func (sm *sessionManager) getLimiter(clientKey string) *rateLimiter {
+	limiter := sm.limiters[clientKey]
+	if limiter == nil {
+		limiter = &rateLimiter{}
+		sm.limiters[clientKey] = limiter
+	}
+	return limiter
+}
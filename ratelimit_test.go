@@ -0,0 +1,204 @@
+package remotedialer
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	if d := b.reserve(1 << 20); d != 0 {
+		t.Fatalf("unlimited bucket waited %v", d)
+	}
+
+	b.set(1000, 100)
+	// Buckets start full
+	if d := b.reserve(100); d != 0 {
+		t.Fatalf("waited %v for the burst", d)
+	}
+	// Larger than the burst, the debt is paid by waiting
+	if d := b.reserve(500); d < 490*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatalf("waited %v for 500 bytes at 1000 bytes/s", d)
+	}
+	// Later callers wait for the debt of earlier ones
+	if d := b.reserve(100); d < 590*time.Millisecond || d > 600*time.Millisecond {
+		t.Fatalf("waited %v after a debt of 500 bytes", d)
+	}
+
+	// Refilling stops at the burst
+	b.set(1000000, 100)
+	time.Sleep(10 * time.Millisecond)
+	if d := b.reserve(100); d != 0 {
+		t.Fatalf("waited %v for a refilled burst", d)
+	}
+	if d := b.reserve(1000); d < 900*time.Microsecond || d > time.Millisecond {
+		t.Fatalf("waited %v beyond the burst", d)
+	}
+
+	// Lowering the burst drops the tokens above it
+	var lowered tokenBucket
+	lowered.set(1000, 1000)
+	lowered.set(1000, 10)
+	if d := lowered.reserve(20); d < 9*time.Millisecond || d > 10*time.Millisecond {
+		t.Fatalf("waited %v with a lowered burst", d)
+	}
+}
+
+func TestWaitInterruptedByClose(t *testing.T) {
+	closed := make(chan struct{})
+	close(closed)
+	if wait(time.Hour, closed) {
+		t.Fatal("wait not interrupted")
+	}
+	if !wait(0, closed) {
+		t.Fatal("wait without delay failed")
+	}
+
+	var r *rateLimiter
+	if !r.waitReceive(1<<20, nil) || !r.waitTransmit(1<<20, nil) || r.limitsReceive() {
+		t.Fatal("nil limiter limits")
+	}
+}
+
+func TestRateMeter(t *testing.T) {
+	var m rateMeter
+	m.advance(10)
+	m.current = 5
+	m.advance(10)
+	if m.current != 5 || m.previous != 0 {
+		t.Fatalf("counted %d, %d within the same second", m.current, m.previous)
+	}
+	m.advance(11)
+	if m.current != 0 || m.previous != 5 {
+		t.Fatalf("counted %d, %d in the next second", m.current, m.previous)
+	}
+	m.current = 7
+	m.advance(13)
+	if m.previous != 0 {
+		t.Fatalf("idle second counted %d", m.previous)
+	}
+}
+
+func TestConnectionMeters(t *testing.T) {
+	echo, closeEcho := listenEcho(t)
+	defer closeEcho()
+	server, url, closeServer := newTestServer()
+	defer closeServer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connectClient(ctx, url, "foo", ClientOptions{})
+	if !waitFor(func() bool { return server.HasSession("foo") }) {
+		t.Fatal("client did not connect")
+	}
+
+	conn, err := server.Dial("foo", 5*time.Second, "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msg := strings.Repeat("hello", 5000)
+	go conn.Write([]byte(msg))
+	if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, _ := server.SessionConnections(clientSessions(server, "foo")[0].sessionKey)
+	if len(infos) != 1 || infos[0].Transmitted != int64(len(msg)) || infos[0].Received != int64(len(msg)) {
+		t.Fatalf("expected %d bytes each way, got %+v", len(msg), infos)
+	}
+}
+
+func TestReceiveOverflow(t *testing.T) {
+	session := &Session{limiter: &rateLimiter{}}
+	conn := &connection{session: session, buf: make(chan []byte, 1)}
+	writer := conn.tunnelWriter()
+
+	// Unpaced connections wait for the reader
+	defer func(timeout time.Duration) { backupTimeout = timeout }(backupTimeout)
+	backupTimeout = 10 * time.Millisecond
+	if _, err := writer.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write([]byte("b")); err == nil || err == errReceiveOverflow {
+		t.Fatalf("expected a backed up reader, got %v", err)
+	}
+
+	// Paced connections overflow without waiting
+	backupTimeout = time.Hour
+	for _, limiter := range []*rateLimiter{&conn.limiter, session.limiter} {
+		limiter.set(RateLimit{Receive: 1})
+		if _, err := writer.Write([]byte("b")); err != errReceiveOverflow {
+			t.Fatalf("expected %v, got %v", errReceiveOverflow, err)
+		}
+		limiter.set(RateLimit{})
+	}
+}
+
+func TestReceiveOverflowFailsConnection(t *testing.T) {
+	echo, closeEcho := listenEcho(t)
+	defer closeEcho()
+	// Writes to whoever connects until they disconnect
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data := make([]byte, MaxRead)
+				for {
+					if _, err := conn.Write(data); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	server, url, closeServer := newTestServer()
+	defer closeServer()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connectClient(ctx, url, "foo", ClientOptions{})
+	if !waitFor(func() bool { return server.HasSession("foo") }) {
+		t.Fatal("client did not connect")
+	}
+
+	conn, err := server.Dial("foo", 5*time.Second, "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	SetRateLimit(conn, RateLimit{Receive: 1000})
+
+	// Not reading fills the buffer of the connection, which fails alone
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	closed := conn.(*connection).closed
+	if !waitFor(func() bool {
+		select {
+		case <-closed:
+			return true
+		default:
+			return false
+		}
+	}) {
+		t.Fatal("connection did not overflow")
+	}
+	if _, err := io.Copy(ioutil.Discard, conn); err != errReceiveOverflow {
+		t.Fatalf("expected %v, got %v", errReceiveOverflow, err)
+	}
+	checkEcho(t, server, "foo", echo)
+}
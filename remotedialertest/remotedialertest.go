@@ -0,0 +1,305 @@
+// Package remotedialertest runs a remotedialer Server and its clients in memory, for tests of
+// code dialing through the tunnel. The clients serve fake destinations instead of dialing the
+// network.
+//
+//	h := remotedialertest.New()
+//	defer h.Close()
+//	client, err := h.Connect("foo")
+//	client.Handle("tcp", "db:5432", remotedialertest.Echo)
+//	conn, err := h.Server.Dial("foo", time.Second, "tcp", "db:5432")
+package remotedialertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rancher/remotedialer"
+)
+
+// clientKeyHeader carries the client key of the clients, accepted as is.
+const clientKeyHeader = "X-API-Tunnel-Test-Client"
+
+// ConnectTimeout is how long Connect waits for the session to be established.
+var ConnectTimeout = 10 * time.Second
+
+var errClosed = errors.New("harness closed")
+
+// Harness is a Server with clients connected over in-memory pipes.
+type Harness struct {
+	// Server is the server under test. Its settings may be changed before clients connect.
+	Server *remotedialer.Server
+	// URL is the websocket URL of the server.
+	URL string
+
+	listener   *memListener
+	httpServer *http.Server
+	lock       sync.Mutex
+	clients    []*Client
+}
+
+// New starts a Server accepting any client key.
+func New() *Harness {
+	h := &Harness{
+		URL:      "ws://remotedialer.test/connect",
+		listener: newMemListener(),
+	}
+	h.Server = remotedialer.New(func(req *http.Request) (string, bool, error) {
+		clientKey := req.Header.Get(clientKeyHeader)
+		return clientKey, clientKey != "", nil
+	}, remotedialer.DefaultErrorWriter)
+	h.httpServer = &http.Server{Handler: h.Server}
+	go h.httpServer.Serve(h.listener)
+	return h
+}
+
+// Connect connects a client with clientKey, returning once its session is established.
+func (h *Harness) Connect(clientKey string) (*Client, error) {
+	return h.ConnectWithOptions(clientKey, remotedialer.ClientOptions{})
+}
+
+// ConnectWithOptions is Connect with client settings. Headers are added to the request, the
+// Dialer and Dial options are replaced by the harness, and Auth allows every destination if
+// nil.
+func (h *Harness) ConnectWithOptions(clientKey string, opts remotedialer.ClientOptions) (*Client, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{
+		ClientKey:    clientKey,
+		destinations: map[string]func(net.Conn){},
+		cancel:       cancel,
+		done:         make(chan struct{}),
+	}
+
+	headers := http.Header{}
+	for k, v := range opts.Headers {
+		headers[k] = v
+	}
+	headers.Set(clientKeyHeader, clientKey)
+	opts.Headers = headers
+	opts.Dialer = &websocket.Dialer{
+		NetDial:          h.listener.dial,
+		HandshakeTimeout: ConnectTimeout,
+	}
+	opts.Dial = c.dial
+	if opts.Auth == nil {
+		opts.Auth = func(string, string) bool { return true }
+	}
+
+	connected := make(chan struct{})
+	onSession := opts.OnSession
+	opts.OnSession = func(session *remotedialer.Session) {
+		c.lock.Lock()
+		c.session = session
+		c.lock.Unlock()
+		if onSession != nil {
+			onSession(session)
+		}
+		close(connected)
+	}
+
+	var err error
+	go func() {
+		defer close(c.done)
+		err = remotedialer.ConnectToProxyWithOptions(ctx, h.URL, opts)
+	}()
+
+	timeout := time.After(ConnectTimeout)
+	select {
+	case <-connected:
+	case <-c.done:
+		if err == nil {
+			err = errors.New("connection closed")
+		}
+		return nil, err
+	case <-timeout:
+		c.Close()
+		return nil, fmt.Errorf("timeout connecting %s", clientKey)
+	}
+
+	// The server registers the session after the websocket handshake completes
+	for !h.Server.HasSession(clientKey) {
+		select {
+		case <-timeout:
+			c.Close()
+			return nil, fmt.Errorf("timeout waiting for the session of %s", clientKey)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	h.lock.Lock()
+	h.clients = append(h.clients, c)
+	h.lock.Unlock()
+	return c, nil
+}
+
+// Close disconnects the clients and stops the server.
+func (h *Harness) Close() {
+	h.lock.Lock()
+	clients := h.clients
+	h.clients = nil
+	h.lock.Unlock()
+
+	for _, c := range clients {
+		c.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	h.Server.Shutdown(ctx)
+	h.httpServer.Close()
+	h.listener.Close()
+}
+
+// Client is a client connected to a Harness, serving the destinations registered with Handle.
+// Dials to other destinations are refused.
+type Client struct {
+	ClientKey string
+
+	lock         sync.Mutex
+	destinations map[string]func(net.Conn)
+	session      *remotedialer.Session
+	cancel       func()
+	done         chan struct{}
+}
+
+// Handle serves the connections to address with serve, which should close the connection
+// when done. A tcp network also matches tcp4 and tcp6, likewise for udp.
+func (c *Client) Handle(network, address string, serve func(conn net.Conn)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.destinations[destination(network, address)] = serve
+}
+
+// HandleHTTP serves HTTP requests to the tcp address with handler.
+func (c *Client) HandleHTTP(address string, handler http.Handler) {
+	c.Handle("tcp", address, func(conn net.Conn) {
+		server := &http.Server{Handler: handler}
+		server.Serve(&connListener{conn: conn})
+	})
+}
+
+// Session returns the session of the client.
+func (c *Client) Session() *remotedialer.Session {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.session
+}
+
+// Close disconnects the client, waiting for its session to end.
+func (c *Client) Close() {
+	c.cancel()
+	<-c.done
+}
+
+func (c *Client) dial(network, address string) (net.Conn, error) {
+	c.lock.Lock()
+	serve := c.destinations[destination(network, address)]
+	c.lock.Unlock()
+
+	if serve == nil {
+		return nil, fmt.Errorf("dial %s %s: connection refused", network, address)
+	}
+
+	client, server := net.Pipe()
+	go serve(server)
+	return client, nil
+}
+
+func destination(network, address string) string {
+	return strings.TrimRight(network, "46") + "://" + address
+}
+
+// Echo is a destination writing back what it reads.
+func Echo(conn net.Conn) {
+	defer conn.Close()
+	io.Copy(conn, conn)
+}
+
+// Discard is a destination reading and dropping what it reads.
+func Discard(conn net.Conn) {
+	defer conn.Close()
+	io.Copy(ioutil.Discard, conn)
+}
+
+type memAddr struct{}
+
+func (memAddr) Network() string { return "memory" }
+func (memAddr) String() string  { return "remotedialer.test" }
+
+// memListener accepts the connections of its dial function.
+type memListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newMemListener() *memListener {
+	return &memListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *memListener) dial(network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, errClosed
+	}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return memAddr{}
+}
+
+// connListener accepts a single connection, so that an http.Server serves it.
+type connListener struct {
+	conn net.Conn
+	once sync.Once
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() {
+		conn = l.conn
+	})
+	if conn != nil {
+		return conn, nil
+	}
+	return nil, io.EOF
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
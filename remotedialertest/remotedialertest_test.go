@@ -0,0 +1,140 @@
+package remotedialertest
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rancher/remotedialer"
+)
+
+func TestHandleEcho(t *testing.T) {
+	h := New()
+	defer h.Close()
+
+	client, err := h.Connect("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Handle("tcp", "db:5432", Echo)
+
+	// tcp4 matches the tcp destination
+	conn, err := h.Server.Dial("foo", time.Second, "tcp4", "db:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read %q: %v", buf, err)
+	}
+	if n := len(client.Session().Connections()); n != 1 {
+		t.Fatalf("client has %d connections, expected 1", n)
+	}
+}
+
+func TestHandleHTTP(t *testing.T) {
+	h := New()
+	defer h.Close()
+
+	client, err := h.Connect("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.HandleHTTP("web:80", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("hello " + req.URL.Path))
+	}))
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{Dial: h.Server.Dialer("foo", time.Second)},
+	}
+	for i := 0; i < 3; i++ {
+		resp, err := httpClient.Get("http://web:80/x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello /x" {
+			t.Fatalf("got %q", body)
+		}
+	}
+}
+
+func TestUnknownDestinationRefused(t *testing.T) {
+	h := New()
+	defer h.Close()
+
+	if _, err := h.Connect("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The dial succeeds once the client is asked to connect, the refusal closes the connection
+	conn, err := h.Server.Dial("foo", time.Second, "tcp", "unknown:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read from a refused destination")
+	}
+}
+
+func TestDeniedByAuth(t *testing.T) {
+	h := New()
+	defer h.Close()
+
+	denied := make(chan string, 1)
+	client, err := h.ConnectWithOptions("foo", remotedialer.ClientOptions{
+		Auth: func(string, string) bool { return false },
+		OnDenied: func(network, address string, reason error) {
+			denied <- network + "://" + address
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Handle("tcp", "db:5432", Echo)
+
+	conn, err := h.Server.Dial("foo", time.Second, "tcp", "db:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read from a denied destination")
+	}
+
+	select {
+	case got := <-denied:
+		if got != "tcp://db:5432" {
+			t.Fatalf("denied %s", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnDenied was not called")
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	h := New()
+	defer h.Close()
+
+	client, err := h.Connect("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	for deadline := time.Now().Add(5 * time.Second); h.Server.HasSession("foo"); {
+		if time.Now().After(deadline) {
+			t.Fatal("session still registered after the client closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
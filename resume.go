@@ -0,0 +1,353 @@
+package remotedialer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ResumeToken is sent by a resuming client with the token of its previous session, or
+	// "new", and returned by the server with the token for the session.
+	ResumeToken = "X-API-Tunnel-Resume-Token"
+
+	// ResumeBufferSize is the number of sent bytes kept per connection to replay after the
+	// websocket is reconnected.
+	ResumeBufferSize = 1024 * 1024
+
+	errResumeBufferFull = errors.New("resume buffer full")
+	errResumeGap        = errors.New("data lost while reconnecting")
+)
+
+// ClientResume keeps a client Session across reconnects so tunneled connections survive a
+// dropped websocket. Pass the same ClientResume to every ClientConnectWithOptions call.
+type ClientResume struct {
+	sync.Mutex
+
+	session *Session
+	token   string
+}
+
+func NewClientResume() *ClientResume {
+	return &ClientResume{}
+}
+
+func (r *ClientResume) headerToken() string {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.token == "" {
+		return "new"
+	}
+	return r.token
+}
+
+// sessionFor resumes the previous session if the server accepted its token, or else starts a
+// new one and passes it to configure.
+func (r *ClientResume) sessionFor(auth ConnectAuthorizer, ws *websocket.Conn, resp *http.Response, configure func(*Session)) (*Session, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	token := resp.Header.Get(ResumeToken)
+	if r.session != nil && token != "" && token == r.token {
+		logrus.Info("Resuming proxy session")
+		r.session.auth = auth
+		if err := r.session.attach(ws); err != nil {
+			return nil, err
+		}
+		return r.session, nil
+	}
+
+	if r.session != nil {
+		r.session.Close()
+	}
+
+	r.session = NewClientSession(auth, ws)
+	r.session.resumeToken = token
+	configure(r.session)
+	r.token = token
+	return r.session, nil
+}
+
+// detach keeps the session for the next connection attempt, unless ctx is done.
+func (r *ClientResume) detach(ctx context.Context) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.session == nil {
+		return
+	}
+
+	if ctx.Err() != nil || !r.session.resumable() {
+		r.session.Close()
+		r.session = nil
+		r.token = ""
+		return
+	}
+
+	r.session.pause()
+}
+
+// replayBuffer numbers the Data messages of a connection on a resumable session and keeps the
+// most recent ones to send again after the websocket is reconnected.
+type replayBuffer struct {
+	sync.Mutex
+
+	paused   bool
+	sendSeq  int64
+	recvSeq  int64
+	size     int
+	messages []*message
+}
+
+func newResumeToken() string {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(bytes)
+}
+
+func (r *replayBuffer) write(conn *connection, msg *message) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	// The caller may reuse its buffer, keep a copy to replay
+	msg.bytes = append([]byte(nil), msg.bytes...)
+	msg.extended = true
+	r.sendSeq++
+	msg.seq = r.sendSeq
+
+	r.messages = append(r.messages, msg)
+	r.size += len(msg.bytes)
+	for r.size > ResumeBufferSize && len(r.messages) > 1 {
+		if r.paused {
+			r.sendSeq--
+			r.messages = r.messages[:len(r.messages)-1]
+			r.size -= len(msg.bytes)
+			return 0, errResumeBufferFull
+		}
+		r.size -= len(r.messages[0].bytes)
+		r.messages = r.messages[1:]
+	}
+
+	if r.paused {
+		return len(msg.bytes), nil
+	}
+
+	n, err := conn.session.writeMessageOn(conn.getStripe(), msg)
+	if err != nil && !conn.session.isClosed() {
+		// Replayed once the session is resumed
+		return len(msg.bytes), nil
+	}
+	return n, err
+}
+
+// received records an incoming sequence number and returns false for duplicates.
+func (r *replayBuffer) received(seq int64) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if seq <= r.recvSeq {
+		return false
+	}
+	r.recvSeq = seq
+	return true
+}
+
+func (r *replayBuffer) lastReceived() int64 {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.recvSeq
+}
+
+func (r *replayBuffer) pause() {
+	r.Lock()
+	r.paused = true
+	r.Unlock()
+}
+
+func (r *replayBuffer) isPaused() bool {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.paused
+}
+
+// resume sends the messages the remote side has not received yet and unpauses writes.
+func (r *replayBuffer) resume(conn *connection, lastSeq int64) error {
+	r.Lock()
+	defer r.Unlock()
+
+	for len(r.messages) > 0 && r.messages[0].seq <= lastSeq {
+		r.size -= len(r.messages[0].bytes)
+		r.messages = r.messages[1:]
+	}
+
+	if len(r.messages) == 0 && r.sendSeq != lastSeq {
+		return errResumeGap
+	}
+	if len(r.messages) > 0 && r.messages[0].seq != lastSeq+1 {
+		return errResumeGap
+	}
+
+	for _, msg := range r.messages {
+		if _, err := conn.session.writeMessageOn(conn.getStripe(), msg); err != nil {
+			return err
+		}
+	}
+
+	r.paused = false
+	return nil
+}
+
+func (s *Session) resumable() bool {
+	return s.resumeToken != ""
+}
+
+func (s *Session) isClosed() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.closed
+}
+
+// pause stops tunneled connections from writing to the broken websocket, buffering their
+// data until the session is resumed.
+func (s *Session) pause() {
+	s.Lock()
+	s.detached = true
+	replays := s.replays()
+	s.Unlock()
+
+	// Writers hold their replay buffer's lock while checking the session, so don't hold the
+	// session's lock while taking it
+	for _, replay := range replays {
+		replay.pause()
+	}
+}
+
+func (s *Session) replays() map[int64]*replayBuffer {
+	replays := map[int64]*replayBuffer{}
+	for connID, conn := range s.conns {
+		if conn.replay != nil {
+			replays[connID] = conn.replay
+		}
+	}
+	return replays
+}
+
+// attach replaces the websocket of a resumed session and tells the remote side the last Data
+// received on each connection, followed by a Resume for connection 0 to mark the end.
+func (s *Session) attach(ws *websocket.Conn) error {
+	s.pause()
+
+	s.connLock.Lock()
+	s.conn = newWSConn(ws)
+	s.connLock.Unlock()
+
+	s.Lock()
+	s.detached = false
+	conns := make([]*connection, 0, len(s.conns))
+	for _, conn := range s.conns {
+		// Other websockets of a striped session are reconnected separately, replay on
+		// the primary one
+		conn.setStripe(0)
+		conns = append(conns, conn)
+	}
+	s.Unlock()
+
+	for _, conn := range conns {
+		if conn.replay == nil {
+			continue
+		}
+		if _, err := s.writeMessage(newResume(conn.connID, conn.replay.lastReceived())); err != nil {
+			return err
+		}
+	}
+
+	_, err := s.writeMessage(newResume(0, 0))
+	return err
+}
+
+func (s *Session) serveResume(message *message) {
+	if message.connID == 0 {
+		// The remote side has sent all its connections, the ones still paused are gone
+		s.Lock()
+		replays := s.replays()
+		s.Unlock()
+
+		var lost []int64
+		for connID, replay := range replays {
+			if replay.isPaused() {
+				lost = append(lost, connID)
+			}
+		}
+
+		for _, connID := range lost {
+			s.closeConnection(connID, errResumeGap)
+		}
+		return
+	}
+
+	s.Lock()
+	conn := s.conns[message.connID]
+	s.Unlock()
+
+	if conn == nil || conn.replay == nil {
+		err := fmt.Errorf("connection not found %s/%d/%d", s.clientKey, s.sessionKey, message.connID)
+		s.writeMessage(newErrorMessage(message.connID, err))
+		return
+	}
+
+	if err := conn.replay.resume(conn, message.seq); err != nil {
+		logrus.Debugf("Failed to resume connection %s/%d/%d: %v", s.clientKey, s.sessionKey, message.connID, err)
+		s.closeConnection(message.connID, err)
+	}
+}
+
+// resume returns the session for token so a reconnecting client can take it over.
+func (sm *sessionManager) resume(clientKey, token string) *Session {
+	sm.Lock()
+	defer sm.Unlock()
+
+	session := sm.resumable[token]
+	if session == nil || session.clientKey != clientKey {
+		return nil
+	}
+	return session
+}
+
+// detach keeps a resumable session whose websocket ws failed for gracePeriod, returning false
+// if the session should be removed now.
+func (sm *sessionManager) detach(session *Session, ws *websocket.Conn, gracePeriod time.Duration) bool {
+	if !session.resumable() || gracePeriod <= 0 {
+		return false
+	}
+
+	if session.getConn().conn != ws {
+		// Already resumed on a new websocket
+		return true
+	}
+
+	logrus.Infof("Waiting %v for backend [%s] to resume", gracePeriod, session.clientKey)
+	session.pause()
+	time.AfterFunc(gracePeriod, func() {
+		session.Lock()
+		expired := session.detached && session.getConn().conn == ws
+		session.Unlock()
+		if expired {
+			sm.remove(session)
+		}
+	})
+	return true
+}
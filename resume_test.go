@@ -0,0 +1,49 @@
+package remotedialer
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResumeAfterWebsocketLoss(t *testing.T) {
+	echo, closeEcho := listenEcho(t)
+	defer closeEcho()
+	server, url, closeServer := newTestServer()
+	defer closeServer()
+	server.ResumeGracePeriod = 30 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connectClient(ctx, url, "foo", ClientOptions{Resume: NewClientResume()})
+	if !waitFor(func() bool { return server.HasSession("foo") }) {
+		t.Fatal("client did not connect")
+	}
+
+	conn, err := server.Dial("foo", 5*time.Second, "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msg := strings.Repeat("hello", 5000)
+	buf := make([]byte, len(msg))
+	go conn.Write([]byte(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+		t.Fatal("echo mismatch before the reconnect", err)
+	}
+
+	session := clientSessions(server, "foo")[0]
+	session.getConn().conn.Close()
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	go conn.Write([]byte(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+		t.Fatal("echo mismatch after the reconnect", err)
+	}
+	if sessions := clientSessions(server, "foo"); len(sessions) != 1 || sessions[0] != session {
+		t.Fatal("session was not resumed")
+	}
+}
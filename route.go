@@ -0,0 +1,173 @@
+package remotedialer
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// route is how a client session connected to another server is reached through a peer
+// session. path lists the servers the dial passes through, starting with the peer.
+type route struct {
+	hops int
+	path []string
+}
+
+func (r route) through(id string) bool {
+	for _, p := range r.path {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeRoute formats an AddClient or RemoveClient address. Routes to the advertising server's
+// own clients use the plain "clientKey/sessionKey" form, relayed routes append the hop count
+// and path on separate lines. A relayed route with no hops withdraws the relayed route only.
+func encodeRoute(clientKey string, sessionKey int, r *route) string {
+	client := fmt.Sprintf("%s/%d", clientKey, sessionKey)
+	if r == nil {
+		return client
+	}
+	return fmt.Sprintf("%s\n%d\n%s", client, r.hops, strings.Join(r.path, ","))
+}
+
+// parseRoute parses an AddClient or RemoveClient address as sent by a peer with ID peerID.
+func parseRoute(peerID, address string) (string, int, route, error) {
+	parts := strings.SplitN(address, "\n", 3)
+
+	clientKey, sessionKey, err := parseAddress(parts[0])
+	if err != nil {
+		return "", 0, route{}, err
+	}
+
+	if len(parts) == 1 {
+		return clientKey, sessionKey, route{
+			hops: 1,
+			path: []string{peerID},
+		}, nil
+	}
+
+	if len(parts) != 3 {
+		return "", 0, route{}, fmt.Errorf("invalid route")
+	}
+
+	hops, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, route{}, err
+	}
+
+	return clientKey, sessionKey, route{
+		hops: hops,
+		path: strings.Split(parts[2], ","),
+	}, nil
+}
+
+// forwardedNetwork encodes the client key and remaining hop budget into the network of a
+// Connect sent to a peer. The client key is escaped as it may contain "/" or "::".
+func forwardedNetwork(clientKey, proto string, ttl int) string {
+	return fmt.Sprintf("%s::%s::%d", url.QueryEscape(clientKey), proto, ttl)
+}
+
+func parseForwardedNetwork(network string) (string, string, int, error) {
+	parts := strings.SplitN(network, "::", 3)
+	switch len(parts) {
+	case 2:
+		return parts[0], parts[1], MaxPeerHops - 1, nil
+	case 3:
+		clientKey, err := url.QueryUnescape(parts[0])
+		if err != nil {
+			return "", "", 0, fmt.Errorf("invalid clientKey: %s", network)
+		}
+		ttl, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return "", "", 0, fmt.Errorf("invalid hop limit: %s", network)
+		}
+		return clientKey, parts[1], ttl, nil
+	}
+	return "", "", 0, fmt.Errorf("invalid clientKey/proto: %s", network)
+}
+
+// routesUpdated is called on outbound peer sessions when the routes to a remote client change,
+// and advertises the shortest route that doesn't loop back to the peer.
+func (s *Session) routesUpdated(clientKey string, sessionKey int, routes []route) {
+	if !s.peerRouting {
+		// The peer only understands routes to our own clients
+		return
+	}
+
+	var best *route
+	for i, r := range routes {
+		if r.hops >= MaxPeerHops || r.through(s.remotePeerID) || r.through(s.localPeerID) {
+			continue
+		}
+		if best == nil || r.hops < best.hops {
+			best = &routes[i]
+		}
+	}
+
+	client := fmt.Sprintf("%s/%d", clientKey, sessionKey)
+	advertisement := ""
+	if best != nil {
+		advertisement = encodeRoute(clientKey, sessionKey, &route{
+			hops: best.hops + 1,
+			path: append([]string{s.localPeerID}, best.path...),
+		})
+	}
+
+	s.Lock()
+	if s.advertised == nil {
+		s.advertised = map[string]string{}
+	}
+	previous := s.advertised[client]
+	if advertisement == "" {
+		delete(s.advertised, client)
+	} else {
+		s.advertised[client] = advertisement
+	}
+	s.Unlock()
+
+	if previous == advertisement {
+		return
+	}
+
+	var err error
+	if advertisement == "" {
+		_, err = s.writeMessage(newRemoveClient(encodeRoute(clientKey, sessionKey, &route{})))
+	} else {
+		_, err = s.writeMessage(newAddClient(advertisement))
+	}
+	if err != nil {
+		s.getConn().conn.Close()
+	}
+}
+
+func (sm *sessionManager) routes(clientKey string, sessionKey int) []route {
+	var result []route
+	for _, sessions := range sm.peers {
+		for _, session := range sessions {
+			session.Lock()
+			if r, ok := session.remoteClientKeys[clientKey][sessionKey]; ok {
+				result = append(result, r)
+			}
+			session.Unlock()
+		}
+	}
+	return result
+}
+
+func (sm *sessionManager) routeUpdated(clientKey string, sessionKey int) {
+	sm.Lock()
+	defer sm.Unlock()
+
+	sm.notifyRoutes(clientKey, sessionKey)
+}
+
+func (sm *sessionManager) notifyRoutes(clientKey string, sessionKey int) {
+	routes := sm.routes(clientKey, sessionKey)
+	for l := range sm.listeners {
+		l.routesUpdated(clientKey, sessionKey, routes)
+	}
+}
@@ -0,0 +1,156 @@
+package remotedialer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteEncoding(t *testing.T) {
+	clientKey, sessionKey, r, err := parseRoute("b", encodeRoute("spiffe://x/foo", 3, nil))
+	if err != nil || clientKey != "spiffe://x/foo" || sessionKey != 3 {
+		t.Fatalf("direct route parsed as %s/%d: %v", clientKey, sessionKey, err)
+	}
+	if !reflect.DeepEqual(r, route{hops: 1, path: []string{"b"}}) {
+		t.Fatalf("direct route parsed as %+v", r)
+	}
+
+	relayed := route{hops: 3, path: []string{"b", "c", "d"}}
+	_, _, r, err = parseRoute("b", encodeRoute("foo", 3, &relayed))
+	if err != nil || !reflect.DeepEqual(r, relayed) {
+		t.Fatalf("relayed route parsed as %+v: %v", r, err)
+	}
+
+	for _, invalid := range []string{"foo", "foo/x", "foo/1\n2", "foo/1\nx\nb"} {
+		if _, _, _, err := parseRoute("b", invalid); err == nil {
+			t.Errorf("invalid route %q parsed", invalid)
+		}
+	}
+}
+
+func TestForwardedNetwork(t *testing.T) {
+	clientKey, proto, ttl, err := parseForwardedNetwork(forwardedNetwork("spiffe://x/a::b", "tcp", 5))
+	if err != nil || clientKey != "spiffe://x/a::b" || proto != "tcp" || ttl != 5 {
+		t.Fatalf("parsed %s, %s, %d: %v", clientKey, proto, ttl, err)
+	}
+
+	// Peers before the hop limit send the client key unescaped with no limit
+	clientKey, proto, ttl, err = parseForwardedNetwork("foo::udp")
+	if err != nil || clientKey != "foo" || proto != "udp" || ttl != MaxPeerHops-1 {
+		t.Fatalf("old format parsed as %s, %s, %d: %v", clientKey, proto, ttl, err)
+	}
+
+	for _, invalid := range []string{"tcp", "foo::tcp::x", "%zz::tcp::1"} {
+		if _, _, _, err := parseForwardedNetwork(invalid); err == nil {
+			t.Errorf("invalid network %q parsed", invalid)
+		}
+	}
+}
+
+func TestRemoteClientLoops(t *testing.T) {
+	session := &Session{
+		clientKey:        "b",
+		localPeerID:      "a",
+		remoteClientKeys: map[string]map[int]route{},
+	}
+
+	add := func(r route) bool {
+		if _, _, err := session.addRemoteClient(encodeRoute("foo", 1, &r)); err != nil {
+			t.Fatal(err)
+		}
+		_, ok := session.remoteClientKeys["foo"][1]
+		return ok
+	}
+
+	if add(route{hops: 2, path: []string{"b", "a"}}) {
+		t.Fatal("route through the local server added")
+	}
+	if !add(route{hops: 2, path: []string{"b", "c"}}) {
+		t.Fatal("route rejected")
+	}
+	path := make([]string, MaxPeerHops+1)
+	for i := range path {
+		path[i] = "x"
+	}
+	if add(route{hops: MaxPeerHops + 1, path: path}) {
+		t.Fatal("route past MaxPeerHops added")
+	}
+	if _, ok := session.remoteClientKeys["foo"]; ok {
+		t.Fatal("previous route kept after a route past MaxPeerHops")
+	}
+}
+
+func TestHopLimit(t *testing.T) {
+	sm := newSessionManager()
+	peer := &Session{
+		clientKey: "b",
+		remoteClientKeys: map[string]map[int]route{
+			"foo": {1: {hops: 1, path: []string{"b"}}},
+		},
+	}
+	sm.peers["b"] = []*Session{peer}
+
+	if _, err := sm.getDialerTTL("foo", time.Second, 0, ""); err == nil {
+		t.Fatal("dial forwarded with no hops left")
+	}
+	if d, err := sm.getDialerTTL("foo", time.Second, 1, ""); err != nil || d == nil {
+		t.Fatalf("dial not forwarded: %v", err)
+	}
+}
+
+func newPeerServer(id string) (*Server, string, func()) {
+	server := New(func(req *http.Request) (string, bool, error) {
+		clientKey := req.Header.Get(clientKeyHeader)
+		return clientKey, clientKey != "", nil
+	}, DefaultErrorWriter)
+	server.PeerID = id
+	server.PeerToken = id + "-token"
+	hs := httptest.NewServer(server)
+	return server, "ws" + strings.TrimPrefix(hs.URL, "http"), hs.Close
+}
+
+func TestMultiHopWithLoop(t *testing.T) {
+	echo, closeEcho := listenEcho(t)
+	defer closeEcho()
+
+	servers := map[string]*Server{}
+	urls := map[string]string{}
+	for _, id := range []string{"a", "b", "c", "d"} {
+		server, url, closeServer := newPeerServer(id)
+		defer closeServer()
+		servers[id], urls[id] = server, url
+	}
+	// a-b-c-d and back to a
+	for _, link := range [][2]string{{"a", "b"}, {"b", "c"}, {"c", "d"}, {"d", "a"}} {
+		x, y := link[0], link[1]
+		servers[x].AddPeer(urls[y], y, y+"-token")
+		servers[y].AddPeer(urls[x], x, x+"-token")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	connectClient(ctx, urls["a"], "foo", ClientOptions{})
+	if !waitFor(func() bool { return servers["c"].HasSession("foo") }) {
+		cancel()
+		t.Fatal("client not reachable two hops away")
+	}
+	for _, id := range []string{"b", "c", "d"} {
+		checkEcho(t, servers[id], "foo", echo)
+	}
+
+	// No route survives by looping around once the client is gone
+	cancel()
+	if !waitFor(func() bool {
+		for _, server := range servers {
+			if server.HasSession("foo") {
+				return false
+			}
+		}
+		return true
+	}) {
+		t.Fatal("routes to the client left after it disconnected")
+	}
+}
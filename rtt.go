@@ -0,0 +1,68 @@
+package remotedialer
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// rttStats smooths round trip times like TCP does, with the jitter being the mean deviation.
+type rttStats struct {
+	sync.Mutex
+
+	rtt    time.Duration
+	jitter time.Duration
+	last   time.Time
+}
+
+func (r *rttStats) add(sample time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.last.IsZero() {
+		r.rtt = sample
+		r.jitter = sample / 2
+	} else {
+		diff := r.rtt - sample
+		if diff < 0 {
+			diff = -diff
+		}
+		r.jitter = (3*r.jitter + diff) / 4
+		r.rtt = (7*r.rtt + sample) / 8
+	}
+	r.last = time.Now()
+}
+
+func (r *rttStats) get() (time.Duration, time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.rtt, r.jitter
+}
+
+// pingPayload timestamps a ping so the pong echoing it gives the round trip time.
+func pingPayload(now time.Time) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(now.UnixNano()))
+	return buf
+}
+
+// pongRTT returns the round trip time of a pong, or false if its payload isn't a timestamp,
+// such as the empty pongs of older versions.
+func pongRTT(payload string, now time.Time) (time.Duration, bool) {
+	if len(payload) != 8 {
+		return 0, false
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64([]byte(payload))))
+	rtt := now.Sub(sent)
+	if rtt < 0 || rtt > PingWaitDuration {
+		return 0, false
+	}
+	return rtt, true
+}
+
+// RTT returns the smoothed round trip time of the session's websocket and its jitter, measured
+// with pings. Both are zero until the first pong.
+func (s *Session) RTT() (rtt, jitter time.Duration) {
+	return s.getConn().rtt.get()
+}
@@ -0,0 +1,191 @@
+package remotedialer
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// Priority is the scheduling class of a tunneled connection. When several connections are
+// writing to the same websocket each class gets a share of it proportional to its weight, and
+// connections of the same class take turns.
+type Priority int32
+
+const (
+	PriorityNormal Priority = iota
+	// PriorityHigh is meant for interactive connections, such as shells.
+	PriorityHigh
+	// PriorityLow is meant for bulk transfers.
+	PriorityLow
+
+	numPriorities = 3
+)
+
+// priorityWeights is the number of MaxRead sized messages each class may send per round.
+var priorityWeights = [numPriorities]int{
+	PriorityNormal: 2,
+	PriorityHigh:   4,
+	PriorityLow:    1,
+}
+
+// PriorityFunc returns the Priority of a tunneled connection to address.
+type PriorityFunc func(proto, address string) Priority
+
+// SetPriority sets the Priority of conn, a connection returned by a tunnel dialer. It returns
+// false if conn is not a tunneled connection.
+func SetPriority(conn net.Conn, priority Priority) bool {
+	c, ok := conn.(*connection)
+	if !ok {
+		return false
+	}
+	c.setPriority(priority)
+	return true
+}
+
+func (c *connection) getPriority() Priority {
+	return Priority(atomic.LoadInt32((*int32)(&c.priority)))
+}
+
+func (c *connection) setPriority(priority Priority) {
+	if priority < 0 || priority >= numPriorities {
+		priority = PriorityNormal
+	}
+	atomic.StoreInt32((*int32)(&c.priority), int32(priority))
+}
+
+type pendingWrite struct {
+	data []byte
+	done chan error
+}
+
+// connQueue holds the pending messages of one connection, kept in order.
+type connQueue struct {
+	connID int64
+	writes []*pendingWrite
+}
+
+// priorityClass round-robins between the connections of one Priority with messages pending.
+type priorityClass struct {
+	queues  []*connQueue
+	deficit int
+}
+
+// writeScheduler orders the messages written to a websocket. Messages not tied to a connection
+// go first, then the classes are served by deficit round-robin.
+type writeScheduler struct {
+	sync.Mutex
+
+	control []*pendingWrite
+	byConn  map[int64]*connQueue
+	classes [numPriorities]priorityClass
+	current int
+	visited bool
+	writing bool
+}
+
+func (s *writeScheduler) push(connID int64, priority Priority, write *pendingWrite) {
+	if connID == 0 {
+		s.control = append(s.control, write)
+		return
+	}
+
+	if s.byConn == nil {
+		s.byConn = map[int64]*connQueue{}
+	}
+
+	// A connection keeps its class until its queue drains so its messages stay in order
+	queue := s.byConn[connID]
+	if queue == nil {
+		queue = &connQueue{
+			connID: connID,
+		}
+		s.byConn[connID] = queue
+		class := &s.classes[priority]
+		class.queues = append(class.queues, queue)
+	}
+	queue.writes = append(queue.writes, write)
+}
+
+func (s *writeScheduler) pop() *pendingWrite {
+	if len(s.control) > 0 {
+		write := s.control[0]
+		s.control = s.control[1:]
+		return write
+	}
+
+	if len(s.byConn) == 0 {
+		return nil
+	}
+
+	for {
+		class := &s.classes[s.current]
+		if len(class.queues) == 0 {
+			class.deficit = 0
+			s.next()
+			continue
+		}
+
+		if !s.visited {
+			class.deficit += priorityWeights[s.current] * MaxRead
+			s.visited = true
+		}
+
+		queue := class.queues[0]
+		write := queue.writes[0]
+		if len(write.data) > class.deficit {
+			s.next()
+			continue
+		}
+		class.deficit -= len(write.data)
+
+		queue.writes = queue.writes[1:]
+		class.queues = class.queues[1:]
+		if len(queue.writes) > 0 {
+			class.queues = append(class.queues, queue)
+		} else {
+			delete(s.byConn, queue.connID)
+		}
+		return write
+	}
+}
+
+func (s *writeScheduler) next() {
+	s.current = (s.current + 1) % numPriorities
+	s.visited = false
+}
+
+// write queues data for connID and waits until it is written. The first writer starts a
+// goroutine that writes queued messages until there are none left.
+func (w *wsConn) write(connID int64, priority Priority, data []byte) error {
+	write := &pendingWrite{
+		data: data,
+		done: make(chan error, 1),
+	}
+
+	w.scheduler.Lock()
+	w.scheduler.push(connID, priority, write)
+	if !w.scheduler.writing {
+		w.scheduler.writing = true
+		go w.writeQueued()
+	}
+	w.scheduler.Unlock()
+
+	return <-write.done
+}
+
+func (w *wsConn) writeQueued() {
+	for {
+		w.scheduler.Lock()
+		write := w.scheduler.pop()
+		if write == nil {
+			w.scheduler.writing = false
+			w.scheduler.Unlock()
+			return
+		}
+		w.scheduler.Unlock()
+
+		write.done <- w.WriteMessage(websocket.BinaryMessage, write.data)
+	}
+}
@@ -0,0 +1,98 @@
+package remotedialer
+
+import "testing"
+
+// popConnIDs pops n writes and returns the connection each was pushed for.
+func popConnIDs(t *testing.T, s *writeScheduler, connIDs map[*pendingWrite]int64, n int) []int64 {
+	var result []int64
+	for i := 0; i < n; i++ {
+		write := s.pop()
+		if write == nil {
+			t.Fatalf("scheduler empty after %d writes", i)
+		}
+		result = append(result, connIDs[write])
+	}
+	return result
+}
+
+func TestSchedulerBulkDoesNotStarveInteractive(t *testing.T) {
+	s := &writeScheduler{}
+	connIDs := map[*pendingWrite]int64{}
+	push := func(connID int64, priority Priority, count, size int) {
+		for i := 0; i < count; i++ {
+			write := &pendingWrite{data: make([]byte, size)}
+			connIDs[write] = connID
+			s.push(connID, priority, write)
+		}
+	}
+
+	// Bulk transfers queue far more than the interactive connection
+	push(1, PriorityLow, 100, MaxRead)
+	push(2, PriorityNormal, 100, MaxRead)
+	push(3, PriorityHigh, 10, 16)
+	push(0, PriorityNormal, 1, 16)
+
+	order := popConnIDs(t, s, connIDs, 20)
+	if order[0] != 0 {
+		t.Fatalf("control message not written first: %v", order)
+	}
+	interactive := 0
+	for _, connID := range order {
+		if connID == 3 {
+			interactive++
+		}
+	}
+	if interactive != 10 {
+		t.Fatalf("interactive writes starved by bulk transfers: %v", order)
+	}
+
+	// The remaining classes share the websocket by weight
+	counts := map[int64]int{}
+	for _, connID := range popConnIDs(t, s, connIDs, 60) {
+		counts[connID]++
+	}
+	if counts[2] != 40 || counts[1] != 20 {
+		t.Fatalf("expected normal and low priority writes 2:1, got %v", counts)
+	}
+}
+
+func TestSchedulerRoundRobinWithinClass(t *testing.T) {
+	s := &writeScheduler{}
+	connIDs := map[*pendingWrite]int64{}
+	for i := 0; i < 3; i++ {
+		for _, connID := range []int64{1, 2} {
+			write := &pendingWrite{data: make([]byte, MaxRead)}
+			connIDs[write] = connID
+			s.push(connID, PriorityLow, write)
+		}
+	}
+
+	order := popConnIDs(t, s, connIDs, 6)
+	for i, connID := range order {
+		if connID != int64(i%2+1) {
+			t.Fatalf("connections of a class don't take turns: %v", order)
+		}
+	}
+	if s.pop() != nil {
+		t.Fatal("scheduler not empty")
+	}
+	if len(s.byConn) != 0 {
+		t.Fatal("drained queues not removed")
+	}
+}
+
+func TestSchedulerKeepsConnectionOrder(t *testing.T) {
+	s := &writeScheduler{}
+	var writes []*pendingWrite
+	for i := 0; i < 10; i++ {
+		write := &pendingWrite{data: make([]byte, i+1)}
+		writes = append(writes, write)
+		// A priority change while messages are queued doesn't reorder them
+		s.push(1, Priority(i%numPriorities), write)
+	}
+	for i, expected := range writes {
+		if write := s.pop(); write != expected {
+			t.Fatalf("write %d out of order", i)
+		}
+	}
+}
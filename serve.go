@@ -0,0 +1,175 @@
+package remotedialer
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// PingStrategy keeps a websocket alive by calling ping until ctx is done.
+type PingStrategy func(ctx context.Context, ping func() error)
+
+// IntervalPings pings every interval.
+func IntervalPings(interval time.Duration) PingStrategy {
+	return func(ctx context.Context, ping func() error) {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := ping(); err != nil {
+					logrus.WithError(err).Error("Error writing ping")
+				}
+				logrus.Debug("Wrote ping")
+			}
+		}
+	}
+}
+
+// NoPings only answers the pings of the remote side.
+func NoPings(ctx context.Context, ping func() error) {}
+
+// ServeOptions configures Session.ServeWithOptions.
+type ServeOptions struct {
+	// Pings is IntervalPings(PingWriteInterval) by default.
+	Pings PingStrategy
+	// PongWait is how long to wait for a ping or pong before the websocket is considered dead,
+	// PongWaitDuration with the default Pings or else PingWaitDuration, as other strategies may
+	// ping rarely or not at all.
+	PongWait time.Duration
+}
+
+func (o ServeOptions) pings() PingStrategy {
+	if o.Pings == nil {
+		return IntervalPings(PingWriteInterval)
+	}
+	return o.Pings
+}
+
+func (o ServeOptions) pongWait() time.Duration {
+	if o.PongWait > 0 {
+		return o.PongWait
+	}
+	if o.Pings == nil {
+		return PongWaitDuration
+	}
+	return PingWaitDuration
+}
+
+// Serve reads messages from the websocket until it fails or ctx is done, pinging it with the
+// default ServeOptions. It returns 0 and a nil error once ctx is done or the remote side closed
+// the websocket cleanly; earlier versions returned 400 and the read error then.
+func (s *Session) Serve(ctx context.Context) (int, error) {
+	return s.ServeWithOptions(ctx, ServeOptions{})
+}
+
+// ServeWhileWindows serves the session like Serve. It used to be the serve loop for Windows,
+// which had its own ping and read deadline handling.
+//
+// Deprecated: use Serve, which works on every platform.
+func (s *Session) ServeWhileWindows(ctx context.Context) (int, error) {
+	return s.Serve(ctx)
+}
+
+// ServeWithOptions reads messages from the websocket until it fails or ctx is done. When ctx is
+// done the websocket is closed cleanly, and 0 and nil are returned then or if the remote side
+// closed it cleanly.
+func (s *Session) ServeWithOptions(ctx context.Context, opts ServeOptions) (int, error) {
+	stopPings := s.startPings(ctx, opts)
+	defer stopPings()
+
+	return s.serveConn(ctx, s.getConn(), 0, opts)
+}
+
+func (s *Session) serveConn(ctx context.Context, conn *wsConn, stripe int64, opts ServeOptions) (int, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Unblocks NextReader
+			conn.closeNormal()
+		case <-done:
+		}
+	}()
+
+	for {
+		msType, reader, err := conn.NextReader()
+		if err != nil {
+			if ctx.Err() != nil || websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return 0, nil
+			}
+			return 400, err
+		}
+
+		if msType != websocket.BinaryMessage {
+			return 400, errWrongMessageType
+		}
+
+		if err := s.serveMessage(stripe, reader); err != nil {
+			return 500, err
+		}
+	}
+}
+
+// startPings pings the current websocket until the returned function or stopPings is called.
+// A resumed session starts new pings before the Serve of the previous websocket returns.
+func (s *Session) startPings(rootCtx context.Context, opts ServeOptions) func() {
+	ctx, cancel := context.WithCancel(rootCtx)
+	done := make(chan struct{})
+	conn := s.getConn()
+
+	stop := func() {
+		cancel()
+		<-done
+	}
+	s.pingLock.Lock()
+	s.pingCancel = stop
+	s.pingLock.Unlock()
+
+	go func() {
+		defer close(done)
+		pings(ctx, conn, opts)
+	}()
+	return stop
+}
+
+// pings sends timestamped pings, the pongs give the round trip time and keep the websocket
+// alive.
+func pings(ctx context.Context, conn *wsConn, opts ServeOptions) {
+	conn.setReadTimeout(opts.pongWait())
+	opts.pings()(ctx, conn.ping)
+}
+
+func (s *Session) stopPings() {
+	s.pingLock.Lock()
+	stop := s.pingCancel
+	s.pingCancel = nil
+	s.pingLock.Unlock()
+
+	if stop != nil {
+		stop()
+	}
+}
+
+func (w *wsConn) ping() error {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.conn.WriteControl(websocket.PingMessage, pingPayload(time.Now()), time.Now().Add(time.Second))
+}
+
+// closeNormal tells the remote side the websocket is going away before closing it.
+func (w *wsConn) closeNormal() {
+	w.Lock()
+	w.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	w.Unlock()
+
+	w.conn.Close()
+}
@@ -2,7 +2,9 @@ package remotedialer
 
 import (
 	"context"
+	"crypto/tls"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -20,63 +22,181 @@ type Authorizer func(req *http.Request) (clientKey string, authed bool, err erro
 type ErrorWriter func(rw http.ResponseWriter, req *http.Request, code int, err error)
 
 func DefaultErrorWriter(rw http.ResponseWriter, req *http.Request, code int, err error) {
-	rw.Write([]byte(err.Error()))
 	rw.WriteHeader(code)
+	rw.Write([]byte(err.Error()))
 }
 
 type Server struct {
-	PeerID      string
-	PeerToken   string
-	authorizer  Authorizer
-	errorWriter ErrorWriter
-	sessions    *sessionManager
-	peers       map[string]peer
-	peerLock    sync.Mutex
+	PeerID    string
+	PeerToken string
+	// PeerTLSConfig verifies the certificates of peers and cluster members, and may present a
+	// client certificate to them. If nil, their certificates are not verified.
+	PeerTLSConfig *tls.Config
+	// Cluster, if set, assigns client keys to members of the cluster, see Cluster.
+	Cluster *Cluster
+	// ResumeGracePeriod is how long the tunneled connections of a client that supports
+	// resumption are kept after its websocket drops. Zero disables resumption.
+	ResumeGracePeriod time.Duration
+	// MaxStripes is the most websockets a client may use for one session, see Stripes.
+	MaxStripes int
+	// Compression configures compression of client sessions, see CompressionConfig.
+	Compression CompressionConfig
+	// Limits protects the server from clients, see Limits.
+	Limits Limits
+	// DuplicatePolicy decides what happens to the existing sessions of a reconnecting client.
+	DuplicatePolicy DuplicatePolicy
+	// ServeOptions configures the pings of client and peer sessions.
+	ServeOptions ServeOptions
+	// Audit, if set, records tunneled connections and refused websockets, see AuditSink.
+	Audit             AuditSink
+	authorizer        Authorizer
+	errorWriter       ErrorWriter
+	sessions          *sessionManager
+	peers             map[string]peer
+	peerLock          sync.Mutex
+	peerTransportOnce sync.Once
+	peerTransport     *http.Transport
+	ctx               context.Context
+	cancel            func()
+	shuttingDown      int32
 }
 
 func New(auth Authorizer, errorWriter ErrorWriter) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
 		peers:       map[string]peer{},
 		authorizer:  auth,
 		errorWriter: errorWriter,
 		sessions:    newSessionManager(),
+		ctx:         ctx,
+		cancel:      cancel,
 	}
 }
 
 func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if s.refuseShuttingDown(rw, req) {
+		return
+	}
+
 	clientKey, authed, peer, err := s.auth(req)
 	if err != nil {
+		s.auditRefused(req, clientKey, err)
 		s.errorWriter(rw, req, 400, err)
 		return
 	}
 	if !authed {
+		s.auditRefused(req, clientKey, errFailedAuth)
 		s.errorWriter(rw, req, 401, errFailedAuth)
 		return
 	}
 
+	if !peer && s.forwardToOwner(rw, req, clientKey) {
+		return
+	}
+
 	logrus.Infof("Handling backend connection request [%s]", clientKey)
 
 	upgrader := websocket.Upgrader{
-		HandshakeTimeout: 5 * time.Second,
-		CheckOrigin:      func(r *http.Request) bool { return true },
-		Error:            s.errorWriter,
+		HandshakeTimeout:  5 * time.Second,
+		CheckOrigin:       func(r *http.Request) bool { return true },
+		Error:             s.errorWriter,
+		EnableCompression: s.Compression.WebsocketDeflate,
+	}
+
+	if !peer && req.Header.Get(StripeToken) != "" {
+		s.serveStripe(rw, req, &upgrader, clientKey)
+		return
+	}
+
+	var (
+		session     *Session
+		resumeToken = req.Header.Get(ResumeToken)
+	)
+	stripes, responseHeader := s.stripeHeader(req)
+	if peer || s.ResumeGracePeriod <= 0 {
+		resumeToken = ""
+	} else if resumeToken != "" {
+		session = s.sessions.resume(clientKey, resumeToken)
+		if session == nil {
+			resumeToken = newResumeToken()
+		}
+		if responseHeader == nil {
+			responseHeader = http.Header{}
+		}
+		responseHeader.Set(ResumeToken, resumeToken)
+	}
+
+	peerRouting := peer && peerVersion(req.Header) >= peerRoutingVersion
+	if peerRouting {
+		if responseHeader == nil {
+			responseHeader = http.Header{}
+		}
+		responseHeader.Set(PeerVersion, strconv.Itoa(peerRoutingVersion))
 	}
 
-	wsConn, err := upgrader.Upgrade(rw, req, nil)
+	deflate := !peer && s.Compression.Deflate && req.Header.Get(Compression) == deflateEncoding
+	if deflate {
+		if responseHeader == nil {
+			responseHeader = http.Header{}
+		}
+		responseHeader.Set(Compression, deflateEncoding)
+	}
+
+	var replaced []*Session
+	if !peer && session == nil {
+		var ok bool
+		if replaced, ok = s.checkDuplicates(rw, req, clientKey); !ok {
+			return
+		}
+		if !s.allowSession(rw, req, clientKey, len(replaced)) {
+			return
+		}
+	}
+
+	wsConn, err := upgrader.Upgrade(rw, req, responseHeader)
 	if err != nil {
+		if !peer && session == nil {
+			s.sessions.release(clientKey)
+		}
 		s.errorWriter(rw, req, 400, errors.Wrapf(err, "Error during upgrade for host [%v]", clientKey))
 		return
 	}
 
-	session := s.sessions.add(clientKey, wsConn, peer)
-	defer s.sessions.remove(session)
+	if session != nil {
+		logrus.Infof("Resuming backend connection [%s]", clientKey)
+		old := session.getConn()
+		if err := session.attach(wsConn); err != nil {
+			logrus.Infof("error resuming remotedialer session [%s]: %v", clientKey, err)
+		}
+		// Unblocks a Serve still reading from a half-open websocket
+		old.conn.Close()
+	} else {
+		limits := s.Limits
+		if peer {
+			limits = Limits{}
+		}
+		var compression *CompressionConfig
+		if deflate {
+			compression = &s.Compression
+		}
+		session = s.sessions.add(clientKey, req.Header.Get(InstanceID), resumeToken, wsConn, peer, peerRouting, s.PeerID,
+			compression, limits, s.Audit)
+		s.sessions.replace(replaced)
+	}
+	if stripes > 1 {
+		s.sessions.setStripeToken(session, responseHeader.Get(StripeToken), stripes)
+	}
 
 	// Don't need to associate req.Context() to the Session, it will cancel otherwise
-	code, err := session.Serve(context.Background())
+	code, err := session.ServeWithOptions(s.ctx, s.ServeOptions)
 	if err != nil {
 		// Hijacked so we can't write to the client
 		logrus.Infof("error in remotedialer server [%d]: %v", code, err)
 	}
+
+	if s.ctx.Err() != nil || !s.sessions.detach(session, wsConn, s.ResumeGracePeriod) {
+		s.sessions.remove(session)
+	}
 }
 
 func (s *Server) auth(req *http.Request) (clientKey string, authed, peer bool, err error) {
@@ -84,11 +204,7 @@ func (s *Server) auth(req *http.Request) (clientKey string, authed, peer bool, e
 	token := req.Header.Get(Token)
 	if id != "" && token != "" {
 		// peer authentication
-		s.peerLock.Lock()
-		p, ok := s.peers[id]
-		s.peerLock.Unlock()
-
-		if ok && p.token == token {
+		if s.checkPeerToken(id, token) {
 			return id, true, true, nil
 		}
 	}
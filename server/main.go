@@ -1,99 +1,50 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rancher/remotedialer"
+	"github.com/rancher/remotedialer/httpproxy"
+	"github.com/rancher/remotedialer/portforward"
+	"github.com/rancher/remotedialer/socks5"
 	"github.com/sirupsen/logrus"
 )
 
-var (
-	clients = map[string]*http.Client{}
-	l       sync.Mutex
-	counter int64
-)
-
 func authorizer(req *http.Request) (string, bool, error) {
 	id := req.Header.Get("x-tunnel-id")
 	return id, id != "", nil
 }
 
-func Client(server *remotedialer.Server, rw http.ResponseWriter, req *http.Request) {
-	timeout := req.URL.Query().Get("timeout")
-	if timeout == "" {
-		timeout = "15"
-	}
-
-	vars := mux.Vars(req)
-	clientKey := vars["id"]
-	url := fmt.Sprintf("%s://%s%s", vars["scheme"], vars["host"], vars["path"])
-	client := getClient(server, clientKey, timeout)
-
-	id := atomic.AddInt64(&counter, 1)
-	logrus.Infof("[%03d] REQ t=%s %s", id, timeout, url)
-
-	resp, err := client.Get(url)
-	if err != nil {
-		logrus.Errorf("[%03d] REQ ERR t=%s %s: %v", id, timeout, url, err)
-		remotedialer.DefaultErrorWriter(rw, req, 500, err)
-		return
-	}
-	defer resp.Body.Close()
-
-	logrus.Infof("[%03d] REQ OK t=%s %s", id, timeout, url)
-	rw.WriteHeader(resp.StatusCode)
-	io.Copy(rw, resp.Body)
-	logrus.Infof("[%03d] REQ DONE t=%s %s", id, timeout, url)
-}
-
-func getClient(server *remotedialer.Server, clientKey, timeout string) *http.Client {
-	l.Lock()
-	defer l.Unlock()
-
-	key := fmt.Sprintf("%s/%s", clientKey, timeout)
-	client := clients[key]
-	if client != nil {
-		return client
-	}
-
-	dialer := server.Dialer(clientKey, 15*time.Second)
-	client = &http.Client{
-		Transport: &http.Transport{
-			Dial: dialer,
-		},
-	}
-	if timeout != "" {
-		t, err := strconv.Atoi(timeout)
-		if err == nil {
-			client.Timeout = time.Duration(t) * time.Second
-		}
-	}
-
-	clients[key] = client
-	return client
-}
-
 func main() {
 	var (
 		addr      string
 		peerID    string
 		peerToken string
 		peers     string
+		peersFile string
+		peersDNS  string
+		socksAddr string
+		httpProxy bool
+		forwards  string
 		debug     bool
 	)
 	flag.StringVar(&addr, "listen", ":8123", "Listen address")
 	flag.StringVar(&peerID, "id", "", "Peer ID")
 	flag.StringVar(&peerToken, "token", "", "Peer Token")
 	flag.StringVar(&peers, "peers", "", "Peers format id:token:url,id:token:url")
+	flag.StringVar(&peersFile, "peers-file", "", "JSON/YAML file listing peers (id, url, token), re-read when changed")
+	flag.StringVar(&peersDNS, "peers-dns", "", "DNS name of a headless service whose addresses are peers on the listen port, using -token")
+	flag.StringVar(&socksAddr, "socks-listen", "", "Listen address of a SOCKS5 proxy dialing through the agent named by the username")
+	flag.BoolVar(&httpProxy, "http-proxy", false, "Also serve as an HTTP proxy dialing through the agent named by the proxy username")
+	flag.StringVar(&forwards, "forward", "", "Port forwards format listen=clientKey/address,listen=clientKey/network://address")
 	flag.BoolVar(&debug, "debug", false, "Enable debug logging")
 	flag.Parse()
 
@@ -114,12 +65,64 @@ func main() {
 		handler.AddPeer(parts[2], parts[0], parts[1])
 	}
 
+	if peersFile != "" {
+		go handler.DiscoverPeers(context.Background(), &remotedialer.FileDiscovery{Path: peersFile}, 10*time.Second)
+	}
+
+	if peersDNS != "" {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			logrus.Fatalf("Invalid listen address %s: %v", addr, err)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			logrus.Fatalf("Invalid listen port %s: %v", port, err)
+		}
+		go handler.DiscoverPeers(context.Background(), &remotedialer.DNSDiscovery{
+			Name:  peersDNS,
+			Port:  p,
+			Token: peerToken,
+		}, 10*time.Second)
+	}
+
+	if socksAddr != "" {
+		socks := socks5.New(handler, 15*time.Second)
+		// Trusts the username as the client key, like the authorizer trusts the header
+		socks.Authenticate = func(username, _ string) (string, bool) {
+			return username, username != ""
+		}
+		go func() {
+			logrus.Fatal(socks.ListenAndServe(socksAddr))
+		}()
+	}
+
+	forwarder := portforward.New(handler, 15*time.Second)
+	for _, forward := range strings.Split(forwards, ",") {
+		if strings.TrimSpace(forward) == "" {
+			continue
+		}
+		f, err := portforward.Parse(strings.TrimSpace(forward))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if err := forwarder.Add(f); err != nil {
+			logrus.Fatalf("Failed to forward %s: %v", f, err)
+		}
+	}
+
 	router := mux.NewRouter()
 	router.Handle("/connect", handler)
-	router.HandleFunc("/client/{id}/{scheme}/{host}{path:.*}", func(rw http.ResponseWriter, req *http.Request) {
-		Client(handler, rw, req)
-	})
+	router.PathPrefix("/client/").Handler(httpproxy.NewReverseProxy(handler, 15*time.Second, httpproxy.PathRoute("/client")))
+
+	var root http.Handler = router
+	if httpProxy {
+		proxy := httpproxy.New(handler, 15*time.Second, router)
+		proxy.Authenticate = func(username, _ string) (string, bool) {
+			return username, username != ""
+		}
+		root = proxy
+	}
 
 	fmt.Println("Listening on ", addr)
-	http.ListenAndServe(addr, router)
+	http.ListenAndServe(addr, root)
 }
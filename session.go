@@ -22,20 +22,48 @@ type Session struct {
 
 	nextConnID       int64
 	clientKey        string
+	instanceID       string
 	sessionKey       int64
+	connLock         sync.Mutex
 	conn             *wsConn
+	stripes          map[int64]*wsConn
+	nextStripe       int64
+	maxStripes       int
+	stripeToken      string
 	conns            map[int64]*connection
-	remoteClientKeys map[string]map[int]bool
+	remoteClientKeys map[string]map[int]route
+	localPeerID      string
+	remotePeerID     string
+	peerRouting      bool
+	manager          *sessionManager
+	advertised       map[string]string
 	auth             ConnectAuthorizer
+	pingLock         sync.Mutex
 	pingCancel       context.CancelFunc
-	pingWait         sync.WaitGroup
 	dialer           Dialer
 	client           bool
+	resumeToken      string
+	priority         PriorityFunc
+	compression      CompressionConfig
+	limits           Limits
+	connectRate      tokenBucket
+	pendingDials     int32
+	limiter          *rateLimiter
+	transmitted      rateMeter
+	received         rateMeter
+	deflate          bool
+	detached         bool
+	closed           bool
+	auditSink        AuditSink
+	onDenied         func(network, address string, reason error)
 }
 
 // PrintTunnelData No tunnel logging by default
 var PrintTunnelData bool
 
+// ErrConnectNotAllowed is returned for connections the client's ConnectAuthorizer refused.
+var ErrConnectNotAllowed = errors.New("connect not allowed")
+
 func init() {
 	if os.Getenv("CATTLE_TUNNEL_DATA_DEBUG") == "true" {
 		PrintTunnelData = true
@@ -59,69 +87,34 @@ func newSession(sessionKey int64, clientKey string, conn *websocket.Conn) *Sessi
 		sessionKey:       sessionKey,
 		conn:             newWSConn(conn),
 		conns:            map[int64]*connection{},
-		remoteClientKeys: map[string]map[int]bool{},
+		remoteClientKeys: map[string]map[int]route{},
 	}
 }
 
-func (s *Session) startPings(rootCtx context.Context) {
-	ctx, cancel := context.WithCancel(rootCtx)
-	s.pingCancel = cancel
-	s.pingWait.Add(1)
-
-	go func() {
-		defer s.pingWait.Done()
-
-		t := time.NewTicker(PingWriteInterval)
-		defer t.Stop()
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-t.C:
-				s.conn.Lock()
-				if err := s.conn.conn.WriteControl(websocket.PingMessage, []byte(""), time.Now().Add(time.Second)); err != nil {
-					logrus.WithError(err).Error("Error writing ping")
-				}
-				logrus.Debug("Wrote ping")
-				s.conn.Unlock()
-			}
-		}
-	}()
-}
-
-func (s *Session) stopPings() {
-	if s.pingCancel == nil {
-		return
-	}
+func (s *Session) getConn() *wsConn {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
 
-	s.pingCancel()
-	s.pingWait.Wait()
+	return s.conn
 }
 
-func (s *Session) Serve(ctx context.Context) (int, error) {
-	if s.client {
-		s.startPings(ctx)
+func (s *Session) readMessage(reader io.Reader) (*message, error) {
+	message, err := newServerMessage(reader)
+	if err != nil {
+		return nil, err
 	}
 
-	for {
-		msType, reader, err := s.conn.NextReader()
-		if err != nil {
-			return 400, err
-		}
-
-		if msType != websocket.BinaryMessage {
-			return 400, errWrongMessageType
-		}
-
-		if err := s.serveMessage(reader); err != nil {
-			return 500, err
+	if message.messageType == Data && s.extendedData() {
+		if err := message.readExtension(); err != nil {
+			return nil, err
 		}
 	}
+
+	return message, nil
 }
 
-func (s *Session) serveMessage(reader io.Reader) error {
-	message, err := newServerMessage(reader)
+func (s *Session) serveMessage(stripe int64, reader io.Reader) error {
+	message, err := s.readMessage(reader)
 	if err != nil {
 		return err
 	}
@@ -132,20 +125,34 @@ func (s *Session) serveMessage(reader io.Reader) error {
 
 	if message.messageType == Connect {
 		if s.auth == nil || !s.auth(message.proto, message.address) {
-			return errors.New("connect not allowed")
+			// Refuse the connection, not the session
+			s.auditDenied(message.connID, message.proto, message.address, "", ErrConnectNotAllowed)
+			s.writeMessageOn(stripe, newErrorMessage(message.connID, ErrConnectNotAllowed))
+			return nil
 		}
-		s.clientConnect(message)
+		s.clientConnect(message, stripe)
+		return nil
+	}
+
+	if message.messageType == Resume {
+		s.serveResume(message)
 		return nil
 	}
 
 	s.Lock()
 	if message.messageType == AddClient && s.remoteClientKeys != nil {
-		err := s.addRemoteClient(message.address)
+		clientKey, sessionKey, err := s.addRemoteClient(message.address)
 		s.Unlock()
+		if err == nil {
+			s.routeUpdated(clientKey, sessionKey)
+		}
 		return err
 	} else if message.messageType == RemoveClient {
-		err := s.removeRemoteClient(message.address)
+		clientKey, sessionKey, err := s.removeRemoteClient(message.address)
 		s.Unlock()
+		if err == nil {
+			s.routeUpdated(clientKey, sessionKey)
+		}
 		return err
 	}
 	conn := s.conns[message.connID]
@@ -154,14 +161,18 @@ func (s *Session) serveMessage(reader io.Reader) error {
 	if conn == nil {
 		if message.messageType == Data {
 			err := fmt.Errorf("connection not found %s/%d/%d", s.clientKey, s.sessionKey, message.connID)
-			newErrorMessage(message.connID, err).WriteTo(s.conn)
+			newErrorMessage(message.connID, err).WriteTo(s.stripeConn(stripe))
 		}
 		return nil
 	}
 
 	switch message.messageType {
 	case Data:
-		if _, err := io.Copy(conn.tunnelWriter(), message); err != nil {
+		if conn.replay != nil && message.extended && !conn.replay.received(message.seq) {
+			// Already received before the session was resumed
+			return nil
+		}
+		if _, err := io.Copy(conn.tunnelWriter(), message.payload()); err != nil {
 			s.closeConnection(message.connID, err)
 		}
 	case Error:
@@ -172,42 +183,55 @@ func (s *Session) serveMessage(reader io.Reader) error {
 }
 
 func parseAddress(address string) (string, int, error) {
-	parts := strings.SplitN(address, "/", 2)
-	if len(parts) != 2 {
+	i := strings.LastIndex(address, "/")
+	if i < 0 {
 		return "", 0, errors.New("not / separated")
 	}
-	v, err := strconv.Atoi(parts[1])
-	return parts[0], v, err
+	v, err := strconv.Atoi(address[i+1:])
+	return address[:i], v, err
 }
 
-func (s *Session) addRemoteClient(address string) error {
-	clientKey, sessionKey, err := parseAddress(address)
+func (s *Session) addRemoteClient(address string) (string, int, error) {
+	clientKey, sessionKey, r, err := parseRoute(s.clientKey, address)
 	if err != nil {
-		return fmt.Errorf("invalid remote Session %s: %v", address, err)
+		return "", 0, fmt.Errorf("invalid remote Session %s: %v", address, err)
 	}
 
 	keys := s.remoteClientKeys[clientKey]
+	if r.hops > MaxPeerHops || (s.localPeerID != "" && r.through(s.localPeerID)) {
+		// Looped or too long, drop any previous route for this session
+		delete(keys, sessionKey)
+		if len(keys) == 0 {
+			delete(s.remoteClientKeys, clientKey)
+		}
+		return clientKey, sessionKey, nil
+	}
+
 	if keys == nil {
-		keys = map[int]bool{}
+		keys = map[int]route{}
 		s.remoteClientKeys[clientKey] = keys
 	}
-	keys[int(sessionKey)] = true
+	keys[sessionKey] = r
 
 	if PrintTunnelData {
-		logrus.Debugf("ADD REMOTE CLIENT %s, SESSION %d", address, s.sessionKey)
+		logrus.Debugf("ADD REMOTE CLIENT %s, SESSION %d, HOPS %d", address, s.sessionKey, r.hops)
 	}
 
-	return nil
+	return clientKey, sessionKey, nil
 }
 
-func (s *Session) removeRemoteClient(address string) error {
-	clientKey, sessionKey, err := parseAddress(address)
+func (s *Session) removeRemoteClient(address string) (string, int, error) {
+	clientKey, sessionKey, r, err := parseRoute(s.clientKey, address)
 	if err != nil {
-		return fmt.Errorf("invalid remote Session %s: %v", address, err)
+		return "", 0, fmt.Errorf("invalid remote Session %s: %v", address, err)
 	}
 
 	keys := s.remoteClientKeys[clientKey]
-	delete(keys, int(sessionKey))
+	if existing, ok := keys[sessionKey]; ok && (existing.hops == 1) != (r.hops == 1) {
+		// Direct and relayed routes are withdrawn separately
+		return clientKey, sessionKey, nil
+	}
+	delete(keys, sessionKey)
 	if len(keys) == 0 {
 		delete(s.remoteClientKeys, clientKey)
 	}
@@ -216,7 +240,13 @@ func (s *Session) removeRemoteClient(address string) error {
 		logrus.Debugf("REMOVE REMOTE CLIENT %s, SESSION %d", address, s.sessionKey)
 	}
 
-	return nil
+	return clientKey, sessionKey, nil
+}
+
+func (s *Session) routeUpdated(clientKey string, sessionKey int) {
+	if s.manager != nil {
+		s.manager.routeUpdated(clientKey, sessionKey)
+	}
 }
 
 func (s *Session) closeConnection(connID int64, err error) {
@@ -233,8 +263,18 @@ func (s *Session) closeConnection(connID int64, err error) {
 	}
 }
 
-func (s *Session) clientConnect(message *message) {
+func (s *Session) clientConnect(message *message, stripe int64) {
+	if err := s.allowConnection(true); err != nil {
+		s.auditDenied(message.connID, message.proto, message.address, "", err)
+		s.writeMessageOn(stripe, newErrorMessage(message.connID, err))
+		return
+	}
+
 	conn := newConnection(message.connID, s, message.proto, message.address)
+	conn.setStripe(stripe)
+	if s.priority != nil {
+		conn.setPriority(s.priority(message.proto, message.address))
+	}
 
 	s.Lock()
 	s.conns[message.connID] = conn
@@ -243,12 +283,20 @@ func (s *Session) clientConnect(message *message) {
 	}
 	s.Unlock()
 
+	conn.audit(AuditConnect, nil)
 	go clientDial(s.dialer, conn, message)
 }
 
-func (s *Session) serverConnect(deadline time.Duration, proto, address string) (net.Conn, error) {
+func (s *Session) serverConnect(deadline time.Duration, proto, address, caller string) (net.Conn, error) {
+	if err := s.allowConnection(false); err != nil {
+		s.auditDenied(0, proto, address, caller, err)
+		return nil, err
+	}
+
 	connID := atomic.AddInt64(&s.nextConnID, 1)
 	conn := newConnection(connID, s, proto, address)
+	conn.caller = caller
+	conn.setStripe(s.pickStripe(connID))
 
 	s.Lock()
 	s.conns[connID] = conn
@@ -257,7 +305,8 @@ func (s *Session) serverConnect(deadline time.Duration, proto, address string) (
 	}
 	s.Unlock()
 
-	_, err := s.writeMessage(newConnect(connID, deadline, proto, address))
+	conn.audit(AuditConnect, nil)
+	_, err := s.writeMessageOn(conn.getStripe(), newConnect(connID, deadline, proto, address))
 	if err != nil {
 		s.closeConnection(connID, err)
 		return nil, err
@@ -267,10 +316,18 @@ func (s *Session) serverConnect(deadline time.Duration, proto, address string) (
 }
 
 func (s *Session) writeMessage(message *message) (int, error) {
+	return s.writeMessageOn(0, message)
+}
+
+func (s *Session) writeMessageOn(stripe int64, message *message) (int, error) {
 	if PrintTunnelData {
 		logrus.Debug("WRITE ", message)
 	}
-	return message.WriteTo(s.conn)
+	conn := s.stripeConn(stripe)
+	if conn == nil {
+		return 0, errStripeClosed
+	}
+	return message.WriteTo(conn)
 }
 
 func (s *Session) Close() {
@@ -278,6 +335,8 @@ func (s *Session) Close() {
 	defer s.Unlock()
 
 	s.stopPings()
+	s.closeStripes()
+	s.closed = true
 
 	for _, connection := range s.conns {
 		connection.tunnelClose(errors.New("tunnel disconnect"))
@@ -290,7 +349,7 @@ func (s *Session) sessionAdded(clientKey string, sessionKey int64) {
 	client := fmt.Sprintf("%s/%d", clientKey, sessionKey)
 	_, err := s.writeMessage(newAddClient(client))
 	if err != nil {
-		s.conn.conn.Close()
+		s.getConn().conn.Close()
 	}
 }
 
@@ -298,6 +357,6 @@ func (s *Session) sessionRemoved(clientKey string, sessionKey int64) {
 	client := fmt.Sprintf("%s/%d", clientKey, sessionKey)
 	_, err := s.writeMessage(newRemoveClient(client))
 	if err != nil {
-		s.conn.conn.Close()
+		s.getConn().conn.Close()
 	}
 }
@@ -14,6 +14,7 @@ import (
 type sessionListener interface {
 	sessionAdded(clientKey string, sessionKey int64)
 	sessionRemoved(clientKey string, sessionKey int64)
+	routesUpdated(clientKey string, sessionKey int, routes []route)
 }
 
 type sessionManager struct {
@@ -21,6 +22,13 @@ type sessionManager struct {
 	clients   map[string][]*Session
 	peers     map[string][]*Session
 	listeners map[sessionListener]bool
+	resumable map[string]*Session
+	striped   map[string]*Session
+	limiters  map[string]*rateLimiter
+	// reserved counts the client sessions allowed but not added yet, see reserve
+	reserved map[string]int
+	// stripeRegistered is closed and replaced when a stripe token is registered
+	stripeRegistered chan struct{}
 }
 
 func newSessionManager() *sessionManager {
@@ -28,15 +36,26 @@ func newSessionManager() *sessionManager {
 		clients:   map[string][]*Session{},
 		peers:     map[string][]*Session{},
 		listeners: map[sessionListener]bool{},
+		resumable: map[string]*Session{},
+		striped:   map[string]*Session{},
+		limiters:  map[string]*rateLimiter{},
+		reserved:  map[string]int{},
+
+		stripeRegistered: make(chan struct{}),
 	}
 }
 
-func toDialer(s *Session, prefix string, deadline time.Duration) Dialer {
+// toDialer is called with the sessionManager locked.
+func toDialer(s *Session, prefix string, ttl int, deadline time.Duration, caller string) Dialer {
+	peerRouting := s.peerRouting
 	return func(proto, address string) (net.Conn, error) {
 		if prefix == "" {
-			return s.serverConnect(deadline, proto, address)
+			return s.serverConnect(deadline, proto, address, caller)
+		}
+		if !peerRouting {
+			return s.serverConnect(deadline, prefix+"::"+proto, address, caller)
 		}
-		return s.serverConnect(deadline, prefix+"::"+proto, address)
+		return s.serverConnect(deadline, forwardedNetwork(prefix, proto, ttl), address, caller)
 	}
 }
 
@@ -59,48 +78,112 @@ func (sm *sessionManager) addListener(listener sessionListener) {
 		}
 	}
 
+	remoteClients := map[string]map[int]bool{}
 	for k, sessions := range sm.peers {
 		for _, session := range sessions {
 			listener.sessionAdded(k, session.sessionKey)
+
+			session.Lock()
+			for clientKey, keys := range session.remoteClientKeys {
+				if remoteClients[clientKey] == nil {
+					remoteClients[clientKey] = map[int]bool{}
+				}
+				for sessionKey := range keys {
+					remoteClients[clientKey][sessionKey] = true
+				}
+			}
+			session.Unlock()
+		}
+	}
+
+	for clientKey, keys := range remoteClients {
+		for sessionKey := range keys {
+			listener.routesUpdated(clientKey, sessionKey, sm.routes(clientKey, sessionKey))
 		}
 	}
 }
 
 func (sm *sessionManager) getDialer(clientKey string, deadline time.Duration) (Dialer, error) {
+	return sm.getDialerTTL(clientKey, deadline, MaxPeerHops, "")
+}
+
+// getDialerTTL returns a dialer for a local client session, or else for the peer with the
+// shortest route to the client if ttl allows forwarding. Connections are audited as dialed by
+// caller.
+func (sm *sessionManager) getDialerTTL(clientKey string, deadline time.Duration, ttl int, caller string) (Dialer, error) {
 	sm.Lock()
 	defer sm.Unlock()
 
-	sessions := sm.clients[clientKey]
-	if len(sessions) > 0 {
-		return toDialer(sessions[0], "", deadline), nil
+	for _, session := range sm.clients[clientKey] {
+		session.Lock()
+		detached := session.detached
+		session.Unlock()
+		if !detached {
+			return toDialer(session, "", 0, deadline, caller), nil
+		}
+	}
+
+	if ttl <= 0 {
+		return nil, fmt.Errorf("hop limit exceeded for client %s", clientKey)
 	}
 
+	var (
+		best     *Session
+		bestHops int
+	)
 	for _, sessions := range sm.peers {
 		for _, session := range sessions {
 			session.Lock()
-			keys := session.remoteClientKeys[clientKey]
-			session.Unlock()
-			if len(keys) > 0 {
-				return toDialer(session, clientKey, deadline), nil
+			for _, r := range session.remoteClientKeys[clientKey] {
+				if best == nil || r.hops < bestHops {
+					best = session
+					bestHops = r.hops
+				}
 			}
+			session.Unlock()
 		}
 	}
 
+	if best != nil {
+		return toDialer(best, clientKey, ttl-1, deadline, caller), nil
+	}
+
 	return nil, fmt.Errorf("failed to find Session for client %s", clientKey)
 }
 
-func (sm *sessionManager) add(clientKey string, conn *websocket.Conn, peer bool) *Session {
+// add registers a new session for clientKey. The session is resumable if resumeToken is set,
+// and compresses Data messages if compression is set.
+func (sm *sessionManager) add(clientKey, instanceID, resumeToken string, conn *websocket.Conn, peer, peerRouting bool, localPeerID string,
+	compression *CompressionConfig, limits Limits, audit AuditSink) *Session {
 	sessionKey := rand.Int63()
 	session := newSession(sessionKey, clientKey, conn)
+	session.instanceID = instanceID
+	// Set before the session is published, connections check them to frame Data messages
+	session.resumeToken = resumeToken
+	if compression != nil {
+		session.compression = *compression
+		session.deflate = true
+	}
+	session.peerRouting = peerRouting
+	session.setLimits(limits)
+	session.auditSink = audit
 
 	sm.Lock()
 	defer sm.Unlock()
 
+	session.limiter = sm.getLimiter(clientKey)
 	if peer {
+		session.localPeerID = localPeerID
+		session.remotePeerID = clientKey
+		session.manager = sm
 		sm.peers[clientKey] = append(sm.peers[clientKey], session)
 	} else {
+		sm.unreserve(clientKey)
 		sm.clients[clientKey] = append(sm.clients[clientKey], session)
 	}
+	if resumeToken != "" {
+		sm.resumable[resumeToken] = session
+	}
 	metrics.IncSMTotalAddWS(clientKey, peer)
 
 	for l := range sm.listeners {
@@ -115,6 +198,14 @@ func (sm *sessionManager) remove(s *Session) {
 	sm.Lock()
 	defer sm.Unlock()
 
+	if s.resumeToken != "" && sm.resumable[s.resumeToken] == s {
+		delete(sm.resumable, s.resumeToken)
+	}
+	if s.stripeToken != "" && sm.striped[s.stripeToken] == s {
+		delete(sm.striped, s.stripeToken)
+	}
+
+	found := false
 	for i, store := range []map[string][]*Session{sm.clients, sm.peers} {
 		var newSessions []*Session
 
@@ -126,6 +217,7 @@ func (sm *sessionManager) remove(s *Session) {
 					isPeer = true
 				}
 				metrics.IncSMTotalRemoveWS(s.clientKey, isPeer)
+				found = true
 				continue
 			}
 			newSessions = append(newSessions, v)
@@ -138,9 +230,32 @@ func (sm *sessionManager) remove(s *Session) {
 		}
 	}
 
+	if !found {
+		// Already removed, such as when replaced by a new session
+		s.Close()
+		return
+	}
+
+	if len(sm.clients[s.clientKey]) == 0 && len(sm.peers[s.clientKey]) == 0 {
+		if limiter := sm.limiters[s.clientKey]; limiter != nil && limiter.get() == (RateLimit{}) {
+			delete(sm.limiters, s.clientKey)
+		}
+	}
+
 	for l := range sm.listeners {
 		l.sessionRemoved(s.clientKey, s.sessionKey)
 	}
 
+	// Routes through a removed peer are gone, advertise the alternatives
+	s.Lock()
+	remoteClients := s.remoteClientKeys
+	s.remoteClientKeys = map[string]map[int]route{}
+	s.Unlock()
+	for clientKey, keys := range remoteClients {
+		for sessionKey := range keys {
+			sm.notifyRoutes(clientKey, sessionKey)
+		}
+	}
+
 	s.Close()
 }
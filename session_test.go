@@ -0,0 +1,57 @@
+package remotedialer
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestDeniedConnectKeepsSession(t *testing.T) {
+	echo, closeEcho := listenEcho(t)
+	defer closeEcho()
+	server, url, closeServer := newTestServer()
+	defer closeServer()
+
+	denied := make(chan string, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connectClient(ctx, url, "foo", ClientOptions{
+		Auth: func(proto, address string) bool {
+			return address == echo
+		},
+		OnDenied: func(network, address string, reason error) {
+			if reason == ErrConnectNotAllowed {
+				denied <- address
+			}
+		},
+	})
+	if !waitFor(func() bool { return server.HasSession("foo") }) {
+		t.Fatal("client did not connect")
+	}
+	session := clientSessions(server, "foo")[0]
+
+	conn, err := server.Dial("foo", 5*time.Second, "tcp", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != ErrConnectNotAllowed {
+		t.Fatalf("expected %v, got %v", ErrConnectNotAllowed, err)
+	}
+	select {
+	case address := <-denied:
+		if address != "127.0.0.1:1" {
+			t.Fatalf("denied %s", address)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnDenied not called")
+	}
+
+	// Only the connection was refused
+	if sessions := clientSessions(server, "foo"); len(sessions) != 1 || sessions[0] != session {
+		t.Fatal("session closed by a denied connect")
+	}
+	checkEcho(t, server, "foo", echo)
+}
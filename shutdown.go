@@ -0,0 +1,79 @@
+package remotedialer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ErrShuttingDown = errors.New("server is shutting down")
+
+// refuseShuttingDown refuses new websockets once Shutdown is called, so clients connect to
+// another server.
+func (s *Server) refuseShuttingDown(rw http.ResponseWriter, req *http.Request) bool {
+	if atomic.LoadInt32(&s.shuttingDown) == 0 {
+		return false
+	}
+	s.errorWriter(rw, req, http.StatusServiceUnavailable, ErrShuttingDown)
+	return true
+}
+
+// Shutdown drains the server: new websockets are refused, then once the tunneled connections of
+// the clients are closed or ctx is done, peers are removed and every websocket is closed
+// cleanly before Shutdown returns. It returns ctx.Err() if connections were still open.
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+
+	err := s.drain(ctx)
+
+	s.peerLock.Lock()
+	var peers []string
+	for id := range s.peers {
+		peers = append(peers, id)
+	}
+	s.peerLock.Unlock()
+	for _, id := range peers {
+		s.RemovePeer(id)
+	}
+
+	s.cancel()
+	s.waitClosed()
+	return err
+}
+
+// waitClosed waits for the websockets to be closed, which takes at most the second allowed to
+// write their close frames.
+func (s *Server) waitClosed() {
+	deadline := time.Now().Add(2 * time.Second)
+	for len(s.Sessions()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *Server) drain(ctx context.Context) error {
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+
+	for {
+		conns := 0
+		for _, info := range s.Sessions() {
+			if !info.Peer {
+				conns += info.Connections
+			}
+		}
+		if conns == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			logrus.Infof("Closing %d tunneled connections still open", conns)
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,352 @@
+// Package socks5 is a SOCKS5 server that dials through remotedialer agents. The SOCKS username
+// selects the agent, so tools that support SOCKS proxies can reach the networks behind it.
+package socks5
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/remotedialer"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	version5 = 5
+
+	methodUserPass     = 2
+	methodNoAcceptable = 0xff
+
+	userPassVersion = 1
+
+	cmdConnect      = 1
+	cmdUDPAssociate = 3
+
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+
+	repSuccess             = 0
+	repFailure             = 1
+	repNetworkUnreachable  = 3
+	repConnectionRefused   = 5
+	repCommandNotSupported = 7
+	repAddressNotSupported = 8
+)
+
+var (
+	errUnsupportedAddress = errors.New("unsupported address type")
+	errNoAuthenticate     = errors.New("socks5: Authenticate is required")
+)
+
+// DialFunc dials address through the agent of clientKey for caller, the username of the SOCKS
+// client.
+type DialFunc func(clientKey, caller, network, address string) (net.Conn, error)
+
+// Server accepts SOCKS5 clients authenticated with a username and password.
+type Server struct {
+	// Dial dials through the agent, Server.DialWithOptions of the remotedialer server by
+	// default.
+	Dial DialFunc
+	// Authenticate returns the client key for a username and password. It is required, clients
+	// are refused without it.
+	Authenticate func(username, password string) (clientKey string, ok bool)
+	// HandshakeTimeout bounds the negotiation before the connection is proxied.
+	HandshakeTimeout time.Duration
+}
+
+// New returns a Server dialing through server, waiting up to deadline for each connection.
+func New(server *remotedialer.Server, deadline time.Duration) *Server {
+	return &Server{
+		Dial: func(clientKey, caller, network, address string) (net.Conn, error) {
+			return server.DialWithOptions(clientKey, deadline, network, address, remotedialer.DialOptions{
+				Caller: caller,
+			})
+		},
+		HandshakeTimeout: 30 * time.Second,
+	}
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until it fails.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+
+	if s.Authenticate == nil {
+		return errNoAuthenticate
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn handles one SOCKS5 client and closes conn when done.
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	if s.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
+
+	reader := bufio.NewReader(conn)
+	username, clientKey, err := s.negotiate(reader, conn)
+	if err != nil {
+		logrus.Debugf("SOCKS negotiation with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	cmd, address, err := readRequest(reader)
+	if err == errUnsupportedAddress {
+		writeReply(conn, repAddressNotSupported, nil)
+		return
+	} else if err != nil {
+		logrus.Debugf("Invalid SOCKS request from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	switch cmd {
+	case cmdConnect:
+		s.connect(conn, reader, clientKey, username, address)
+	case cmdUDPAssociate:
+		s.udpAssociate(conn, clientKey, username)
+	default:
+		writeReply(conn, repCommandNotSupported, nil)
+	}
+}
+
+// negotiate selects username/password authentication and returns the username and client key.
+func (s *Server) negotiate(reader *bufio.Reader, conn net.Conn) (string, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", "", err
+	}
+	if header[0] != version5 {
+		return "", "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", "", err
+	}
+	if !containsByte(methods, methodUserPass) {
+		conn.Write([]byte{version5, methodNoAcceptable})
+		return "", "", errors.New("client does not support username authentication")
+	}
+	if _, err := conn.Write([]byte{version5, methodUserPass}); err != nil {
+		return "", "", err
+	}
+
+	// RFC 1929
+	version, err := reader.ReadByte()
+	if err != nil {
+		return "", "", err
+	}
+	if version != userPassVersion {
+		return "", "", fmt.Errorf("unsupported authentication version %d", version)
+	}
+	username, err := readString(reader)
+	if err != nil {
+		return "", "", err
+	}
+	password, err := readString(reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	clientKey, ok := s.authenticate(username, password)
+	if !ok {
+		conn.Write([]byte{userPassVersion, 1})
+		return "", "", fmt.Errorf("authentication failed for %s", username)
+	}
+	_, err = conn.Write([]byte{userPassVersion, 0})
+	return username, clientKey, err
+}
+
+func (s *Server) authenticate(username, password string) (string, bool) {
+	if s.Authenticate == nil {
+		logrus.Error(errNoAuthenticate)
+		return "", false
+	}
+	return s.Authenticate(username, password)
+}
+
+// connect proxies a CONNECT request. Tunneled dials succeed once the agent is asked to connect,
+// so a target refusing the connection closes it after the success reply.
+func (s *Server) connect(conn net.Conn, reader *bufio.Reader, clientKey, caller, address string) {
+	target, err := s.Dial(clientKey, caller, "tcp", address)
+	if err != nil {
+		logrus.Debugf("SOCKS connect to %s through [%s] failed: %v", address, clientKey, err)
+		writeReply(conn, replyCode(err), nil)
+		return
+	}
+	defer target.Close()
+
+	if err := writeReply(conn, repSuccess, nil); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// The reader may have buffered data sent right after the request
+		io.Copy(target, reader)
+		target.Close()
+	}()
+
+	io.Copy(conn, target)
+	conn.Close()
+	wg.Wait()
+}
+
+func replyCode(err error) byte {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "connection refused"):
+		return repConnectionRefused
+	case strings.Contains(msg, "failed to find Session"), strings.Contains(msg, "hop limit exceeded"):
+		return repNetworkUnreachable
+	}
+	return repFailure
+}
+
+func readString(reader *bufio.Reader) (string, error) {
+	length, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func readRequest(reader *bufio.Reader) (byte, string, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, "", err
+	}
+	if header[0] != version5 {
+		return 0, "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	address, err := readAddress(reader)
+	return header[1], address, err
+}
+
+// readAddress reads ATYP, DST.ADDR and DST.PORT and returns them as host:port.
+func readAddress(reader io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(reader, atyp); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == atypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case atypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(reader, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", errUnsupportedAddress
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// appendAddress encodes addr as ATYP, BND.ADDR and BND.PORT, or the zero IPv4 address if nil.
+func appendAddress(buf []byte, addr net.Addr) []byte {
+	ip := net.IPv4zero
+	port := 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, atypIPv4)
+		buf = append(buf, ip4...)
+	} else {
+		buf = append(buf, atypIPv6)
+		buf = append(buf, ip.To16()...)
+	}
+	return append(buf, byte(port>>8), byte(port))
+}
+
+// appendHostPort encodes the host:port address as ATYP, ADDR and PORT, keeping domain names.
+func appendHostPort(buf []byte, address string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return appendAddress(buf, &net.UDPAddr{IP: ip, Port: int(port)}), nil
+	}
+	if len(host) > 255 {
+		return nil, fmt.Errorf("domain name too long: %s", host)
+	}
+	buf = append(buf, atypDomain, byte(len(host)))
+	buf = append(buf, host...)
+	return append(buf, byte(port>>8), byte(port)), nil
+}
+
+func writeReply(conn net.Conn, rep byte, bound net.Addr) error {
+	_, err := conn.Write(appendAddress([]byte{version5, rep, 0}, bound))
+	return err
+}
+
+func containsByte(bytes []byte, b byte) bool {
+	for _, c := range bytes {
+		if c == b {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,331 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type dialed struct {
+	clientKey, caller, network, address string
+}
+
+// newTestServer returns a SOCKS server authenticating user with password as the agent and
+// dialing directly, the address it is served on and the dials it made.
+func newTestServer(t *testing.T) (*Server, string, func() []dialed) {
+	var (
+		lock  sync.Mutex
+		dials []dialed
+	)
+	s := &Server{
+		Dial: func(clientKey, caller, network, address string) (net.Conn, error) {
+			lock.Lock()
+			dials = append(dials, dialed{clientKey, caller, network, address})
+			lock.Unlock()
+			return net.Dial(network, address)
+		},
+		Authenticate: func(username, password string) (string, bool) {
+			return "agent", username == "user" && password == "password"
+		},
+		HandshakeTimeout: 5 * time.Second,
+	}
+
+	return s, serve(t, s), func() []dialed {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]dialed{}, dials...)
+	}
+}
+
+// serve serves s on a local port and returns its address.
+func serve(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+func listenEcho(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+// authenticate connects to addr and authenticates with username and password, returning the
+// connection and the authentication status.
+func authenticate(t *testing.T, addr, username, password string) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte{version5, 2, 0, methodUserPass})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[0] != version5 || reply[1] != methodUserPass {
+		t.Fatalf("expected username authentication, got %v", reply)
+	}
+
+	request := []byte{userPassVersion, byte(len(username))}
+	request = append(request, username...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+	conn.Write(request)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[0] != userPassVersion {
+		t.Fatalf("unexpected authentication reply %v", reply)
+	}
+	return conn, reply[1]
+}
+
+// request sends a request for cmd to address and returns the reply code and bound address.
+func request(t *testing.T, conn net.Conn, cmd byte, address string) (byte, string) {
+	req, err := appendHostPort([]byte{version5, cmd, 0}, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(req)
+
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	bound, err := readAddress(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply[1], bound
+}
+
+func TestConnect(t *testing.T) {
+	echo := listenEcho(t)
+	defer echo.Close()
+	_, addr, dials := newTestServer(t)
+
+	conn, status := authenticate(t, addr, "user", "password")
+	defer conn.Close()
+	if status != 0 {
+		t.Fatalf("authentication failed with %d", status)
+	}
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	target := net.JoinHostPort("localhost", port)
+	if rep, _ := request(t, conn, cmdConnect, target); rep != repSuccess {
+		t.Fatalf("connect failed with %d", rep)
+	}
+
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("echo mismatch", err)
+	}
+
+	expected := dialed{clientKey: "agent", caller: "user", network: "tcp", address: target}
+	if d := dials(); len(d) != 1 || d[0] != expected {
+		t.Fatalf("expected dial %+v, got %+v", expected, d)
+	}
+}
+
+func TestAuthenticationFailed(t *testing.T) {
+	_, addr, dials := newTestServer(t)
+
+	conn, status := authenticate(t, addr, "user", "wrong")
+	defer conn.Close()
+	if status == 0 {
+		t.Fatal("wrong password accepted")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+	if len(dials()) != 0 {
+		t.Fatal("dialed without authentication")
+	}
+}
+
+func TestUsernameAuthenticationRequired(t *testing.T) {
+	_, addr, _ := newTestServer(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// No authentication only
+	conn.Write([]byte{version5, 1, 0})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != methodNoAcceptable {
+		t.Fatalf("expected no acceptable method, got %v", reply)
+	}
+}
+
+func TestRefusedWithoutAuthenticate(t *testing.T) {
+	s := &Server{
+		Dial: func(clientKey, caller, network, address string) (net.Conn, error) {
+			t.Fatal("dialed without Authenticate")
+			return nil, nil
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(l); err != errNoAuthenticate {
+		t.Fatalf("expected %v, got %v", errNoAuthenticate, err)
+	}
+
+	// Connections served directly are refused
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.ServeConn(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte{version5, 1, methodUserPass})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	client.Write([]byte{userPassVersion, 1, 'u', 1, 'p'})
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] == 0 {
+		t.Fatal("authenticated without Authenticate")
+	}
+}
+
+func TestReplyCode(t *testing.T) {
+	tests := []struct {
+		err error
+		rep byte
+	}{
+		{errors.New("dial tcp 10.0.0.1:80: connect: connection refused"), repConnectionRefused},
+		{errors.New("failed to find Session for client agent"), repNetworkUnreachable},
+		{errors.New("hop limit exceeded"), repNetworkUnreachable},
+		{errors.New("connect not allowed"), repFailure},
+	}
+	for _, test := range tests {
+		if rep := replyCode(test.err); rep != test.rep {
+			t.Errorf("%v: expected %d, got %d", test.err, test.rep, rep)
+		}
+	}
+
+	s, _, _ := newTestServer(t)
+	s.Dial = func(clientKey, caller, network, address string) (net.Conn, error) {
+		return nil, errors.New("failed to find Session for client " + clientKey)
+	}
+	conn, _ := authenticate(t, serve(t, s), "user", "password")
+	defer conn.Close()
+	if rep, _ := request(t, conn, cmdConnect, "example.com:80"); rep != repNetworkUnreachable {
+		t.Fatalf("expected %d, got %d", repNetworkUnreachable, rep)
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	tests := []struct {
+		address string
+		encoded []byte
+	}{
+		{"1.2.3.4:53", []byte{atypIPv4, 1, 2, 3, 4, 0, 53}},
+		{"example.com:443", append(append([]byte{atypDomain, 11}, "example.com"...), 1, 187)},
+		{"[::1]:8080", append(append([]byte{atypIPv6}, net.IPv6loopback...), 0x1f, 0x90)},
+	}
+	for _, test := range tests {
+		encoded, err := appendHostPort(nil, test.address)
+		if err != nil || !bytes.Equal(encoded, test.encoded) {
+			t.Errorf("%s: encoded as %v, %v", test.address, encoded, err)
+		}
+		if address, err := readAddress(bytes.NewReader(test.encoded)); err != nil || address != test.address {
+			t.Errorf("%v: read %s, %v", test.encoded, address, err)
+		}
+	}
+
+	if _, err := readAddress(bytes.NewReader([]byte{2, 0, 0})); err != errUnsupportedAddress {
+		t.Fatalf("expected %v, got %v", errUnsupportedAddress, err)
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	// Writes back the datagrams it receives in upper case
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, from, err := target.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			target.WriteToUDP(bytes.ToUpper(buf[:n]), from)
+		}
+	}()
+	_, addr, dials := newTestServer(t)
+
+	conn, _ := authenticate(t, addr, "user", "password")
+	defer conn.Close()
+	rep, bound := request(t, conn, cmdUDPAssociate, "0.0.0.0:0")
+	if rep != repSuccess {
+		t.Fatalf("associate failed with %d", rep)
+	}
+
+	relay, err := net.Dial("udp", bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+
+	address := net.JoinHostPort("localhost", strconv.Itoa(target.LocalAddr().(*net.UDPAddr).Port))
+	header, err := appendHostPort([]byte{0, 0, 0}, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		relay.Write(append(header, "ping"...))
+		relay.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, maxDatagram)
+		n, err := relay.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Replies keep the domain name the client sent to
+		if expected := append(header, "PING"...); !bytes.Equal(buf[:n], expected) {
+			t.Fatalf("expected %v, got %v", expected, buf[:n])
+		}
+	}
+
+	expected := dialed{clientKey: "agent", caller: "user", network: "udp", address: address}
+	if d := dials(); len(d) != 1 || d[0] != expected {
+		t.Fatalf("expected one dial %+v, got %+v", expected, d)
+	}
+}
@@ -0,0 +1,169 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxDatagram is the largest UDP payload relayed. The tunnel keeps datagram boundaries only up
+// to remotedialer.MaxRead bytes, larger ones are split.
+const maxDatagram = 65507
+
+// udpAssociate relays datagrams between the client and UDP connections dialed through the
+// agent, one per destination, until the control connection closes.
+func (s *Server) udpAssociate(conn net.Conn, clientKey, caller string) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	remote, remoteOK := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !remoteOK {
+		writeReply(conn, repFailure, nil)
+		return
+	}
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		writeReply(conn, repFailure, nil)
+		return
+	}
+	defer relay.Close()
+
+	if err := writeReply(conn, repSuccess, relay.LocalAddr()); err != nil {
+		return
+	}
+
+	association := &udpAssociation{
+		server:    s,
+		clientKey: clientKey,
+		caller:    caller,
+		relay:     relay,
+		clientIP:  remote.IP,
+		targets:   map[string]net.Conn{},
+	}
+	defer association.close()
+	go association.serve()
+
+	// The association lasts as long as the control connection
+	conn.SetDeadline(time.Time{})
+	io.Copy(ioutil.Discard, conn)
+}
+
+type udpAssociation struct {
+	sync.Mutex
+
+	server    *Server
+	clientKey string
+	caller    string
+	relay     *net.UDPConn
+	clientIP  net.IP
+	client    *net.UDPAddr
+	targets   map[string]net.Conn
+}
+
+func (a *udpAssociation) serve() {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !from.IP.Equal(a.clientIP) {
+			continue
+		}
+
+		a.Lock()
+		if a.client == nil {
+			a.client = from
+		}
+		a.Unlock()
+
+		// RSV(2) FRAG(1), fragmented datagrams are dropped
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		reader := bytes.NewReader(buf[3:n])
+		address, err := readAddress(reader)
+		if err != nil {
+			continue
+		}
+
+		target, err := a.target(address)
+		if err != nil {
+			logrus.Debugf("SOCKS UDP to %s through [%s] failed: %v", address, a.clientKey, err)
+			continue
+		}
+		target.Write(buf[n-reader.Len() : n])
+	}
+}
+
+func (a *udpAssociation) target(address string) (net.Conn, error) {
+	a.Lock()
+	target := a.targets[address]
+	a.Unlock()
+	if target != nil {
+		return target, nil
+	}
+
+	target, err := a.server.Dial(a.clientKey, a.caller, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	a.Lock()
+	if existing := a.targets[address]; existing != nil {
+		a.Unlock()
+		target.Close()
+		return existing, nil
+	}
+	a.targets[address] = target
+	a.Unlock()
+
+	go a.replies(address, target)
+	return target, nil
+}
+
+// replies relays the datagrams of target back to the client.
+func (a *udpAssociation) replies(address string, target net.Conn) {
+	defer func() {
+		a.Lock()
+		if a.targets[address] == target {
+			delete(a.targets, address)
+		}
+		a.Unlock()
+		target.Close()
+	}()
+
+	// Replies come from the address the client sent to, domain names included
+	header, err := appendHostPort([]byte{0, 0, 0}, address)
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, maxDatagram)
+	for {
+		n, err := target.Read(buf)
+		if err != nil {
+			return
+		}
+
+		a.Lock()
+		client := a.client
+		a.Unlock()
+
+		a.relay.WriteToUDP(append(header[:len(header):len(header)], buf[:n]...), client)
+	}
+}
+
+func (a *udpAssociation) close() {
+	a.relay.Close()
+
+	a.Lock()
+	defer a.Unlock()
+	for _, target := range a.targets {
+		target.Close()
+	}
+}
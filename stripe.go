@@ -0,0 +1,290 @@
+package remotedialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// Stripes is sent by the client with the number of websockets it wants for its session,
+	// and returned by the server with the number it accepted.
+	Stripes = "X-API-Tunnel-Stripes"
+	// StripeToken is returned by the server with the token the client uses to join additional
+	// websockets to its session.
+	StripeToken = "X-API-Tunnel-Stripe-Token"
+
+	errStripeClosed = errors.New("tunnel stripe closed")
+	errStripeLimit  = errors.New("too many websockets for session")
+)
+
+// stripeJoinTimeout is how long a joining websocket waits for its session to be registered.
+const stripeJoinTimeout = time.Second
+
+// Striped sessions spread their tunneled connections over several websockets so they aren't
+// all serialized through one reader and one writer. Each connection is pinned to a single
+// websocket, keeping its messages in order. Stripe 0 is the session's primary websocket, if any
+// other websocket fails the connections using it are closed and the session carries on with
+// the remaining ones.
+
+func (s *Session) stripeConn(stripe int64) *wsConn {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	if stripe == 0 {
+		return s.conn
+	}
+	return s.stripes[stripe]
+}
+
+// pickStripe spreads new connections over the live websockets.
+func (s *Session) pickStripe(connID int64) int64 {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	if len(s.stripes) == 0 {
+		return 0
+	}
+
+	stripes := []int64{0}
+	for i := range s.stripes {
+		stripes = append(stripes, i)
+	}
+	sort.Slice(stripes, func(i, j int) bool {
+		return stripes[i] < stripes[j]
+	})
+	return stripes[connID%int64(len(stripes))]
+}
+
+// addStripe adds ws to the session, failing if the session already has the negotiated number
+// of websockets.
+func (s *Session) addStripe(ws *websocket.Conn) (int64, error) {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	if !s.canAddStripe() {
+		return 0, errStripeLimit
+	}
+	if s.stripes == nil {
+		s.stripes = map[int64]*wsConn{}
+	}
+	s.nextStripe++
+	s.stripes[s.nextStripe] = newWSConn(ws)
+	return s.nextStripe, nil
+}
+
+// canAddStripe is called with connLock held. A maxStripes of zero sets no limit.
+func (s *Session) canAddStripe() bool {
+	return s.maxStripes <= 0 || len(s.stripes)+1 < s.maxStripes
+}
+
+func (s *Session) stripesFull() bool {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	return !s.canAddStripe()
+}
+
+// removeStripe closes a failed websocket and the connections that were using it.
+func (s *Session) removeStripe(stripe int64) {
+	s.connLock.Lock()
+	conn := s.stripes[stripe]
+	delete(s.stripes, stripe)
+	s.connLock.Unlock()
+
+	if conn != nil {
+		conn.conn.Close()
+	}
+
+	s.Lock()
+	var connIDs []int64
+	for connID, c := range s.conns {
+		if c.getStripe() == stripe {
+			connIDs = append(connIDs, connID)
+		}
+	}
+	s.Unlock()
+
+	for _, connID := range connIDs {
+		s.closeConnection(connID, errStripeClosed)
+	}
+}
+
+func (s *Session) closeStripes() {
+	s.connLock.Lock()
+	stripes := s.stripes
+	s.stripes = nil
+	s.connLock.Unlock()
+
+	for _, conn := range stripes {
+		conn.conn.Close()
+	}
+}
+
+// serveStripe reads messages from an additional websocket until it fails.
+func (s *Session) serveStripe(ctx context.Context, stripe int64, opts ServeOptions) (int, error) {
+	defer s.removeStripe(stripe)
+
+	conn := s.stripeConn(stripe)
+	if conn == nil {
+		return 400, errStripeClosed
+	}
+
+	pingCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go pings(pingCtx, conn, opts)
+
+	return s.serveConn(ctx, conn, stripe, opts)
+}
+
+func (c *connection) getStripe() int64 {
+	return atomic.LoadInt64(&c.stripe)
+}
+
+func (c *connection) setStripe(stripe int64) {
+	atomic.StoreInt64(&c.stripe, stripe)
+}
+
+// stripeSession returns the session a websocket with token should join, waiting until ctx is
+// done for the handler of the primary websocket to register it.
+func (sm *sessionManager) stripeSession(ctx context.Context, clientKey, token string) *Session {
+	for {
+		sm.Lock()
+		session := sm.striped[token]
+		registered := sm.stripeRegistered
+		sm.Unlock()
+
+		if session != nil {
+			if session.clientKey != clientKey {
+				return nil
+			}
+			return session
+		}
+
+		select {
+		case <-registered:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// setStripeToken lets up to stripes websockets, counting the primary one, join s with token.
+func (sm *sessionManager) setStripeToken(s *Session, token string, stripes int) {
+	s.connLock.Lock()
+	s.maxStripes = stripes
+	s.connLock.Unlock()
+
+	sm.Lock()
+	defer sm.Unlock()
+
+	if s.stripeToken != "" && sm.striped[s.stripeToken] == s {
+		delete(sm.striped, s.stripeToken)
+	}
+	s.stripeToken = token
+	sm.striped[token] = s
+
+	close(sm.stripeRegistered)
+	sm.stripeRegistered = make(chan struct{})
+}
+
+// serveStripe joins an additional websocket to the session identified by the StripeToken
+// header of req.
+func (s *Server) serveStripe(rw http.ResponseWriter, req *http.Request, upgrader *websocket.Upgrader, clientKey string) {
+	// The client may join before the handler of its primary websocket registered the token
+	ctx, cancel := context.WithTimeout(req.Context(), stripeJoinTimeout)
+	session := s.sessions.stripeSession(ctx, clientKey, req.Header.Get(StripeToken))
+	cancel()
+	if session == nil {
+		s.errorWriter(rw, req, 404, fmt.Errorf("no session to join for [%s]", clientKey))
+		return
+	}
+	if session.stripesFull() {
+		s.errorWriter(rw, req, 429, fmt.Errorf("%v [%s]", errStripeLimit, clientKey))
+		return
+	}
+
+	wsConn, err := upgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		s.errorWriter(rw, req, 400, fmt.Errorf("error during upgrade for host [%v]: %v", clientKey, err))
+		return
+	}
+
+	stripe, err := session.addStripe(wsConn)
+	if err != nil {
+		// Another websocket joined since the check
+		logrus.Infof("Refusing websocket for backend connection [%s]: %v", clientKey, err)
+		wsConn.Close()
+		return
+	}
+	logrus.Infof("Added websocket %d to backend connection [%s]", stripe, clientKey)
+
+	code, err := session.serveStripe(s.ctx, stripe, s.ServeOptions)
+	if err != nil {
+		logrus.Infof("error in remotedialer server stripe [%d]: %v", code, err)
+	}
+}
+
+// stripeHeader returns the Stripes response header for a client requesting stripes, or nil.
+func (s *Server) stripeHeader(req *http.Request) (int, http.Header) {
+	requested, err := strconv.Atoi(req.Header.Get(Stripes))
+	if err != nil || requested <= 1 || s.MaxStripes <= 1 {
+		return 0, nil
+	}
+	if requested > s.MaxStripes {
+		requested = s.MaxStripes
+	}
+
+	header := http.Header{}
+	header.Set(Stripes, strconv.Itoa(requested))
+	header.Set(StripeToken, newResumeToken())
+	return requested, header
+}
+
+// dialStripes opens the additional websockets the server accepted for session.
+func dialStripes(ctx context.Context, session *Session, dialer *websocket.Dialer, wsURL string, headers http.Header, resp *http.Response, opts ServeOptions) {
+	count, err := strconv.Atoi(resp.Header.Get(Stripes))
+	token := resp.Header.Get(StripeToken)
+	if err != nil || token == "" {
+		return
+	}
+
+	headers = cloneHeader(headers)
+	headers.Del(Stripes)
+	headers.Del(ResumeToken)
+	headers.Set(StripeToken, token)
+
+	for i := 1; i < count; i++ {
+		ws, resp, err := dialFollowingRedirects(dialer, wsURL, headers)
+		if err != nil {
+			if resp != nil {
+				body, _ := ioutil.ReadAll(resp.Body)
+				logrus.WithError(err).Errorf("Failed to add websocket to proxy session: %s", body)
+			} else {
+				logrus.WithError(err).Error("Failed to add websocket to proxy session")
+			}
+			return
+		}
+
+		stripe, err := session.addStripe(ws)
+		if err != nil {
+			ws.Close()
+			return
+		}
+		go func() {
+			defer ws.Close()
+			if _, err := session.serveStripe(ctx, stripe, opts); err != nil {
+				logrus.WithError(err).Debugf("Proxy websocket %d closed", stripe)
+			}
+		}()
+	}
+}
@@ -0,0 +1,85 @@
+package remotedialer
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func stripeCount(session *Session) int {
+	session.connLock.Lock()
+	defer session.connLock.Unlock()
+
+	return len(session.stripes)
+}
+
+func TestStripesLimitedByServer(t *testing.T) {
+	echo, closeEcho := listenEcho(t)
+	defer closeEcho()
+	server, url, closeServer := newTestServer()
+	defer closeServer()
+	server.MaxStripes = 3
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connectClient(ctx, url, "foo", ClientOptions{Stripes: 4})
+
+	var session *Session
+	if !waitFor(func() bool {
+		sessions := clientSessions(server, "foo")
+		if len(sessions) == 0 {
+			return false
+		}
+		session = sessions[0]
+		return stripeCount(session) == server.MaxStripes-1
+	}) {
+		t.Fatal("additional stripes did not join")
+	}
+
+	server.sessions.Lock()
+	token := session.stripeToken
+	server.sessions.Unlock()
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{
+		clientKeyHeader: {"foo"},
+		StripeToken:     {token},
+	})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("stripe joined past MaxStripes: %v", err)
+	}
+
+	start := time.Now()
+	_, resp, err = websocket.DefaultDialer.Dial(url, http.Header{
+		clientKeyHeader: {"foo"},
+		StripeToken:     {"unknown"},
+	})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("stripe joined with an unknown token: %v", err)
+	}
+	if time.Since(start) < stripeJoinTimeout {
+		t.Fatal("unknown token refused before the session could register")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkEcho(t, server, "foo", echo)
+		}()
+	}
+	wg.Wait()
+
+	// Connections fall back to the remaining stripes
+	session.stripeConn(1).conn.Close()
+	if !waitFor(func() bool { return stripeCount(session) < server.MaxStripes-1 }) {
+		t.Fatal("closed stripe was not removed")
+	}
+	for i := 0; i < 6; i++ {
+		checkEcho(t, server, "foo", echo)
+	}
+}
@@ -0,0 +1,223 @@
+package remotedialer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errExpiredToken = errors.New("token expired")
+)
+
+// TokenSource returns the bearer token to present to the server. It is called before every
+// connection attempt so short lived tokens can be refreshed.
+type TokenSource func(ctx context.Context) (string, error)
+
+// TokenClaims are the registered JWT claims understood by TokenAuthorizer.
+type TokenClaims struct {
+	Subject   string `json:"sub,omitempty"`
+	Audience  string `json:"aud,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+type TokenAuthorizerConfig struct {
+	// Keys maps key IDs to HMAC-SHA256 secrets. Tokens carrying a "kid" header are only checked
+	// against that key, others against every key.
+	Keys map[string][]byte
+	// Audience, if set, must match the "aud" claim.
+	Audience string
+	// ClientKeyClaim names the claim holding the client key, "sub" by default.
+	ClientKeyClaim string
+	// Leeway is the allowed clock skew when checking "exp" and "nbf".
+	Leeway time.Duration
+}
+
+// TokenAuthorizer authorizes websocket requests carrying a signed, expiring HS256 JWT in the
+// Authorization header.
+type TokenAuthorizer struct {
+	sync.RWMutex
+
+	config TokenAuthorizerConfig
+}
+
+func NewTokenAuthorizer(config TokenAuthorizerConfig) *TokenAuthorizer {
+	if config.ClientKeyClaim == "" {
+		config.ClientKeyClaim = "sub"
+	}
+	t := &TokenAuthorizer{}
+	t.config = config
+	t.SetKeys(config.Keys)
+	return t
+}
+
+// SetKeys replaces the set of active signing keys. To rotate, add the new key, move token
+// issuers to it, and remove the old key once its tokens have expired.
+func (t *TokenAuthorizer) SetKeys(keys map[string][]byte) {
+	copied := map[string][]byte{}
+	for k, v := range keys {
+		copied[k] = v
+	}
+
+	t.Lock()
+	t.config.Keys = copied
+	t.Unlock()
+}
+
+func (t *TokenAuthorizer) Authorize(req *http.Request) (string, bool, error) {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false, nil
+	}
+
+	clientKey, err := t.Verify(strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		return "", false, nil
+	}
+	return clientKey, true, nil
+}
+
+// Verify checks the signature, expiry and audience of token and returns its client key.
+func (t *TokenAuthorizer) Verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errInvalidToken
+	}
+
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", err
+	}
+	if header.Algorithm != "HS256" {
+		return "", fmt.Errorf("unsupported token algorithm %s", header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errInvalidToken
+	}
+	if !t.checkSignature(header.KeyID, parts[0]+"."+parts[1], signature) {
+		return "", errInvalidToken
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return "", errors.Wrap(errInvalidToken, "missing exp claim")
+	}
+	if now.Add(-t.config.Leeway).After(time.Unix(int64(exp), 0)) {
+		return "", errExpiredToken
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(t.config.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return "", errors.Wrap(errInvalidToken, "token not yet valid")
+	}
+
+	if t.config.Audience != "" && !hasAudience(claims["aud"], t.config.Audience) {
+		return "", errors.Wrap(errInvalidToken, "audience mismatch")
+	}
+
+	clientKey, _ := claims[t.config.ClientKeyClaim].(string)
+	if clientKey == "" {
+		return "", errors.Wrapf(errInvalidToken, "missing %s claim", t.config.ClientKeyClaim)
+	}
+
+	return clientKey, nil
+}
+
+func (t *TokenAuthorizer) checkSignature(keyID, signed string, signature []byte) bool {
+	t.RLock()
+	defer t.RUnlock()
+
+	if keyID != "" {
+		key, ok := t.config.Keys[keyID]
+		return ok && hmac.Equal(sign(key, signed), signature)
+	}
+
+	for _, key := range t.config.Keys {
+		if hmac.Equal(sign(key, signed), signature) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAudience(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, obj interface{}) error {
+	bytes, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errInvalidToken
+	}
+	if err := json.Unmarshal(bytes, obj); err != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+func sign(key []byte, signed string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+// SignToken creates an HS256 JWT for claims using key, identified by keyID.
+func SignToken(keyID string, key []byte, claims TokenClaims) (string, error) {
+	header, err := json.Marshal(tokenHeader{
+		Algorithm: "HS256",
+		Type:      "JWT",
+		KeyID:     keyID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(key, signed)), nil
+}
+
+// StaticTokenSource returns a TokenSource that always returns token.
+func StaticTokenSource(token string) TokenSource {
+	return func(context.Context) (string, error) {
+		return token, nil
+	}
+}
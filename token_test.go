@@ -0,0 +1,195 @@
+package remotedialer
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	testKey      = []byte("0123456789abcdef0123456789abcdef")
+	testOtherKey = []byte("fedcba9876543210fedcba9876543210")
+)
+
+func signTestToken(t *testing.T, keyID string, key []byte, claims TokenClaims) string {
+	token, err := SignToken(keyID, key, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestTokenVerify(t *testing.T) {
+	auth := NewTokenAuthorizer(TokenAuthorizerConfig{
+		Keys:     map[string][]byte{"k1": testKey},
+		Audience: "remotedialer",
+		Leeway:   time.Minute,
+	})
+	now := time.Now()
+	valid := TokenClaims{
+		Subject:   "foo",
+		Audience:  "remotedialer",
+		ExpiresAt: now.Add(time.Hour).Unix(),
+	}
+
+	tests := []struct {
+		name   string
+		claims func(c *TokenClaims)
+		key    []byte
+		valid  bool
+	}{
+		{"valid", func(c *TokenClaims) {}, testKey, true},
+		{"wrong key", func(c *TokenClaims) {}, testOtherKey, false},
+		{"expired", func(c *TokenClaims) { c.ExpiresAt = now.Add(-2 * time.Minute).Unix() }, testKey, false},
+		{"expired within leeway", func(c *TokenClaims) { c.ExpiresAt = now.Add(-30 * time.Second).Unix() }, testKey, true},
+		{"no expiry", func(c *TokenClaims) { c.ExpiresAt = 0 }, testKey, false},
+		{"not yet valid", func(c *TokenClaims) { c.NotBefore = now.Add(2 * time.Minute).Unix() }, testKey, false},
+		{"not yet valid within leeway", func(c *TokenClaims) { c.NotBefore = now.Add(30 * time.Second).Unix() }, testKey, true},
+		{"other audience", func(c *TokenClaims) { c.Audience = "other" }, testKey, false},
+		{"no audience", func(c *TokenClaims) { c.Audience = "" }, testKey, false},
+		{"no subject", func(c *TokenClaims) { c.Subject = "" }, testKey, false},
+	}
+	for _, test := range tests {
+		claims := valid
+		test.claims(&claims)
+		clientKey, err := auth.Verify(signTestToken(t, "", test.key, claims))
+		if test.valid && (err != nil || clientKey != "foo") {
+			t.Errorf("%s: rejected: %v", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+}
+
+func TestTokenAlgorithms(t *testing.T) {
+	auth := NewTokenAuthorizer(TokenAuthorizerConfig{
+		Keys: map[string][]byte{"k1": testKey},
+	})
+	token := signTestToken(t, "k1", testKey, TokenClaims{
+		Subject:   "foo",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+	parts := strings.Split(token, ".")
+
+	for _, header := range []string{
+		`{"alg":"none","typ":"JWT"}`,
+		`{"alg":"HS512","typ":"JWT","kid":"k1"}`,
+		`{"alg":"RS256","typ":"JWT","kid":"k1"}`,
+	} {
+		encoded := base64.RawURLEncoding.EncodeToString([]byte(header))
+		for _, forged := range []string{
+			encoded + "." + parts[1] + ".",
+			encoded + "." + parts[1] + "." + parts[2],
+		} {
+			if _, err := auth.Verify(forged); err == nil {
+				t.Errorf("token with header %s accepted", header)
+			}
+		}
+	}
+
+	for _, malformed := range []string{"", "a.b", "a.b.c.d", parts[0] + "." + parts[1] + ".!"} {
+		if _, err := auth.Verify(malformed); err == nil {
+			t.Errorf("malformed token %q accepted", malformed)
+		}
+	}
+}
+
+func TestTokenKeyRotation(t *testing.T) {
+	auth := NewTokenAuthorizer(TokenAuthorizerConfig{
+		Keys: map[string][]byte{"old": testKey},
+	})
+	claims := TokenClaims{
+		Subject:   "foo",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}
+	oldToken := signTestToken(t, "old", testKey, claims)
+	newToken := signTestToken(t, "new", testOtherKey, claims)
+	// A kid selects the key, signing with another key fails
+	mislabeled := signTestToken(t, "old", testOtherKey, claims)
+
+	if _, err := auth.Verify(newToken); err == nil {
+		t.Fatal("token of an unknown key accepted")
+	}
+
+	auth.SetKeys(map[string][]byte{"old": testKey, "new": testOtherKey})
+	for _, token := range []string{oldToken, newToken} {
+		if _, err := auth.Verify(token); err != nil {
+			t.Fatalf("token rejected during rotation: %v", err)
+		}
+	}
+	if _, err := auth.Verify(mislabeled); err == nil {
+		t.Fatal("token signed with another key than its kid accepted")
+	}
+
+	auth.SetKeys(map[string][]byte{"new": testOtherKey})
+	if _, err := auth.Verify(oldToken); err == nil {
+		t.Fatal("token of a removed key accepted")
+	}
+	if _, err := auth.Verify(newToken); err != nil {
+		t.Fatalf("token of the new key rejected: %v", err)
+	}
+}
+
+func TestTokenAuthorize(t *testing.T) {
+	auth := NewTokenAuthorizer(TokenAuthorizerConfig{
+		Keys:           map[string][]byte{"k1": testKey},
+		ClientKeyClaim: "aud",
+	})
+	token := signTestToken(t, "k1", testKey, TokenClaims{
+		Audience:  "cluster-1",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/connect", nil)
+	if _, ok, _ := auth.Authorize(req); ok {
+		t.Fatal("request without a token accepted")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if clientKey, ok, err := auth.Authorize(req); !ok || clientKey != "cluster-1" {
+		t.Fatalf("request rejected: %v", err)
+	}
+}
+
+func TestTokenSourceCalledOnEveryConnect(t *testing.T) {
+	auth := NewTokenAuthorizer(TokenAuthorizerConfig{
+		Keys: map[string][]byte{"k1": testKey},
+	})
+	server := New(auth.Authorize, DefaultErrorWriter)
+	hs := httptest.NewServer(server)
+	defer hs.Close()
+	url := "ws" + strings.TrimPrefix(hs.URL, "http")
+
+	// The first token is already expired, the client must get another one to connect
+	var calls int32
+	opts := ClientOptions{
+		Auth: func(string, string) bool { return true },
+		TokenSource: func(context.Context) (string, error) {
+			expires := time.Now().Add(time.Hour)
+			if atomic.AddInt32(&calls, 1) == 1 {
+				expires = time.Now().Add(-time.Hour)
+			}
+			return SignToken("k1", testKey, TokenClaims{
+				Subject:   "foo",
+				ExpiresAt: expires.Unix(),
+			})
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ConnectToProxyWithOptions(ctx, url, opts); err == nil {
+		t.Fatal("connected with an expired token")
+	}
+	go ConnectToProxyWithOptions(ctx, url, opts)
+	if !waitFor(func() bool { return server.HasSession("foo") }) {
+		t.Fatal("client did not connect with the refreshed token")
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("token source called %d times, expected 2", n)
+	}
+}
@@ -5,6 +5,11 @@ import "time"
 const (
 	PingWaitDuration  	= 60 * time.Second
 	PingWriteInterval 	= 5 * time.Second
+	// PongWaitDuration is how long a side sending pings waits for a pong before it considers
+	// the websocket dead, longer than a reader may stay blocked on a backed up connection
+	PongWaitDuration  	= 30 * time.Second
 	MaxRead           	= 8192
 	HandshakeTimeOut	= 10 * time.Second
+	// MaxPeerHops is the most servers a dial is forwarded through to reach a client
+	MaxPeerHops       	= 8
 )
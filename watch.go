@@ -0,0 +1,26 @@
+package remotedialer
+
+// removedListener calls f for every removed session.
+type removedListener struct {
+	f func(clientKey string)
+}
+
+func (l *removedListener) sessionAdded(clientKey string, sessionKey int64) {}
+
+func (l *removedListener) sessionRemoved(clientKey string, sessionKey int64) {
+	// Listeners are called with the session manager locked
+	go l.f(clientKey)
+}
+
+func (l *removedListener) routesUpdated(clientKey string, sessionKey int, routes []route) {}
+
+// OnSessionRemoved calls f, in a new goroutine, with the client key of every client or peer
+// session removed from the server, so state tied to the session such as pooled connections can
+// be dropped. The returned function stops the calls.
+func (s *Server) OnSessionRemoved(f func(clientKey string)) func() {
+	l := &removedListener{f: f}
+	s.sessions.addListener(l)
+	return func() {
+		s.sessions.removeListener(l)
+	}
+}
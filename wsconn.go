@@ -3,6 +3,7 @@ package remotedialer
 import (
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -10,12 +11,16 @@ import (
 
 type wsConn struct {
 	sync.Mutex
-	conn *websocket.Conn
+	conn        *websocket.Conn
+	scheduler   writeScheduler
+	readTimeout int64
+	rtt         rttStats
 }
 
 func newWSConn(conn *websocket.Conn) *wsConn {
 	w := &wsConn{
-		conn: conn,
+		conn:        conn,
+		readTimeout: int64(PingWaitDuration),
 	}
 	w.setupDeadline()
 	return w
@@ -32,16 +37,30 @@ func (w *wsConn) NextReader() (int, io.Reader, error) {
 	return w.conn.NextReader()
 }
 
+// setReadTimeout changes how long the websocket may go without receiving a ping or pong.
+func (w *wsConn) setReadTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&w.readTimeout, int64(timeout))
+	w.conn.SetReadDeadline(time.Now().Add(timeout))
+}
+
+func (w *wsConn) readDeadline() time.Time {
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&w.readTimeout)))
+}
+
 func (w *wsConn) setupDeadline() {
-	w.conn.SetReadDeadline(time.Now().Add(PingWaitDuration))
-	w.conn.SetPingHandler(func(string) error {
+	w.conn.SetReadDeadline(w.readDeadline())
+	w.conn.SetPingHandler(func(payload string) error {
+		// Echo the payload, it carries the timestamp the remote side measures RTT with
 		w.Lock()
-		w.conn.WriteControl(websocket.PongMessage, []byte(""), time.Now().Add(time.Second))
+		w.conn.WriteControl(websocket.PongMessage, []byte(payload), time.Now().Add(time.Second))
 		w.Unlock()
-		return w.conn.SetReadDeadline(time.Now().Add(PingWaitDuration))
+		return w.conn.SetReadDeadline(w.readDeadline())
 	})
-	w.conn.SetPongHandler(func(string) error {
-		return w.conn.SetReadDeadline(time.Now().Add(PingWaitDuration))
+	w.conn.SetPongHandler(func(payload string) error {
+		if rtt, ok := pongRTT(payload, time.Now()); ok {
+			w.rtt.add(rtt)
+		}
+		return w.conn.SetReadDeadline(w.readDeadline())
 	})
 
 }